@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around the changes of a hunk.
+const diffContext = 3
+
+// An edit is a line of a diff: a line kept, deleted from the old text or
+// inserted from the new one. a and b are the indexes of the line in the
+// old and the new text, of the next line for the texts it is not in.
+type edit struct {
+	op   byte // ' ', '-' or '+'
+	a, b int
+	line string
+}
+
+// unifiedDiff returns the unified diff of the texts a and b, named from and
+// to, like diff -u, nil when they are equal.
+func unifiedDiff(from, to string, a, b []byte) []byte {
+	edits := diffLines(splitLines(a), splitLines(b))
+	var out bytes.Buffer
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		// the hunk of the change at i goes on until diffContext lines after
+		// its last change not followed by another within 2*diffContext lines
+		start, end := i-diffContext, i
+		if start < 0 {
+			start = 0
+		}
+		for j := i; j < len(edits) && j-end <= 2*diffContext+1; j++ {
+			if edits[j].op != ' ' {
+				end = j
+			}
+		}
+		if end += diffContext + 1; end > len(edits) {
+			end = len(edits)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", from, to)
+		}
+		hunk := edits[start:end]
+		na, nb := 0, 0
+		for _, e := range hunk {
+			if e.op != '+' {
+				na++
+			}
+			if e.op != '-' {
+				nb++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(hunk[0].a, na), hunkRange(hunk[0].b, nb))
+		for _, e := range hunk {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.Bytes()
+}
+
+// hunkRange returns the range of the n lines from the line at index i in
+// a hunk header. An empty range starts at the line before.
+func hunkRange(i, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", i)
+	case 1:
+		return fmt.Sprint(i + 1)
+	}
+	return fmt.Sprintf("%d,%d", i+1, n)
+}
+
+// splitLines returns the lines of text with their newline.
+func splitLines(text []byte) []string {
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script turning the lines a into b,
+// found by the algorithm of Myers.
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	off := n + m + 1
+	// v[off+k] is the furthest x reached on the diagonal k = x-y; trace
+	// holds v before each step d, to follow the path back
+	v := make([]int, 2*off+1)
+	var trace [][]int
+	x, y := 0, 0
+search:
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y = x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+	edits := make([]edit, 0, n+m)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		prev := k - 1
+		if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+			prev = k + 1
+		}
+		px := v[off+prev]
+		py := px - prev
+		for x > px && y > py {
+			x--
+			y--
+			edits = append(edits, edit{' ', x, y, a[x]})
+		}
+		if d > 0 {
+			if x == px {
+				edits = append(edits, edit{'+', x, py, b[py]})
+			} else {
+				edits = append(edits, edit{'-', px, y, a[px]})
+			}
+		}
+		x, y = px, py
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
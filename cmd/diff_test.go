@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	cases := []struct {
+		a, b, want string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nx\nc\n", "--- t.orig\n+++ t\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"", "a\n", "--- t.orig\n+++ t\n@@ -0,0 +1 @@\n+a\n"},
+		{"a\n", "", "--- t.orig\n+++ t\n@@ -1 +0,0 @@\n-a\n"},
+		{"a\nb", "a\nb\n", "--- t.orig\n+++ t\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+		// changes more than 2*3 lines apart are in hunks of their own
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"x\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ny\n",
+			"--- t.orig\n+++ t\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+y\n",
+		},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n",
+			"x\n2\n3\n4\n5\n6\n7\ny\n",
+			"--- t.orig\n+++ t\n@@ -1,8 +1,8 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n",
+		},
+	}
+	for _, c := range cases {
+		if got := string(unifiedDiff("t.orig", "t", []byte(c.a), []byte(c.b))); got != c.want {
+			t.Errorf("%q -> %q:\ngot\n%s\nwant\n%s", c.a, c.b, got, c.want)
+		}
+	}
+}
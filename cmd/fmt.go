@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"fbnoi.com/gotpl/template"
+)
+
+// runFmt formats template files like gofmt: the formatted source is written
+// to the standard output, or back to the files with -w. Without files, the
+// standard input is formatted.
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write result to (source) file instead of stdout")
+	list := flags.Bool("l", false, "list files whose formatting differs from gotpl fmt's")
+	diff := flags.Bool("d", false, "display diffs instead of rewriting files")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gotpl fmt [flags] [path ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "gotpl fmt: cannot use -w with standard input")
+			return 2
+		}
+		if err := formatFile("<standard input>", os.Stdin, os.Stdout, *list, false, *diff); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return 0
+	}
+
+	code := 0
+	for _, path := range flags.Args() {
+		if err := formatPath(path, *list, *write, *diff); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 2
+		}
+	}
+	return code
+}
+
+func formatPath(path string, list, write, diff bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return formatFile(path, nil, os.Stdout, list, write, diff)
+	}
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isTemplate(info.Name()) {
+			return err
+		}
+		return formatFile(path, nil, os.Stdout, list, write, diff)
+	})
+}
+
+// isTemplate reports whether a file found in a directory is a template.
+func isTemplate(name string) bool {
+	switch filepath.Ext(name) {
+	case ".tpl", ".html", ".htm", ".twig":
+		return true
+	}
+	return false
+}
+
+func formatFile(path string, in io.Reader, out io.Writer, list, write, diff bool) error {
+	if in == nil {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	src, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	res, err := template.Format(src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	if !bytes.Equal(src, res) {
+		if list {
+			fmt.Fprintln(out, path)
+		}
+		if write {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if err = os.WriteFile(path, res, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		if diff {
+			out.Write(unifiedDiff(path+".orig", path, src, res))
+		}
+	}
+	if !list && !write && !diff {
+		_, err = out.Write(res)
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fbnoi.com/gotpl/template"
+)
+
+// runGen generates the Go package rendering template files and directories,
+// with one function per template. It is meant to be run by go generate,
+// e.g.
+//
+//	//go:generate gotpl gen -pkg views -root templates -o views_gen.go templates/...
+func runGen(args []string) int {
+	flags := flag.NewFlagSet("gen", flag.ExitOnError)
+	pkg := flags.String("pkg", "", "name of the package; the name of the directory of -o by default")
+	root := flags.String("root", "", "directory the paths of the templates, includes and extends are relative to")
+	out := flags.String("o", "", "file to write the code to instead of stdout")
+	imports := flags.String("import", "", "comma separated packages of the qualified types of the params")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gotpl gen [flags] path[/...] ...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if *pkg == "" {
+		*pkg = "templates"
+		if *out != "" {
+			if abs, err := filepath.Abs(*out); err == nil {
+				*pkg = filepath.Base(filepath.Dir(abs))
+			}
+		}
+	}
+
+	var names []string
+	for _, arg := range flags.Args() {
+		paths, err := templateFiles(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		for _, path := range paths {
+			name, err := filepath.Rel(filepath.Join(*root, "."), path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			names = append(names, filepath.ToSlash(name))
+		}
+	}
+
+	g := &template.Generator{Package: *pkg, Root: *root}
+	if *imports != "" {
+		g.Imports = strings.Split(*imports, ",")
+	}
+	src, err := g.Generate(names)
+	if err != nil {
+		fmt.Fprint(os.Stderr, template.FormatError(err))
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(src)
+		return 0
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
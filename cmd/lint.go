@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fbnoi.com/gotpl/template"
+)
+
+// runLint checks template files and directories, reporting the problems
+// found as file:line:col messages, or as a JSON array with -json. The exit
+// status is 1 when problems are found.
+func runLint(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the problems as JSON")
+	enable := flags.String("enable", "", "comma separated rules to run instead of all of them")
+	disable := flags.String("disable", "", "comma separated rules not to run")
+	root := flags.String("root", "", "directory the paths of includes and extends are relative to")
+	globals := flags.String("globals", "", "comma separated variables defined for every template")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gotpl lint [flags] path[/...] ...")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "rules:")
+		for _, r := range template.LintRules {
+			fmt.Fprintf(os.Stderr, "  %-18s %s\n", r.Name, r.Doc)
+		}
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	rules, err := lintRules(*enable, *disable)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	linter := &template.Linter{Root: *root, Rules: rules}
+	if *globals != "" {
+		linter.Globals = strings.Split(*globals, ",")
+	}
+
+	diags := []*template.Diagnostic{}
+	for _, arg := range flags.Args() {
+		paths, err := templateFiles(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		for _, path := range paths {
+			ds, err := linter.LintFile(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			diags = append(diags, ds...)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(diags)
+	} else {
+		for _, d := range diags {
+			fmt.Println(d)
+		}
+	}
+	if len(diags) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// lintRules returns the rules enabled, all of them unless some are, minus
+// the ones disabled.
+func lintRules(enable, disable string) ([]*template.LintRule, error) {
+	rules := template.LintRules
+	if enable != "" {
+		rules = nil
+		for _, name := range strings.Split(enable, ",") {
+			r := template.LookupLintRule(strings.TrimSpace(name))
+			if r == nil {
+				return nil, fmt.Errorf("gotpl lint: unknown rule %s", name)
+			}
+			rules = append(rules, r)
+		}
+	}
+	disabled := map[string]bool{}
+	for _, name := range strings.Split(disable, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if template.LookupLintRule(name) == nil {
+			return nil, fmt.Errorf("gotpl lint: unknown rule %s", name)
+		}
+		disabled[name] = true
+	}
+	enabled := []*template.LintRule{}
+	for _, r := range rules {
+		if !disabled[r.Name] {
+			enabled = append(enabled, r)
+		}
+	}
+	return enabled, nil
+}
+
+// templateFiles returns the template files of arg, a file or a directory
+// searched recursively, optionally followed by /... as in Go packages.
+func templateFiles(arg string) ([]string, error) {
+	arg = strings.TrimSuffix(arg, "/...")
+	info, err := os.Stat(arg)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{arg}, nil
+	}
+	var paths []string
+	err = filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && isTemplate(info.Name()) {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	return paths, err
+}
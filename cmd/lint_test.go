@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"fbnoi.com/gotpl/template"
+)
+
+func TestLintRules(t *testing.T) {
+	var all []string
+	for _, r := range template.LintRules {
+		all = append(all, r.Name)
+	}
+	cases := []struct {
+		enable, disable string
+		want            []string
+	}{
+		{"", "", all},
+		{"unclosed-block, unused-set", "", []string{"unclosed-block", "unused-set"}},
+		{"unclosed-block,unused-set", "unclosed-block", []string{"unused-set"}},
+		{"", "unclosed-block", without(all, "unclosed-block")},
+		{"", "unknown-tag,unclosed-block", without(without(all, "unknown-tag"), "unclosed-block")},
+		{"nope", "", nil},
+		{"", "unused-set,nope", nil},
+	}
+	for _, c := range cases {
+		rules, err := lintRules(c.enable, c.disable)
+		var got []string
+		for _, r := range rules {
+			got = append(got, r.Name)
+		}
+		if c.want == nil && err == nil || c.want != nil && (err != nil || !reflect.DeepEqual(got, c.want)) {
+			t.Errorf("-enable %q -disable %q: got %q, %v, want %q", c.enable, c.disable, got, err, c.want)
+		}
+	}
+}
+
+// TestLintDisable checks that the problems of a disabled rule are not
+// reported, and the others are.
+func TestLintDisable(t *testing.T) {
+	code := []byte("{% set x = 1 %}{% if a %}{% for i = 0; i < 2; i++ %}{% endif %}")
+	for _, c := range []struct {
+		disable string
+		want    []string
+	}{
+		{"", []string{"unused-set", "unclosed-block"}},
+		{"unclosed-block", []string{"unused-set"}},
+		{"unused-set", []string{"unclosed-block"}},
+		{"unused-set,unclosed-block", nil},
+	} {
+		rules, err := lintRules("", c.disable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range (&template.Linter{Rules: rules}).Lint("t.html", code) {
+			got = append(got, d.Rule)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("-disable %q: got %q, want %q", c.disable, got, c.want)
+		}
+	}
+}
+
+func without(list []string, s string) []string {
+	var l []string
+	for _, x := range list {
+		if x != s {
+			l = append(l, x)
+		}
+	}
+	return l
+}
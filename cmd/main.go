@@ -2,16 +2,29 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"strings"
 
 	"fbnoi.com/gotpl/template"
-	"github.com/pkg/errors"
 )
 
+// commands are the subcommands of gotpl, run with the rest of the arguments.
+var commands = map[string]func(args []string) int{
+	"fmt":  runFmt,
+	"gen":  runGen,
+	"lint": runLint,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
 	sb := &strings.Builder{}
 	if err := template.Render(sb, "./cmd/test.html"); err != nil {
-		panic(errors.WithStack(err))
+		fmt.Fprint(os.Stderr, template.FormatErrorANSI(err))
+		os.Exit(1)
 	}
 	fmt.Println(sb.String())
 }
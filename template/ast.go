@@ -2,13 +2,24 @@ package template
 
 const NoPos Pos = 0
 
+// Pos is the position of a byte in the source of a template: its offset
+// plus one, so that the zero value is NoPos. Use Source.Position to get the
+// line and column of a Pos.
 type Pos int
 
 func (p Pos) Position() Pos {
 	return p
 }
 
+// IsValid reports whether the position is valid.
+func (p Pos) IsValid() bool {
+	return p != NoPos
+}
+
+// All node types implement the ASTNode interface.
 type ASTNode interface {
+	Pos() Pos // position of first character belonging to the node
+	End() Pos // position of first character immediately after the node
 }
 
 // All expression nodes implement the Expr interface.
@@ -37,58 +48,169 @@ type AppendAble interface {
 // Expressions
 
 type (
+	// A BadExpr node is a placeholder for an expression containing
+	// syntax errors for which a correct expression node cannot be
+	// created.
+	BadExpr struct {
+		From, To Pos // position range of bad expression
+	}
+
 	Ident struct {
-		Name string // identifier name
+		NamePos Pos    // identifier position
+		Name    string // identifier name
 	}
 
 	BasicLit struct {
-		Kind  int    // TYPE_NUMBER, TYPE_STRING
-		Value string // literal string; e.g. 42, 0x7f, 3.14, 1e-9, 2.4i, 'a', etc.
+		ValuePos Pos    // literal position
+		Kind     int    // TYPE_NUMBER, TYPE_STRING
+		Value    string // literal string; e.g. 42, 0x7f, 3.14, 1e-9, 2.4i, 'a', etc.
 	}
 
 	OpLit struct {
-		Op string // literal string; e.g. + - * /
+		OpPos Pos    // position of Op
+		Op    string // literal string; e.g. + - * /
 	}
 
 	// An IndexExpr node represents an expression followed by an index.
 	IndexExpr struct {
-		X     Expr // expression
-		Index Expr // index expression
+		X      Expr // expression
+		Lbrack Pos  // position of "["
+		Index  Expr // index expression
+		Rbrack Pos  // position of "]"
 	}
 
 	ParenExpr struct {
-		Kind  int    // TYPE_OPERATOR
-		Paren string // literal paren; (, )
+		ParenPos Pos    // position of Paren
+		Kind     int    // TYPE_OPERATOR
+		Paren    string // literal paren; (, )
+	}
+
+	// A SelectorExpr node represents an expression followed by a selector.
+	SelectorExpr struct {
+		X   Expr   // expression
+		Sel *Ident // field selector
 	}
 
-	// A CallExpr node represents an expression followed by an argument list.
+	// A CallExpr node represents an expression followed by an argument
+	// list, or a filter, i.e. a function applied to the expression
+	// preceding it, which is its first argument.
 	CallExpr struct {
-		Fun  Expr      // function expression
-		Args *ArgsExpr // function arguments; or nil
+		Pipe   Pos       // position of "|" of a filter; or NoPos
+		Fun    Expr      // function expression
+		Lparen Pos       // position of "("; or NoPos for a filter without arguments
+		Args   *ArgsExpr // function arguments; or nil
+		Rparen Pos       // position of ")"; or NoPos for a filter without arguments
 	}
 
 	ArgsExpr struct {
 		List []Expr // function arguments
 	}
 
+	// A UnaryExpr node represents a unary expression.
+	UnaryExpr struct {
+		Op OpLit // operator
+		X  Expr  // operand
+	}
+
 	// A BinaryExpr node represents a binary expression.
 	BinaryExpr struct {
 		X  Expr  // left operand
 		Op OpLit // operator
 		Y  Expr  // right operand
 	}
+
+	// A TestExpr node represents an expression tested with is, e.g.
+	// x is divisible by(3).
+	TestExpr struct {
+		X      Expr      // tested expression
+		Is     Pos       // position of "is"
+		Not    bool      // whether the test is negated with is not
+		Name   *Ident    // test name, its words separated by a space
+		Lparen Pos       // position of "("; or NoPos
+		Args   *ArgsExpr // test arguments; or nil
+		Rparen Pos       // position of ")"; or NoPos
+	}
 )
 
+// Pos and End implementations for expression nodes.
+
+func (x *BadExpr) Pos() Pos   { return x.From }
+func (x *Ident) Pos() Pos     { return x.NamePos }
+func (x *BasicLit) Pos() Pos  { return x.ValuePos }
+func (x *OpLit) Pos() Pos     { return x.OpPos }
+func (x *IndexExpr) Pos() Pos { return x.X.Pos() }
+func (x *ParenExpr) Pos() Pos { return x.ParenPos }
+func (x *SelectorExpr) Pos() Pos {
+	return x.X.Pos()
+}
+func (x *CallExpr) Pos() Pos {
+	if x.Pipe.IsValid() {
+		return x.Args.List[0].Pos()
+	}
+	return x.Fun.Pos()
+}
+func (x *ArgsExpr) Pos() Pos {
+	if len(x.List) > 0 {
+		return x.List[0].Pos()
+	}
+	return NoPos
+}
+func (x *UnaryExpr) Pos() Pos  { return x.Op.OpPos }
+func (x *BinaryExpr) Pos() Pos { return x.X.Pos() }
+func (x *TestExpr) Pos() Pos   { return x.X.Pos() }
+
+func (x *BadExpr) End() Pos   { return x.To }
+func (x *Ident) End() Pos     { return endOf(x.NamePos, x.Name) }
+func (x *BasicLit) End() Pos  { return endOf(x.ValuePos, x.Value) }
+func (x *OpLit) End() Pos     { return endOf(x.OpPos, x.Op) }
+func (x *IndexExpr) End() Pos { return endOf(x.Rbrack, "]") }
+func (x *ParenExpr) End() Pos { return endOf(x.ParenPos, x.Paren) }
+func (x *SelectorExpr) End() Pos {
+	return x.Sel.End()
+}
+func (x *CallExpr) End() Pos {
+	if !x.Rparen.IsValid() {
+		return x.Fun.End()
+	}
+	return endOf(x.Rparen, ")")
+}
+func (x *ArgsExpr) End() Pos {
+	if len(x.List) > 0 {
+		return x.List[len(x.List)-1].End()
+	}
+	return NoPos
+}
+func (x *UnaryExpr) End() Pos  { return x.X.End() }
+func (x *BinaryExpr) End() Pos { return x.Y.End() }
+func (x *TestExpr) End() Pos {
+	if !x.Rparen.IsValid() {
+		return x.Name.End()
+	}
+	return endOf(x.Rparen, ")")
+}
+
+// endOf returns the position after the text lit starting at pos.
+func endOf(pos Pos, lit string) Pos {
+	if !pos.IsValid() {
+		return NoPos
+	}
+	return pos + Pos(len(lit))
+}
+
 // exprNode() ensures that only expression/type nodes can be
 // assigned to an Expr.
 //
-func (*Ident) exprNode()      {}
-func (*BasicLit) exprNode()   {}
-func (*OpLit) exprNode()      {}
-func (*IndexExpr) exprNode()  {}
-func (*CallExpr) exprNode()   {}
-func (*ArgsExpr) exprNode()   {}
-func (*BinaryExpr) exprNode() {}
+func (*BadExpr) exprNode()      {}
+func (*Ident) exprNode()        {}
+func (*BasicLit) exprNode()     {}
+func (*OpLit) exprNode()        {}
+func (*IndexExpr) exprNode()    {}
+func (*SelectorExpr) exprNode() {}
+func (*CallExpr) exprNode()     {}
+func (*ArgsExpr) exprNode()     {}
+func (*UnaryExpr) exprNode()    {}
+func (*BinaryExpr) exprNode()   {}
+func (*TestExpr) exprNode()     {}
 
 // ----------------------------------------------------------------------------
 // Convenience functions for Idents
@@ -96,10 +218,14 @@ func (*BinaryExpr) exprNode() {}
 // NewIdent creates a new Ident without position.
 // Useful for ASTs generated by code other than the Go parser.
 //
-func NewIdent(name string) *Ident { return &Ident{name} }
+func NewIdent(name string) *Ident { return &Ident{Name: name} }
 
 // ----------------------------------------------------------------------------
 // Statements
+//
+// TagPos is the position of the opening delimiter of the tag of a statement,
+// e.g. "{%", and EndPos the position after the closing delimiter of its last
+// tag, e.g. "%}" of "{% endif %}".
 
 type (
 
@@ -107,14 +233,17 @@ type (
 	// a short variable declaration.
 	//
 	AssignStmt struct {
-		Lh  Expr   // Ident
-		Tok string // assignment token, DEFINE
-		Rh  Expr
+		Lh     Expr   // Ident
+		TokPos Pos    // position of Tok
+		Tok    string // assignment token, DEFINE
+		Rh     Expr
 	}
 
 	// A SectionStmt node represents a braced statement list.
 	SectionStmt struct {
-		List []Stmt
+		Lbrace Pos // position after the tag opening the section
+		List   []Stmt
+		Rbrace Pos // position of the tag closing the section
 	}
 
 	// TextStmt
@@ -122,72 +251,243 @@ type (
 		Text Expr // text content BasicLit
 	}
 
+	// A RawStmt node represents the content of a verbatim or raw block,
+	// which is output as it is.
+	RawStmt struct {
+		TagPos Pos
+		Name   string // verbatim or raw
+		Text   Expr   // raw content BasicLit
+		EndPos Pos
+	}
+
+	// A CommentStmt node represents a comment, which is only kept when the
+	// lexer is asked to.
+	CommentStmt struct {
+		TagPos Pos
+		Text   string // comment text without delimiters and modifiers
+		EndPos Pos
+	}
+
 	ValueStmt struct {
-		Tok Expr // assignment expr
+		TagPos Pos
+		Tok    Expr // assignment expr
+		EndPos Pos
 	}
 
 	SetStmt struct {
+		TagPos Pos
 		Assign *AssignStmt
+		EndPos Pos
 	}
 
 	// An IfStmt node represents an if statement.
 	IfStmt struct {
-		Cond Expr // condition
-		Else Stmt // else branch; or nil
-		Body *SectionStmt
+		TagPos Pos
+		Cond   Expr // condition
+		Else   Stmt // else branch; or nil
+		Body   *SectionStmt
+		EndPos Pos
 	}
 
 	// A ForStmt represents a for statement.
 	ForStmt struct {
-		Init Stmt // initialization statement; or nil
-		Cond Expr // condition; or nil
-		Post Stmt // post iteration statement; or nil
-		Body *SectionStmt
+		TagPos Pos
+		Init   Stmt // initialization statement; or nil
+		Cond   Expr // condition; or nil
+		Post   Stmt // post iteration statement; or nil
+		Body   *SectionStmt
+		EndPos Pos
 	}
 
 	// A RangeStmt represents a for statement with a range clause.
 	RangeStmt struct {
+		TagPos     Pos
 		Key, Value Expr // Key, Value may be nil
 		Tok        string
 		X          Expr // value to range over
 		Body       *SectionStmt
+		EndPos     Pos
 	}
 
 	//
 	BlockStmt struct {
-		Name *Ident       // name of block
-		Body *SectionStmt // body of block
+		TagPos Pos
+		Name   *Ident       // name of block
+		Body   *SectionStmt // body of block
+		EndPos Pos
 	}
 
 	IncludeStmt struct {
+		TagPos Pos
 		Ident  *BasicLit     // string of block name
 		Params []*AssignStmt // parameters injected into block
+		EndPos Pos
 	}
 
 	ExtendStmt struct {
-		Ident *BasicLit // string of block name
+		TagPos Pos
+		Ident  *BasicLit // string of block name
+		EndPos Pos
+	}
+
+	// A WithStmt node represents a block with its own variable scope.
+	WithStmt struct {
+		TagPos Pos
+		Params []*AssignStmt // variables defined in the scope
+		X      Expr          // expression of variables map; or nil
+		Only   bool          // outer variables are not visible
+		Body   *SectionStmt
+		EndPos Pos
+	}
+
+	// A SpacelessStmt node represents a block whose output has no
+	// whitespace between HTML tags.
+	SpacelessStmt struct {
+		TagPos Pos
+		Body   *SectionStmt
+		EndPos Pos
+	}
+
+	// A SandboxStmt node represents a block whose included templates are
+	// executed under the security policy.
+	SandboxStmt struct {
+		TagPos Pos
+		Body   *SectionStmt
+		EndPos Pos
+	}
+
+	// A ParamsStmt node represents the declaration of the parameters a
+	// template expects.
+	ParamsStmt struct {
+		TagPos Pos
+		List   []*Param
+		EndPos Pos
+	}
+
+	// A Param node represents a parameter of a params statement.
+	Param struct {
+		Name    *Ident
+		Colon   Pos    // position of ":"
+		TypePos Pos    // position of Type
+		Type    string // Go type, e.g. []Item
+		Default Expr   // default value; or nil
 	}
 )
 
+// Pos and End implementations for statement nodes.
+
+func (s *AssignStmt) Pos() Pos { return s.Lh.Pos() }
+func (s *SectionStmt) Pos() Pos {
+	if s.Lbrace.IsValid() || len(s.List) == 0 {
+		return s.Lbrace
+	}
+	return s.List[0].Pos()
+}
+func (s *TextStmt) Pos() Pos      { return s.Text.Pos() }
+func (s *RawStmt) Pos() Pos       { return s.TagPos }
+func (s *CommentStmt) Pos() Pos   { return s.TagPos }
+func (s *ValueStmt) Pos() Pos     { return s.TagPos }
+func (s *SetStmt) Pos() Pos       { return s.TagPos }
+func (s *IfStmt) Pos() Pos        { return s.TagPos }
+func (s *ForStmt) Pos() Pos       { return s.TagPos }
+func (s *RangeStmt) Pos() Pos     { return s.TagPos }
+func (s *BlockStmt) Pos() Pos     { return s.TagPos }
+func (s *IncludeStmt) Pos() Pos   { return s.TagPos }
+func (s *ExtendStmt) Pos() Pos    { return s.TagPos }
+func (s *WithStmt) Pos() Pos      { return s.TagPos }
+func (s *SpacelessStmt) Pos() Pos { return s.TagPos }
+func (s *SandboxStmt) Pos() Pos   { return s.TagPos }
+func (s *ParamsStmt) Pos() Pos    { return s.TagPos }
+func (s *Param) Pos() Pos         { return s.Name.Pos() }
+
+func (s *AssignStmt) End() Pos {
+	if s.Rh != nil {
+		return s.Rh.End()
+	}
+	return endOf(s.TokPos, s.Tok)
+}
+func (s *SectionStmt) End() Pos {
+	if s.Rbrace.IsValid() || len(s.List) == 0 {
+		return s.Rbrace
+	}
+	return s.List[len(s.List)-1].End()
+}
+func (s *TextStmt) End() Pos    { return s.Text.End() }
+func (s *RawStmt) End() Pos     { return s.EndPos }
+func (s *CommentStmt) End() Pos { return s.EndPos }
+func (s *ValueStmt) End() Pos   { return s.EndPos }
+func (s *SetStmt) End() Pos     { return s.EndPos }
+func (s *IfStmt) End() Pos {
+	if s.EndPos.IsValid() {
+		return s.EndPos
+	}
+	if s.Else != nil {
+		return s.Else.End()
+	}
+	return sectionEnd(s.Body, s.TagPos)
+}
+func (s *ForStmt) End() Pos       { return blockEnd(s.EndPos, s.Body, s.TagPos) }
+func (s *RangeStmt) End() Pos     { return blockEnd(s.EndPos, s.Body, s.TagPos) }
+func (s *BlockStmt) End() Pos     { return blockEnd(s.EndPos, s.Body, s.TagPos) }
+func (s *IncludeStmt) End() Pos   { return s.EndPos }
+func (s *ExtendStmt) End() Pos    { return s.EndPos }
+func (s *WithStmt) End() Pos      { return blockEnd(s.EndPos, s.Body, s.TagPos) }
+func (s *SpacelessStmt) End() Pos { return blockEnd(s.EndPos, s.Body, s.TagPos) }
+func (s *SandboxStmt) End() Pos   { return blockEnd(s.EndPos, s.Body, s.TagPos) }
+func (s *ParamsStmt) End() Pos    { return s.EndPos }
+func (s *Param) End() Pos {
+	if s.Default != nil {
+		return s.Default.End()
+	}
+	return endOf(s.TypePos, s.Type)
+}
+
+// blockEnd returns the end of a block statement, which is the end of its
+// body when the closing tag is missing.
+func blockEnd(end Pos, body *SectionStmt, tag Pos) Pos {
+	if end.IsValid() {
+		return end
+	}
+	return sectionEnd(body, tag)
+}
+
+func sectionEnd(body *SectionStmt, tag Pos) Pos {
+	if body != nil {
+		if end := body.End(); end.IsValid() {
+			return end
+		}
+	}
+	return tag
+}
+
 // stmtNode() ensures that only statement nodes can be
 // assigned to a Stmt.
 //
 
-func (*TextStmt) stmtNode()    {}
-func (*ValueStmt) stmtNode()   {}
-func (*AssignStmt) stmtNode()  {}
-func (*SectionStmt) stmtNode() {}
-func (*IfStmt) stmtNode()      {}
-func (*ForStmt) stmtNode()     {}
-func (*RangeStmt) stmtNode()   {}
-func (*BlockStmt) stmtNode()   {}
-func (*IncludeStmt) stmtNode() {}
-func (*ExtendStmt) stmtNode()  {}
-func (*SetStmt) stmtNode()     {}
+func (*TextStmt) stmtNode()      {}
+func (*RawStmt) stmtNode()       {}
+func (*CommentStmt) stmtNode()   {}
+func (*ValueStmt) stmtNode()     {}
+func (*AssignStmt) stmtNode()    {}
+func (*SectionStmt) stmtNode()   {}
+func (*IfStmt) stmtNode()        {}
+func (*ForStmt) stmtNode()       {}
+func (*RangeStmt) stmtNode()     {}
+func (*BlockStmt) stmtNode()     {}
+func (*IncludeStmt) stmtNode()   {}
+func (*ExtendStmt) stmtNode()    {}
+func (*SetStmt) stmtNode()       {}
+func (*WithStmt) stmtNode()      {}
+func (*SpacelessStmt) stmtNode() {}
+func (*SandboxStmt) stmtNode()   {}
+func (*ParamsStmt) stmtNode()    {}
 
 // Append() ensures that only statement nodes can be
 // assigned to a Stmt.
 //
+func (s *SectionStmt) Append(x Stmt) {
+	s.List = append(s.List, x)
+}
 func (s *IfStmt) Append(x Stmt) {
 	if s.Body == nil {
 		s.Body = &SectionStmt{}
@@ -212,3 +512,45 @@ func (s *BlockStmt) Append(x Stmt) {
 	}
 	s.Body.List = append(s.Body.List, x)
 }
+func (s *WithStmt) Append(x Stmt) {
+	if s.Body == nil {
+		s.Body = &SectionStmt{}
+	}
+	s.Body.List = append(s.Body.List, x)
+}
+func (s *SpacelessStmt) Append(x Stmt) {
+	if s.Body == nil {
+		s.Body = &SectionStmt{}
+	}
+	s.Body.List = append(s.Body.List, x)
+}
+func (s *SandboxStmt) Append(x Stmt) {
+	if s.Body == nil {
+		s.Body = &SectionStmt{}
+	}
+	s.Body.List = append(s.Body.List, x)
+}
+
+// close records the position of the tag closing the block statement, which
+// ends its last section, and the position after that tag.
+func (s *IfStmt) close(tag, end Pos) {
+	s.EndPos = end
+	if es, ok := s.Else.(*SectionStmt); ok {
+		es.Rbrace = tag
+	} else if s.Body != nil {
+		s.Body.Rbrace = tag
+	}
+}
+func (s *ForStmt) close(tag, end Pos)       { closeBlock(s.Body, &s.EndPos, tag, end) }
+func (s *RangeStmt) close(tag, end Pos)     { closeBlock(s.Body, &s.EndPos, tag, end) }
+func (s *BlockStmt) close(tag, end Pos)     { closeBlock(s.Body, &s.EndPos, tag, end) }
+func (s *WithStmt) close(tag, end Pos)      { closeBlock(s.Body, &s.EndPos, tag, end) }
+func (s *SpacelessStmt) close(tag, end Pos) { closeBlock(s.Body, &s.EndPos, tag, end) }
+func (s *SandboxStmt) close(tag, end Pos)   { closeBlock(s.Body, &s.EndPos, tag, end) }
+
+func closeBlock(body *SectionStmt, endPos *Pos, tag, end Pos) {
+	*endPos = end
+	if body != nil {
+		body.Rbrace = tag
+	}
+}
@@ -0,0 +1,128 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// spans returns the nodes of the tree of code, with their positions and
+// their source between Pos and End.
+func spans(t *testing.T, code string) []string {
+	src := NewSource(code)
+	tr, diags := Parse(src)
+	if len(diags) > 0 {
+		t.Fatal(diags)
+	}
+	var got []string
+	for _, node := range tr.List {
+		Inspect(node, func(n ASTNode) bool {
+			if n == nil {
+				return false
+			}
+			pos, end := src.Position(n.Pos()), src.Position(n.End())
+			text := ""
+			if pos.IsValid() && end.IsValid() {
+				text = code[pos.Offset:end.Offset]
+			}
+			got = append(got, fmt.Sprintf("%s %s-%s %q", strings.TrimPrefix(fmt.Sprintf("%T", n), "*template."), pos, end, text))
+			return true
+		})
+	}
+	return got
+}
+
+func TestPositions(t *testing.T) {
+	code := "a\n{% if user.Name ==\n  \"bob\" %}\n  {{ list[1] | upper }}{% else %}{{ -f(1,\n2) }}{% endif %}\n" +
+		"{% for i = 0; i < 3; i++ %}{% set x += i %}{% endfor %}\n{% range k, v = m %}{% endrange %}{# c\n #}" +
+		"{% with {a: 1} only %}{% include \"x\" with b = 2 %}{% endwith %}{% verbatim %}\n{{ r }}{% endverbatim %}"
+	want := []string{
+		`TextStmt 1:1-2:1 "a\n"`,
+		`BasicLit 1:1-2:1 "a\n"`,
+		`IfStmt 2:1-5:17 "{% if user.Name ==\n  \"bob\" %}\n  {{ list[1] | upper }}{% else %}{{ -f(1,\n2) }}{% endif %}"`,
+		`BinaryExpr 2:7-3:8 "user.Name ==\n  \"bob\""`,
+		`Ident 2:7-2:16 "user.Name"`,
+		`OpLit 2:17-2:19 "=="`,
+		`BasicLit 3:3-3:8 "\"bob\""`,
+		`SectionStmt 3:11-4:24 "\n  {{ list[1] | upper }}"`,
+		`TextStmt 3:11-4:3 "\n  "`,
+		`BasicLit 3:11-4:3 "\n  "`,
+		`ValueStmt 4:3-4:24 "{{ list[1] | upper }}"`,
+		`CallExpr 4:6-4:21 "list[1] | upper"`,
+		`IndexExpr 4:6-4:13 "list[1]"`,
+		`Ident 4:6-4:10 "list"`,
+		`BasicLit 4:11-4:12 "1"`,
+		`Ident 4:16-4:21 "upper"`,
+		`SectionStmt 4:34-5:6 "{{ -f(1,\n2) }}"`,
+		`ValueStmt 4:34-5:6 "{{ -f(1,\n2) }}"`,
+		`UnaryExpr 4:37-5:3 "-f(1,\n2)"`,
+		`OpLit 4:37-4:38 "-"`,
+		`CallExpr 4:38-5:3 "f(1,\n2)"`,
+		`Ident 4:38-4:39 "f"`,
+		`ArgsExpr 4:40-5:2 "1,\n2"`,
+		`BasicLit 4:40-4:41 "1"`,
+		`BasicLit 5:1-5:2 "2"`,
+		`TextStmt 5:17-6:1 "\n"`,
+		`BasicLit 5:17-6:1 "\n"`,
+		`ForStmt 6:1-6:56 "{% for i = 0; i < 3; i++ %}{% set x += i %}{% endfor %}"`,
+		`AssignStmt 6:8-6:13 "i = 0"`,
+		`Ident 6:8-6:9 "i"`,
+		`BasicLit 6:12-6:13 "0"`,
+		`BinaryExpr 6:15-6:20 "i < 3"`,
+		`Ident 6:15-6:16 "i"`,
+		`OpLit 6:17-6:18 "<"`,
+		`BasicLit 6:19-6:20 "3"`,
+		`AssignStmt 6:22-6:25 "i++"`,
+		`Ident 6:22-6:23 "i"`,
+		`SectionStmt 6:28-6:44 "{% set x += i %}"`,
+		`SetStmt 6:28-6:44 "{% set x += i %}"`,
+		`AssignStmt 6:35-6:41 "x += i"`,
+		`Ident 6:35-6:36 "x"`,
+		`Ident 6:40-6:41 "i"`,
+		`TextStmt 6:56-7:1 "\n"`,
+		`BasicLit 6:56-7:1 "\n"`,
+		`RangeStmt 7:1-7:35 "{% range k, v = m %}{% endrange %}"`,
+		`Ident 7:10-7:11 "k"`,
+		`Ident 7:13-7:14 "v"`,
+		`Ident 7:17-7:18 "m"`,
+		`SectionStmt 7:21-7:21 ""`,
+		`WithStmt 8:4-8:67 "{% with {a: 1} only %}{% include \"x\" with b = 2 %}{% endwith %}"`,
+		`AssignStmt 8:13-8:17 "a: 1"`,
+		`Ident 8:13-8:14 "a"`,
+		`BasicLit 8:16-8:17 "1"`,
+		`SectionStmt 8:26-8:54 "{% include \"x\" with b = 2 %}"`,
+		`IncludeStmt 8:26-8:54 "{% include \"x\" with b = 2 %}"`,
+		`BasicLit 8:37-8:40 "\"x\""`,
+		`AssignStmt 8:46-8:51 "b = 2"`,
+		`Ident 8:46-8:47 "b"`,
+		`BasicLit 8:50-8:51 "2"`,
+		`RawStmt 8:67-9:25 "{% verbatim %}\n{{ r }}{% endverbatim %}"`,
+		`BasicLit 8:81-9:8 "\n{{ r }}"`,
+	}
+	got := spans(t, code)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSourcePosition(t *testing.T) {
+	src := NewSource("ab\n\ncd\n")
+	cases := []struct {
+		pos  Pos
+		want string
+	}{
+		{NoPos, "-"},
+		{1, "1:1"},
+		{3, "1:3"},
+		{4, "2:1"},
+		{5, "3:1"},
+		{7, "3:3"},
+		{8, "4:1"},
+		{9, "-"},
+	}
+	for _, c := range cases {
+		if got := src.Position(c.pos).String(); got != c.want {
+			t.Errorf("%d: got %s, want %s", c.pos, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Check checks the template name, along with the templates it extends and
+// includes, against typ, the type of the data it is rendered with: the
+// variables and the fields read must exist, the methods called must take
+// as many arguments as they are passed, and the values ranged over must be
+// iterable. The problems found are returned as Diagnostics.
+//
+// Only what is known statically is checked: the values of an interface
+// type, or computed by operators, are not. A nil typ makes every variable
+// of the data unknown.
+func (ts *Templates) Check(name string, typ reflect.Type) error {
+	c := &checker{ts: ts, reported: make(map[string]bool)}
+	globals := newTypeScope(nil)
+	for name, v := range ts.Globals.vars {
+		globals.vars[name] = known(reflect.TypeOf(v))
+	}
+	c.globals = globals
+	c.data = c.bind(typ)
+	c.scope = c.data
+	if e := c.template(name); e != nil {
+		return e
+	}
+	if len(c.diags) > 0 {
+		return c.diags
+	}
+	return nil
+}
+
+// RULE_TYPE is the rule of the diagnostics reporting type errors.
+const RULE_TYPE = "type"
+
+// A typeScope is a variable scope holding the types of the variables, like
+// Scope holds their values. A nil type is unknown.
+type typeScope struct {
+	parent   *typeScope
+	vars     map[string]reflect.Type
+	isolated bool
+	open     bool         // every variable is defined, of type elem
+	elem     reflect.Type // type of the variables of an open scope
+}
+
+func newTypeScope(parent *typeScope) *typeScope {
+	return &typeScope{parent: parent, vars: make(map[string]reflect.Type)}
+}
+
+// fork returns a new isolated scope nested in sc, like Scope.Fork.
+func (sc *typeScope) fork() *typeScope {
+	c := newTypeScope(sc)
+	c.isolated = true
+	return c
+}
+
+// lookup returns the type of the variable name, false when it is not defined.
+func (sc *typeScope) lookup(name string) (reflect.Type, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if t, ok := sc.vars[name]; ok {
+			return t, true
+		}
+		if sc.open {
+			return sc.elem, true
+		}
+	}
+	return nil, false
+}
+
+// set assigns a value of type t to the variable name, in the scope Scope.Set
+// would. The type of a variable assigned values of different types is
+// unknown.
+func (sc *typeScope) set(name string, t reflect.Type) {
+	crossed := false
+	for c := sc; c != nil; c = c.parent {
+		if old, ok := c.vars[name]; ok {
+			if !crossed {
+				if old != t {
+					t = nil
+				}
+				c.vars[name] = t
+				return
+			}
+			break
+		}
+		crossed = crossed || c.isolated
+	}
+	sc.vars[name] = t
+}
+
+// A checker checks templates against the types of their variables.
+type checker struct {
+	ts       *Templates
+	globals  *typeScope
+	scope    *typeScope        // innermost scope
+	root     reflect.Type      // struct type of the data; or nil
+	data     *typeScope        // scope of the variables of the data
+	src      *Source           // template being checked
+	blocks   map[string]*block // blocks overridden by child templates
+	stack    []string          // templates being checked, the outermost first
+	diags    Diagnostics
+	reported map[string]bool
+}
+
+var (
+	intType    = reflect.TypeOf(0)
+	int64Type  = reflect.TypeOf(int64(0))
+	stringType = reflect.TypeOf("")
+	boolType   = reflect.TypeOf(false)
+)
+
+// known returns t, nil when it is an interface type whose values are only
+// known at runtime.
+func known(t reflect.Type) reflect.Type {
+	if t == nil || t.Kind() == reflect.Interface {
+		return nil
+	}
+	return t
+}
+
+// bind returns the scope of the variables of data of type typ, which are
+// bound like state.bind does.
+func (c *checker) bind(typ reflect.Type) *typeScope {
+	sc := newTypeScope(c.globals)
+	if typ == nil {
+		sc.open = true
+		return sc
+	}
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		c.root = typ
+		for i := 0; i < typ.NumField(); i++ {
+			if f := typ.Field(i); f.IsExported() {
+				sc.vars[f.Name] = known(f.Type)
+			}
+		}
+	case reflect.Map:
+		if typ.Key().Kind() == reflect.String {
+			sc.open, sc.elem = true, known(typ.Elem())
+		}
+	case reflect.Interface:
+		sc.open = true
+	}
+	return sc
+}
+
+// report reports a problem found at pos in the template being checked, once.
+func (c *checker) report(pos Pos, format string, args ...any) {
+	p := c.src.Position(pos)
+	d := &Diagnostic{
+		File:    c.src.Identity,
+		Line:    p.Line,
+		Column:  p.Column,
+		Rule:    RULE_TYPE,
+		Message: fmt.Sprintf(format, args...),
+		src:     c.src,
+	}
+	if key := d.String(); !c.reported[key] {
+		c.reported[key] = true
+		c.diags = append(c.diags, d)
+	}
+}
+
+// template checks the template name, following the chain of extended
+// templates. A template including itself is checked once.
+func (c *checker) template(name string) error {
+	for _, n := range c.stack {
+		if n == name {
+			return nil
+		}
+	}
+	c.stack = append(c.stack, name)
+	defer func() { c.stack = c.stack[:len(c.stack)-1] }()
+	t, e := c.ts.load(name)
+	if e != nil {
+		return e
+	}
+	tr := t.tree()
+	src := c.src
+	c.src = t.Source
+	defer func() { c.src = src }()
+	if ps := tr.params(); ps != nil {
+		c.params(ps)
+	}
+	if tr.Extend != nil {
+		if c.blocks == nil {
+			c.blocks = make(map[string]*block)
+		}
+		collectBlocks(tr.List, t.Source, nil, c.blocks)
+		return c.template(unquote(tr.Extend.Ident.Value))
+	}
+	for _, node := range tr.List {
+		c.stmt(node)
+	}
+	return nil
+}
+
+// params checks that the params without a default value are defined, and
+// defines the other ones.
+func (c *checker) params(ps *ParamsStmt) {
+	for _, p := range ps.List {
+		if _, ok := c.scope.lookup(p.Name.Name); ok {
+			continue
+		}
+		if p.Default == nil {
+			c.report(p.Pos(), "missing param %s of type %s", p.Name.Name, p.Type)
+			continue
+		}
+		c.scope.vars[p.Name.Name] = c.expr(p.Default)
+	}
+}
+
+func (c *checker) section(section *SectionStmt) {
+	if section != nil {
+		for _, st := range section.List {
+			c.stmt(st)
+		}
+	}
+}
+
+func (c *checker) stmt(node ASTNode) {
+	switch n := node.(type) {
+	case *ValueStmt:
+		c.expr(n.Tok)
+	case *SectionStmt:
+		c.section(n)
+	case *SetStmt:
+		c.assign(n.Assign)
+	case *AssignStmt:
+		c.assign(n)
+	case *IfStmt:
+		c.expr(n.Cond)
+		c.section(n.Body)
+		if n.Else != nil {
+			c.stmt(n.Else)
+		}
+	case *ForStmt:
+		outer := c.scope
+		c.scope = newTypeScope(outer)
+		if as, ok := n.Init.(*AssignStmt); ok && as.Tok == "=" {
+			c.scope.vars[as.Lh.(*Ident).Name] = c.expr(as.Rh)
+		} else if n.Init != nil {
+			c.stmt(n.Init)
+		}
+		if n.Cond != nil {
+			c.expr(n.Cond)
+		}
+		c.section(n.Body)
+		if n.Post != nil {
+			c.stmt(n.Post)
+		}
+		c.scope = outer
+	case *RangeStmt:
+		k, v := c.iterate(c.expr(n.X), n.X.Pos())
+		outer := c.scope
+		c.scope = newTypeScope(outer)
+		if n.Key != nil {
+			c.scope.vars[n.Key.(*Ident).Name] = k
+		}
+		if n.Value != nil {
+			c.scope.vars[n.Value.(*Ident).Name] = v
+		}
+		c.section(n.Body)
+		c.scope = outer
+	case *BlockStmt:
+		if b, ok := c.blocks[n.Name.Name]; ok {
+			src := c.src
+			c.src = b.src
+			c.section(b.stmt.Body)
+			c.src = src
+		} else {
+			c.section(n.Body)
+		}
+	case *IncludeStmt:
+		scope := c.scope.fork()
+		for _, as := range n.Params {
+			scope.vars[as.Lh.(*Ident).Name] = c.expr(as.Rh)
+		}
+		outer, blocks := c.scope, c.blocks
+		c.scope, c.blocks = scope, nil
+		if e := c.template(unquote(n.Ident.Value)); e != nil {
+			c.report(n.Ident.Pos(), "%s", e)
+		}
+		c.scope, c.blocks = outer, blocks
+	case *WithStmt:
+		c.with(n)
+	case *SpacelessStmt:
+		c.section(n.Body)
+	case *SandboxStmt:
+		c.section(n.Body)
+	}
+}
+
+func (c *checker) with(ws *WithStmt) {
+	var scope *typeScope
+	if ws.Only {
+		scope = c.globals.fork()
+	} else {
+		scope = c.scope.fork()
+	}
+	if ws.X != nil {
+		inner := newTypeScope(scope)
+		if t := c.expr(ws.X); t == nil {
+			inner.open = true
+		} else if d := indirectType(t); d.Kind() == reflect.Map && d.Key().Kind() == reflect.String {
+			inner.open, inner.elem = true, known(d.Elem())
+		} else {
+			c.report(ws.X.Pos(), "variables of with must be a hash, got %s", t)
+		}
+		scope = inner
+	}
+	for _, as := range ws.Params {
+		scope.vars[as.Lh.(*Ident).Name] = c.expr(as.Rh)
+	}
+	outer := c.scope
+	c.scope = scope
+	c.section(ws.Body)
+	c.scope = outer
+}
+
+func (c *checker) assign(as *AssignStmt) {
+	name := as.Lh.(*Ident).Name
+	if as.Tok == "=" {
+		c.scope.set(name, c.expr(as.Rh))
+		return
+	}
+	t := c.lookup(as.Lh.(*Ident))
+	if as.Rh != nil {
+		c.expr(as.Rh)
+	}
+	if t != nil && !isNumber(indirectType(t).Kind()) {
+		t = nil
+	}
+	c.scope.set(name, t)
+}
+
+// expr checks x and returns the type of its value, nil if it is unknown.
+func (c *checker) expr(x Expr) reflect.Type {
+	switch x := x.(type) {
+	case *BasicLit:
+		if v, e := literal(x); e == nil {
+			return reflect.TypeOf(v)
+		}
+	case *Ident:
+		return c.lookup(x)
+	case *IndexExpr:
+		t := c.expr(x.X)
+		c.expr(x.Index)
+		if t == nil {
+			return nil
+		}
+		switch d := indirectType(t); d.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			return known(d.Elem())
+		case reflect.String:
+			return stringType
+		case reflect.Interface:
+			return nil
+		}
+		c.report(x.Pos(), "cannot index %s", t)
+	case *SelectorExpr:
+		if t := c.expr(x.X); t != nil {
+			return c.property(t, x.Sel.Name, (&printer{}).expr(x.X), x.Sel.Pos())
+		}
+	case *CallExpr:
+		return c.call(x)
+	case *UnaryExpr:
+		c.expr(x.X)
+		if x.Op.Op == "!" || x.Op.Op == "not" {
+			return boolType
+		}
+	case *BinaryExpr:
+		a, b := c.expr(x.X), c.expr(x.Y)
+		switch x.Op.Op {
+		case "&&", "and", "||", "or", "==", "!=", "<", "<=", ">", ">=":
+			return boolType
+		case "&", "^", "b-and", "b-or", "b-xor":
+			if a == boolType && b == boolType {
+				return boolType
+			}
+		}
+	case *TestExpr:
+		// the expression tested by defined may well not be
+		if x.Name.Name != "defined" {
+			c.expr(x.X)
+			if _, ok := c.ts.test(x.Name.Name); !ok {
+				c.report(x.Name.Pos(), "test %s is not defined", x.Name.Name)
+			}
+		}
+		if x.Args != nil {
+			for _, arg := range x.Args.List {
+				c.expr(arg)
+			}
+		}
+		return boolType
+	}
+	return nil
+}
+
+// lookup returns the type of the variable or the field path id.
+func (c *checker) lookup(id *Ident) reflect.Type {
+	parts := strings.Split(id.Name, ".")
+	t, ok := c.scope.lookup(parts[0])
+	if !ok {
+		if c.root != nil && c.visible(c.data) {
+			c.report(id.Pos(), "%s has no field %s", c.root, parts[0])
+		} else {
+			c.report(id.Pos(), "variable %s is not defined", parts[0])
+		}
+		return nil
+	}
+	for i, p := range parts[1:] {
+		if t == nil {
+			return nil
+		}
+		t = c.property(t, p, strings.Join(parts[:i+1], "."), id.Pos())
+	}
+	return t
+}
+
+// visible reports whether the variables of sc are visible from the current
+// scope.
+func (c *checker) visible(sc *typeScope) bool {
+	for s := c.scope; s != nil; s = s.parent {
+		if s == sc {
+			return true
+		}
+	}
+	return false
+}
+
+// property returns the type of the field, the map entry or the result of
+// the method without arguments name of a value of type t, which is read
+// from path. It is looked up like state.property does.
+func (c *checker) property(t reflect.Type, name, path string, pos Pos) reflect.Type {
+	if m, ok := t.MethodByName(name); ok && m.Type.NumIn() == 1 {
+		return c.result(m.Type, path+"."+name, pos)
+	}
+	switch d := indirectType(t); d.Kind() {
+	case reflect.Struct:
+		if f, ok := d.FieldByName(name); ok && f.IsExported() {
+			return known(f.Type)
+		}
+	case reflect.Map:
+		if d.Key().Kind() == reflect.String {
+			return known(d.Elem())
+		}
+	case reflect.Interface:
+		return nil
+	}
+	c.report(pos, "%s (%s) has no field or method %s", path, t, name)
+	return nil
+}
+
+// call checks the call of a function or a method, and returns the type of
+// its result.
+func (c *checker) call(call *CallExpr) reflect.Type {
+	var args []Expr
+	if call.Args != nil {
+		args = call.Args.List
+	}
+	if sel, ok := call.Fun.(*SelectorExpr); ok {
+		recv := c.expr(sel.X)
+		for _, arg := range args {
+			c.expr(arg)
+		}
+		return c.method(recv, (&printer{}).expr(sel.X), sel.Sel.Name, len(args), sel.Sel.Pos())
+	}
+	name := call.Fun.(*Ident).Name
+	for _, arg := range args {
+		c.expr(arg)
+	}
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		recv := c.lookup(&Ident{NamePos: call.Pos(), Name: name[:i]})
+		return c.method(recv, name[:i], name[i+1:], len(args), call.Pos())
+	}
+	t, ok := c.scope.lookup(name)
+	if !ok {
+		c.report(call.Pos(), "function %s is not defined", name)
+		return nil
+	}
+	if t == nil {
+		return nil
+	}
+	if t.Kind() != reflect.Func {
+		c.report(call.Pos(), "%s (%s) is not a function", name, t)
+		return nil
+	}
+	return c.arity(t, 0, name, len(args), call.Pos())
+}
+
+// method checks the call of the method name with n arguments of a value
+// of type recv, which is read from path, and returns the type of its
+// result.
+func (c *checker) method(recv reflect.Type, path, name string, n int, pos Pos) reflect.Type {
+	if recv == nil {
+		return nil
+	}
+	m, ok := recv.MethodByName(name)
+	if !ok {
+		if indirectType(recv).Kind() != reflect.Interface {
+			c.report(pos, "%s (%s) has no method %s", path, recv, name)
+		}
+		return nil
+	}
+	return c.arity(m.Type, 1, path+"."+name, n, pos)
+}
+
+// arity checks that the function of type fn, whose first skip arguments
+// are not passed by the template, can be called with n arguments, and
+// returns the type of its result.
+func (c *checker) arity(fn reflect.Type, skip int, name string, n int, pos Pos) reflect.Type {
+	if fn.NumIn() > skip && fn.In(skip) == contextType {
+		skip++
+	}
+	numIn := fn.NumIn() - skip
+	if fn.IsVariadic() {
+		if n < numIn-1 {
+			c.report(pos, "%s takes at least %d arguments, called with %d", name, numIn-1, n)
+		}
+	} else if n != numIn {
+		c.report(pos, "%s takes %d arguments, called with %d", name, numIn, n)
+	}
+	return c.result(fn, name, pos)
+}
+
+// result returns the type of the result of the function of type fn.
+func (c *checker) result(fn reflect.Type, name string, pos Pos) reflect.Type {
+	if n := fn.NumOut(); n == 1 || n == 2 {
+		return known(fn.Out(0))
+	}
+	c.report(pos, "%s must return one value, or a value and an error", name)
+	return nil
+}
+
+// iterate returns the types of the keys and the values of a range over a
+// value of type t, like newIterator.
+func (c *checker) iterate(t reflect.Type, pos Pos) (k, v reflect.Type) {
+	if t == nil {
+		return nil, nil
+	}
+	switch d := indirectType(t); d.Kind() {
+	case reflect.Slice, reflect.Array:
+		return intType, known(d.Elem())
+	case reflect.String:
+		return intType, stringType
+	case reflect.Map:
+		return known(d.Key()), known(d.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int64Type, int64Type
+	case reflect.Interface:
+		return nil, nil
+	}
+	c.report(pos, "can't range over %s", t)
+	return nil, nil
+}
+
+// indirectType returns t without its pointers.
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,143 @@
+package template
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type checkUser struct {
+	Name  string
+	Tags  []string
+	Attrs map[string]int
+	Any   any
+}
+
+func (u *checkUser) Hello(s string) string               { return "hello " + s }
+func (u *checkUser) Join(sep string, s ...string) string { return sep }
+func (u *checkUser) Nothing()                            {}
+
+type checkData struct {
+	User  *checkUser
+	Users []*checkUser
+	N     int
+	Ok    bool
+	Any   any
+}
+
+// checkTemplates returns the templates of the codes keyed by their names.
+func checkTemplates(t *testing.T, files map[string]string) *Templates {
+	ts := NewTemplates(&Config{})
+	for name, code := range files {
+		tpl := EmptyTemplate()
+		tpl.ts = ts
+		if e := tpl.parse(&Source{Identity: name, Code: code}); e != nil {
+			t.Fatalf("%s: %v", name, e)
+		}
+		ts.addTemplate(tpl)
+	}
+	return ts
+}
+
+func TestCheck(t *testing.T) {
+	data := reflect.TypeOf(&checkData{})
+	cases := []struct {
+		code string
+		typ  reflect.Type
+		want []string
+	}{
+		{"{{ User.Name }}{{ N + 1 }}{{ Any.Whatever }}{{ User.Hello(\"a\") }}", data, nil},
+		{"{% range i, u = Users %}{{ u.Name }}{{ u.Tags }}{% endrange %}{% range i = Users %}{{ i + 1 }}{% endrange %}", data, nil},
+		{"{% range k, v = User.Attrs %}{{ k }}{{ v }}{% endrange %}{% range c = User.Name %}{{ c }}{% endrange %}", data, nil},
+		{"{{ User.Join(\",\") }}{{ User.Join(\",\", \"a\", \"b\") }}", data, nil},
+		{"{{ Nobody }}", data, []string{
+			"page.html:1:4: template.checkData has no field Nobody (type)",
+		}},
+		{"{{ User.Age }}\n{{ User.Tags.First }}", data, []string{
+			"page.html:1:4: User (*template.checkUser) has no field or method Age (type)",
+			"page.html:2:4: User.Tags ([]string) has no field or method First (type)",
+		}},
+		{"{{ User.Hello() }}{{ User.Hello(\"a\", \"b\") }}{{ User.Join() }}", data, []string{
+			"page.html:1:4: User.Hello takes 1 arguments, called with 0 (type)",
+			"page.html:1:22: User.Hello takes 1 arguments, called with 2 (type)",
+			"page.html:1:48: User.Join takes at least 1 arguments, called with 0 (type)",
+		}},
+		{"{{ User.Bye() }}{{ User.Nothing() }}", data, []string{
+			"page.html:1:4: User (*template.checkUser) has no method Bye (type)",
+			"page.html:1:20: User.Nothing must return one value, or a value and an error (type)",
+		}},
+		{"{{ nope(1) }}{{ N(1) }}", data, []string{
+			"page.html:1:4: function nope is not defined (type)",
+			"page.html:1:17: N (int) is not a function (type)",
+		}},
+		{"{% range v = Ok %}{% endrange %}{% range v = User %}{% endrange %}{% range v = Any %}{% endrange %}", data, []string{
+			"page.html:1:14: can't range over bool (type)",
+			"page.html:1:46: can't range over *template.checkUser (type)",
+		}},
+		// the variables set and the loop variables are known in their scope
+		{"{% set a = User %}{{ a.Name }}{{ a.Age }}{% for i = 0; i < N; i++ %}{% endfor %}{{ i }}", data, []string{
+			"page.html:1:34: a (*template.checkUser) has no field or method Age (type)",
+			"page.html:1:84: template.checkData has no field i (type)",
+		}},
+		{"{% with {u: User} %}{{ u.Name }}{{ N }}{% endwith %}{% with {u: User} only %}{{ N }}{% endwith %}", data, []string{
+			"page.html:1:81: variable N is not defined (type)",
+		}},
+		{"{% with N %}{% endwith %}", data, []string{
+			"page.html:1:9: variables of with must be a hash, got int (type)",
+		}},
+		{"{% params x: int, y: int = 1 %}{{ y }}", data, []string{
+			"page.html:1:11: missing param x of type int (type)",
+		}},
+		{"{% include \"part.html\" with u = User %}", data, []string{
+			"part.html:1:16: u (*template.checkUser) has no field or method Age (type)",
+		}},
+		{"{% include \"none.html\" %}", data, []string{
+			"page.html:1:12: open none.html: no such file or directory (type)",
+		}},
+		{"{% extend \"base.html\" %}{% block b %}{{ User.Age }}{% endblock %}", data, []string{
+			"base.html:1:4: template.checkData has no field Title (type)",
+			"page.html:1:41: User (*template.checkUser) has no field or method Age (type)",
+		}},
+		// without a type, the variables of the data are unknown
+		{"{{ Nobody.Age }}{% range v = Nobody %}{% endrange %}", nil, nil},
+		{"{{ Nobody }}{{ Len }}", reflect.TypeOf(map[string]int{}), nil},
+		{"{{ Nobody.Age }}", reflect.TypeOf(map[string]int{}), []string{
+			"page.html:1:4: Nobody (int) has no field or method Age (type)",
+		}},
+	}
+	for _, c := range cases {
+		ts := checkTemplates(t, map[string]string{
+			"page.html": c.code,
+			"part.html": "{{ u.Name }}{{ u.Age }}",
+			"base.html": "{{ Title }}{% block b %}{% endblock %}",
+		})
+		var got []string
+		if e := ts.Check("page.html", c.typ); e != nil {
+			var diags Diagnostics
+			if !errors.As(e, &diags) {
+				t.Errorf("%q: %v", c.code, e)
+				continue
+			}
+			for _, d := range diags {
+				got = append(got, d.String())
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q:\ngot  %q\nwant %q", c.code, got, c.want)
+		}
+	}
+}
+
+func TestCheckGlobals(t *testing.T) {
+	ts := checkTemplates(t, map[string]string{
+		"page.html": "{{ add(1, 2) }}{{ add(1) }}{{ site.Name }}{{ site.Age }}",
+	})
+	ts.AddGlobal("add", func(a, b int) int { return a + b })
+	ts.AddGlobal("site", checkUser{})
+	e := ts.Check("page.html", reflect.TypeOf(checkData{}))
+	want := "page.html:1:19: add takes 2 arguments, called with 1 (type) (and 1 more errors)"
+	if e == nil || e.Error() != want {
+		t.Errorf("got %v, want %s", e, want)
+	}
+}
@@ -0,0 +1,475 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An opcode is the operation of an instruction of a compiled template.
+type opcode uint8
+
+const (
+	opStep        opcode = iota // start the statement at the position a
+	opText                      // write the text a
+	opPush                      // push the constant a
+	opLoad                      // push the variable of the path a
+	opIndex                     // pop an index and a value, push the element of the value
+	opBinary                    // pop y and x, push the result of the operator a
+	opUnary                     // replace the top by the result of the operator a
+	opProperty                  // replace the top by its property a
+	opAnd                       // jump to a keeping false when the top is false, pop it otherwise
+	opOr                        // jump to a keeping true when the top is true, pop it otherwise
+	opTruth                     // replace the top by its truth value
+	opFunc                      // push the function a, applied as a filter when b is 1
+	opMethod                    // replace the top, the value of the node b, by its method a
+	opCall                      // pop b arguments and a function, push the result of the call of a
+	opTest                      // pop b arguments and a value, push whether it passes the test a
+	opDefined                   // push whether the expression of the node a is defined
+	opPrint                     // pop a value and write it
+	opJump                      // jump to a
+	opJumpIfFalse               // pop a value, jump to a when it is false
+	opSet                       // pop a value and set the variable a to it
+	opDefine                    // pop a value and define the variable a as it
+	opPushScope                 // push a new innermost scope
+	opPopScope                  // restore the scope replaced by the last push
+	opFor                       // start a for loop
+	opLoop                      // start an iteration of the innermost for loop
+	opRange                     // pop a value and range over it, into the variables a-1 and b-1
+	opNext                      // start the next iteration of the innermost range, jump to a when it is over
+	opEndLoop                   // end the innermost loop
+	opBlock                     // render the block of the node a
+	opTemplate                  // push the template of the path a
+	opInclude                   // pop b parameters and a template, render it for the include of the node a
+	opHash                      // check the top is the hash of variables of a with
+	opWith                      // pop b parameters and variables of the with of the node a, push its scope
+	opCapture                   // write to a buffer
+	opFlush                     // write the buffer without the whitespace between its tags
+	opSandbox                   // apply the security policy
+	opUnsandbox                 // stop applying the security policy applied by the matching sandbox
+	opFail                      // fail with the error a
+	opReturn                    // return from the code
+)
+
+var opNames = [...]string{
+	opStep:        "step",
+	opText:        "text",
+	opPush:        "push",
+	opLoad:        "load",
+	opIndex:       "index",
+	opBinary:      "binary",
+	opUnary:       "unary",
+	opProperty:    "property",
+	opAnd:         "and",
+	opOr:          "or",
+	opTruth:       "truth",
+	opFunc:        "func",
+	opMethod:      "method",
+	opCall:        "call",
+	opTest:        "test",
+	opDefined:     "defined",
+	opPrint:       "print",
+	opJump:        "jump",
+	opJumpIfFalse: "jumpiffalse",
+	opSet:         "set",
+	opDefine:      "define",
+	opPushScope:   "pushscope",
+	opPopScope:    "popscope",
+	opFor:         "for",
+	opLoop:        "loop",
+	opRange:       "range",
+	opNext:        "next",
+	opEndLoop:     "endloop",
+	opBlock:       "block",
+	opTemplate:    "template",
+	opInclude:     "include",
+	opHash:        "hash",
+	opWith:        "with",
+	opCapture:     "capture",
+	opFlush:       "flush",
+	opSandbox:     "sandbox",
+	opUnsandbox:   "unsandbox",
+	opFail:        "fail",
+	opReturn:      "return",
+}
+
+func (op opcode) String() string {
+	return opNames[op]
+}
+
+// An instr is an instruction, an operation with up to two operands.
+type instr struct {
+	op   opcode
+	a, b int32
+}
+
+// A Program is a template compiled to bytecode, which is run by a stack
+// machine instead of walking the syntax tree of the template. Its output
+// is the one of the tree.
+type Program struct {
+	tree   *Tree
+	code   []instr
+	strs   []string           // names, operators and texts
+	paths  [][]string         // dotted names split at their dots
+	values []any              // constants and errors
+	nodes  []ASTNode          // statements run by a single instruction
+	blocks map[*BlockStmt]int // entries of the bodies of the blocks
+	stack  int                // largest number of operands on the stack
+}
+
+// Compile compiles the syntax tree tr to a program. The code of the tree
+// starts at 0, the bodies of its blocks follow it.
+func Compile(tr *Tree) *Program {
+	c := &compiler{
+		p:    &Program{tree: tr, blocks: make(map[*BlockStmt]int)},
+		strs: make(map[string]int32),
+	}
+	for _, node := range tr.List {
+		c.walk(node)
+	}
+	c.emit(opReturn, 0, 0)
+	for len(c.pending) > 0 {
+		bs := c.pending[0]
+		c.pending = c.pending[1:]
+		c.p.blocks[bs] = len(c.p.code)
+		c.section(bs.Body)
+		c.emit(opReturn, 0, 0)
+	}
+	return c.p
+}
+
+// String returns the listing of the code of p.
+func (p *Program) String() string {
+	var sb strings.Builder
+	for pc, in := range p.code {
+		fmt.Fprintf(&sb, "%4d %-11s", pc, in.op)
+		switch in.op {
+		case opLoad:
+			fmt.Fprintf(&sb, " %q", strings.Join(p.paths[in.a], "."))
+		case opText, opBinary, opUnary, opProperty, opFunc, opSet, opDefine, opTemplate:
+			fmt.Fprintf(&sb, " %q", p.strs[in.a])
+		case opCall, opTest:
+			fmt.Fprintf(&sb, " %q %d", p.strs[in.a], in.b)
+		case opMethod:
+			fmt.Fprintf(&sb, " %q", p.strs[in.a])
+		case opPush, opFail:
+			fmt.Fprintf(&sb, " %#v", p.values[in.a])
+		case opStep, opAnd, opOr, opJump, opJumpIfFalse, opNext:
+			fmt.Fprintf(&sb, " %d", in.a)
+		case opRange:
+			fmt.Fprintf(&sb, " %d %d", in.a, in.b)
+		case opBlock, opInclude, opWith, opDefined:
+			fmt.Fprintf(&sb, " %T", p.nodes[in.a])
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// A compiler compiles a syntax tree to a program.
+type compiler struct {
+	p       *Program
+	depth   int              // number of operands on the stack
+	strs    map[string]int32 // indexes of the strings of the program
+	pending []*BlockStmt     // blocks whose bodies are not compiled yet
+}
+
+// emit appends an instruction to the code and returns its address.
+func (c *compiler) emit(op opcode, a, b int32) int {
+	c.p.code = append(c.p.code, instr{op: op, a: a, b: b})
+	switch op {
+	case opPush, opLoad, opFunc, opTemplate, opSandbox, opDefined:
+		c.depth++
+	case opIndex, opBinary, opAnd, opOr, opPrint, opJumpIfFalse, opSet, opDefine, opRange, opUnsandbox:
+		c.depth--
+	case opCall, opTest, opWith:
+		c.depth -= int(b)
+	case opInclude:
+		c.depth -= int(b) + 1
+	}
+	if c.depth > c.p.stack {
+		c.p.stack = c.depth
+	}
+	return len(c.p.code) - 1
+}
+
+// patch makes the jump at pc go to the next instruction.
+func (c *compiler) patch(pc int) {
+	c.p.code[pc].a = int32(len(c.p.code))
+}
+
+func (c *compiler) str(s string) int32 {
+	if i, ok := c.strs[s]; ok {
+		return i
+	}
+	i := int32(len(c.p.strs))
+	c.p.strs = append(c.p.strs, s)
+	c.strs[s] = i
+	return i
+}
+
+func (c *compiler) path(name string) int32 {
+	c.p.paths = append(c.p.paths, strings.Split(name, "."))
+	return int32(len(c.p.paths) - 1)
+}
+
+func (c *compiler) value(v any) int32 {
+	c.p.values = append(c.p.values, v)
+	return int32(len(c.p.values) - 1)
+}
+
+func (c *compiler) node(n ASTNode) int32 {
+	c.p.nodes = append(c.p.nodes, n)
+	return int32(len(c.p.nodes) - 1)
+}
+
+// fail emits the failure with e, the error the evaluator returns at the
+// same point.
+func (c *compiler) fail(e error) {
+	c.emit(opFail, c.value(e), 0)
+}
+
+// walk compiles the statement node like state.walk executes it.
+func (c *compiler) walk(node ASTNode) {
+	c.emit(opStep, int32(node.Pos()), 0)
+	switch n := node.(type) {
+	case *TextStmt:
+		c.emit(opText, c.str(n.Text.(*BasicLit).Value), 0)
+	case *RawStmt:
+		c.emit(opText, c.str(n.Text.(*BasicLit).Value), 0)
+	case *ValueStmt:
+		c.expr(n.Tok)
+		c.emit(opPrint, 0, 0)
+	case *SectionStmt:
+		c.section(n)
+	case *SetStmt:
+		c.assign(n.Assign)
+	case *AssignStmt:
+		c.assign(n)
+	case *IfStmt:
+		c.ifStmt(n)
+	case *ForStmt:
+		c.forStmt(n)
+	case *RangeStmt:
+		c.rangeStmt(n)
+	case *BlockStmt:
+		c.emit(opBlock, c.node(n), 0)
+		c.pending = append(c.pending, n)
+	case *IncludeStmt:
+		c.emit(opTemplate, c.str(unquote(n.Ident.Value)), 0)
+		for _, as := range n.Params {
+			c.expr(as.Rh)
+		}
+		c.emit(opInclude, c.node(n), int32(len(n.Params)))
+	case *WithStmt:
+		c.withStmt(n)
+	case *SpacelessStmt:
+		if isStaticSection(n.Body) {
+			c.section(n.Body)
+			break
+		}
+		c.emit(opCapture, 0, 0)
+		c.section(n.Body)
+		c.emit(opFlush, 0, 0)
+	case *SandboxStmt:
+		c.emit(opSandbox, 0, 0)
+		c.section(n.Body)
+		c.emit(opUnsandbox, 0, 0)
+	case *ExtendStmt, *CommentStmt, *ParamsStmt:
+	default:
+		c.fail(err("walk: unexpected node %T", node))
+	}
+}
+
+func (c *compiler) section(section *SectionStmt) {
+	if section == nil {
+		return
+	}
+	for _, st := range section.List {
+		c.walk(st)
+	}
+}
+
+func (c *compiler) assign(as *AssignStmt) {
+	name := c.str(as.Lh.(*Ident).Name)
+	switch as.Tok {
+	case "=":
+		c.expr(as.Rh)
+	case "+=", "-=", "&=", "|=", "^=", "<<=", ">>=", "++", "--":
+		c.emit(opLoad, c.path(as.Lh.(*Ident).Name), 0)
+		if as.Rh != nil {
+			c.expr(as.Rh)
+		} else {
+			c.emit(opPush, c.value(int64(1)), 0)
+		}
+		c.emit(opBinary, c.str(assignOp(as.Tok)), 0)
+	default:
+		c.fail(err("assign: unexpected token %s", as.Tok))
+		return
+	}
+	c.emit(opSet, name, 0)
+}
+
+func (c *compiler) ifStmt(is *IfStmt) {
+	c.expr(is.Cond)
+	jf := c.emit(opJumpIfFalse, 0, 0)
+	c.section(is.Body)
+	if is.Else == nil {
+		c.patch(jf)
+		return
+	}
+	j := c.emit(opJump, 0, 0)
+	c.patch(jf)
+	c.walk(is.Else)
+	c.patch(j)
+}
+
+func (c *compiler) forStmt(fs *ForStmt) {
+	c.emit(opPushScope, 0, 0)
+	if as, ok := fs.Init.(*AssignStmt); ok && as.Tok == "=" {
+		c.expr(as.Rh)
+		c.emit(opDefine, c.str(as.Lh.(*Ident).Name), 0)
+	} else if fs.Init != nil {
+		c.walk(fs.Init)
+	}
+	c.emit(opFor, 0, 0)
+	// the iteration starts once the condition holds
+	loop := len(c.p.code)
+	jf := -1
+	if fs.Cond != nil {
+		c.expr(fs.Cond)
+		jf = c.emit(opJumpIfFalse, 0, 0)
+	}
+	c.emit(opLoop, 0, 0)
+	c.section(fs.Body)
+	if fs.Post != nil {
+		c.walk(fs.Post)
+	}
+	c.emit(opJump, int32(loop), 0)
+	if jf >= 0 {
+		c.patch(jf)
+	}
+	c.emit(opEndLoop, 0, 0)
+	c.emit(opPopScope, 0, 0)
+}
+
+func (c *compiler) rangeStmt(rs *RangeStmt) {
+	c.expr(rs.X)
+	c.emit(opPushScope, 0, 0)
+	var key, value int32
+	if rs.Key != nil {
+		key = c.str(rs.Key.(*Ident).Name) + 1
+	}
+	if rs.Value != nil {
+		value = c.str(rs.Value.(*Ident).Name) + 1
+	}
+	c.emit(opRange, key, value)
+	next := c.emit(opNext, 0, 0)
+	c.section(rs.Body)
+	c.emit(opJump, int32(next), 0)
+	c.patch(next)
+	c.emit(opEndLoop, 0, 0)
+	c.emit(opPopScope, 0, 0)
+}
+
+func (c *compiler) withStmt(ws *WithStmt) {
+	if ws.X != nil {
+		c.expr(ws.X)
+		c.emit(opHash, 0, 0)
+	}
+	for _, as := range ws.Params {
+		c.expr(as.Rh)
+	}
+	n := len(ws.Params)
+	if ws.X != nil {
+		n++
+	}
+	c.emit(opWith, c.node(ws), int32(n))
+	c.section(ws.Body)
+	c.emit(opPopScope, 0, 0)
+}
+
+// expr compiles the expression x like state.evalExpr evaluates it.
+func (c *compiler) expr(x Expr) {
+	switch x := x.(type) {
+	case *BasicLit:
+		v, e := literal(x)
+		if e != nil {
+			c.fail(e)
+			return
+		}
+		c.emit(opPush, c.value(v), 0)
+	case *Ident:
+		c.emit(opLoad, c.path(x.Name), 0)
+	case *IndexExpr:
+		c.expr(x.X)
+		c.expr(x.Index)
+		c.emit(opIndex, 0, 0)
+	case *SelectorExpr:
+		c.expr(x.X)
+		c.emit(opProperty, c.str(x.Sel.Name), 0)
+	case *CallExpr:
+		var name int32
+		if sel, ok := x.Fun.(*SelectorExpr); ok {
+			name = c.str(sel.Sel.Name)
+			c.expr(sel.X)
+			c.emit(opMethod, name, c.node(sel.X))
+		} else {
+			name = c.str(x.Fun.(*Ident).Name)
+			var filter int32
+			if x.Pipe.IsValid() {
+				filter = 1
+			}
+			c.emit(opFunc, name, filter)
+		}
+		var argc int32
+		if x.Args != nil {
+			for _, arg := range x.Args.List {
+				c.expr(arg)
+			}
+			argc = int32(len(x.Args.List))
+		}
+		c.emit(opCall, name, argc)
+	case *UnaryExpr:
+		c.expr(x.X)
+		c.emit(opUnary, c.str(x.Op.Op), 0)
+	case *BinaryExpr:
+		c.expr(x.X)
+		switch x.Op.Op {
+		case "&&", "and", "||", "or":
+			op := opAnd
+			if x.Op.Op == "||" || x.Op.Op == "or" {
+				op = opOr
+			}
+			j := c.emit(op, 0, 0)
+			c.expr(x.Y)
+			c.emit(opTruth, 0, 0)
+			c.patch(j)
+		default:
+			c.expr(x.Y)
+			c.emit(opBinary, c.str(x.Op.Op), 0)
+		}
+	case *TestExpr:
+		if x.Name.Name == "defined" {
+			if x.Args != nil {
+				c.fail(err("evalTest: test defined takes no arguments"))
+				return
+			}
+			c.emit(opDefined, c.node(x.X), 0)
+		} else {
+			c.expr(x.X)
+			var argc int32
+			if x.Args != nil {
+				for _, arg := range x.Args.List {
+					c.expr(arg)
+				}
+				argc = int32(len(x.Args.List))
+			}
+			c.emit(opTest, c.str(x.Name.Name), argc)
+		}
+		if x.Not {
+			c.emit(opUnary, c.str("not"), 0)
+		}
+	default:
+		c.fail(err("evalExpr: unexpected expression %T", x))
+	}
+}
@@ -1,26 +1,58 @@
 package template
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A SyntaxError is an error located in the source of a template.
+type SyntaxError interface {
+	error
+	// Location returns the source and the line of the error, and its
+	// position when it is known, NoPos otherwise.
+	Location() (src *Source, line int, pos Pos)
+	// Brief returns the message of the error without its location.
+	Brief() string
+}
 
 type UnexpectedEndOfFile struct {
-	Source  *Source
-	Line    int
-	Message string
+	Source   *Source
+	Line     int
+	Pos      Pos    // position of the error; or NoPos
+	Expected string // what was expected instead; or ""
+	Message  string
 }
 type UnexpectedToken struct {
-	Source  *Source
-	Line    int
-	Message string
+	Source   *Source
+	Line     int
+	Pos      Pos    // position of the error; or NoPos
+	Token    string // text of the unexpected token
+	Expected string // what was expected instead; or ""
+	Message  string
 }
 type ParseTemplateFaild struct {
-	Source  *Source
-	Line    int
-	Message string
+	Source   *Source
+	Line     int
+	Pos      Pos    // position of the error; or NoPos
+	Token    string // text the error was found at; or ""
+	Expected string // what was expected instead; or ""
+	Message  string
 }
 
-func (e *UnexpectedEndOfFile) Error() string { return e.Message }
-func (e *UnexpectedToken) Error() string     { return e.Message }
-func (e *ParseTemplateFaild) Error() string  { return e.Message }
+func (e *UnexpectedEndOfFile) Error() string { return locate(e) }
+func (e *UnexpectedToken) Error() string     { return locate(e) }
+func (e *ParseTemplateFaild) Error() string  { return locate(e) }
+
+func (e *UnexpectedEndOfFile) Brief() string { return brief(e.Message, "", e.Expected) }
+func (e *UnexpectedToken) Brief() string     { return brief(e.Message, e.Token, e.Expected) }
+func (e *ParseTemplateFaild) Brief() string  { return brief(e.Message, e.Token, e.Expected) }
+
+func (e *UnexpectedEndOfFile) Location() (*Source, int, Pos) { return e.Source, e.Line, e.Pos }
+func (e *UnexpectedToken) Location() (*Source, int, Pos)     { return e.Source, e.Line, e.Pos }
+func (e *ParseTemplateFaild) Location() (*Source, int, Pos)  { return e.Source, e.Line, e.Pos }
 
 func (e *UnexpectedEndOfFile) Overview() []*Line { return e.Source.Overview(e.Line) }
 func (e *UnexpectedToken) Overview() []*Line     { return e.Source.Overview(e.Line) }
@@ -28,9 +60,10 @@ func (e *ParseTemplateFaild) Overview() []*Line  { return e.Source.Overview(e.Li
 
 func NewUnexpectedEndOfFile(src *Source, line int, tok string) *UnexpectedEndOfFile {
 	return &UnexpectedEndOfFile{
-		Source:  src,
-		Line:    line,
-		Message: fmt.Sprintf("unexpected EOF at line: %d", line),
+		Source:   src,
+		Line:     line,
+		Expected: tok,
+		Message:  "unexpected end of template",
 	}
 }
 
@@ -38,7 +71,8 @@ func NewUnexpectedToken(src *Source, line int, tok string) *UnexpectedToken {
 	return &UnexpectedToken{
 		Source:  src,
 		Line:    line,
-		Message: fmt.Sprintf("unexpected token at line: %d", line),
+		Token:   tok,
+		Message: "unexpected token",
 	}
 }
 
@@ -49,3 +83,222 @@ func NewParseTemplateFaild(src *Source, line int) *ParseTemplateFaild {
 		Message: "parse template failed",
 	}
 }
+
+// brief returns msg followed by the token it is about and what was
+// expected instead, when they are known.
+func brief(msg, tok, expected string) string {
+	if tok != "" {
+		msg += fmt.Sprintf(" %q", tok)
+	}
+	if expected != "" {
+		msg += ", expecting " + expected
+	}
+	return msg
+}
+
+// locate returns the message of e prefixed with the identity of its
+// template, its line and its column when it is known.
+func locate(e SyntaxError) string {
+	src, line, pos := e.Location()
+	if src == nil {
+		return fmt.Sprintf("line %d: %s", line, e.Brief())
+	}
+	if p := src.Position(pos); p.IsValid() {
+		return fmt.Sprintf("%s:%d:%d: %s", src.Identity, p.Line, p.Column, e.Brief())
+	}
+	return fmt.Sprintf("%s:%d: %s", src.Identity, line, e.Brief())
+}
+
+// A Frame is a template being executed when a runtime error occurred.
+type Frame struct {
+	Template string // identity of the template
+	Line     int    // line of the statement being executed; or 0
+	Block    string // name of the block being executed; or ""
+}
+
+func (f Frame) String() string {
+	s := f.Template
+	if f.Line > 0 {
+		s += fmt.Sprintf(":%d", f.Line)
+	}
+	if f.Block != "" {
+		s += fmt.Sprintf(" block %q", f.Block)
+	}
+	return s
+}
+
+// A RuntimeError is an error which occurred while executing a template,
+// along with the templates being executed, the included ones and the
+// blocks of child templates. The panics of the functions and methods
+// called by templates are reported by a PanicError.
+type RuntimeError struct {
+	Stack []Frame // the outermost first
+	Err   error
+}
+
+func (e *RuntimeError) Error() string {
+	stack := make([]string, len(e.Stack))
+	for i, f := range e.Stack {
+		stack[i] = f.String()
+	}
+	return fmt.Sprintf("%s: %v", strings.Join(stack, " -> "), e.Err)
+}
+
+// Unwrap returns the error which occurred.
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// A PanicError is a panic of a function or a method called by a template.
+type PanicError struct {
+	Func  string // name of the function or the method
+	Value any    // value recovered from the panic
+	Stack []byte // stack trace of the goroutine when it panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s panicked: %v", e.Func, e.Value)
+}
+
+// A SecurityError is the use of a tag, a function, a field or a method
+// which the security policy of a sandboxed template denies. The errors found
+// while executing a template have no source, the runtime error holding them
+// tells where they occurred.
+type SecurityError struct {
+	Source *Source // template using it; or nil
+	Pos    Pos     // position of the use; or NoPos
+	Kind   string  // "tag", "function", "filter", "field", "method" or "print"
+	Name   string
+}
+
+func (e *SecurityError) Error() string {
+	msg := fmt.Sprintf("%s %s is not allowed by the security policy", e.Kind, e.Name)
+	if e.Source == nil {
+		return msg
+	}
+	if p := e.Source.Position(e.Pos); p.IsValid() {
+		return fmt.Sprintf("%s:%d:%d: %s", e.Source.Identity, p.Line, p.Column, msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Source.Identity, msg)
+}
+
+// A ParamError reports a variable which does not match the parameter a
+// template declares: it is missing, or its value is of another kind than
+// the type of the parameter.
+type ParamError struct {
+	Name    string
+	Type    string // type of the parameter
+	Value   any    // value of the variable; nil when it is missing
+	Missing bool
+}
+
+func (e *ParamError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("missing param %s of type %s", e.Name, e.Type)
+	} else if e.Value == nil {
+		return fmt.Sprintf("param %s of type %s is nil", e.Name, e.Type)
+	}
+	return fmt.Sprintf("param %s of type %s is %T", e.Name, e.Type, e.Value)
+}
+
+// A StepLimitError reports a rendering executing too many statements.
+type StepLimitError struct {
+	Limit int
+	At    Frame // statement executed when the limit was hit
+}
+
+// An IterationLimitError reports a loop iterating too many times.
+type IterationLimitError struct {
+	Limit int
+	At    Frame
+}
+
+// A DepthLimitError reports too many nested templates, included or extended.
+type DepthLimitError struct {
+	Limit int
+	At    Frame
+}
+
+// An OutputLimitError reports a rendering writing too many bytes.
+type OutputLimitError struct {
+	Limit int64
+	At    Frame
+}
+
+// A TimeLimitError reports a rendering taking too much time.
+type TimeLimitError struct {
+	Limit time.Duration
+	At    Frame
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("more than %d statements executed", e.Limit)
+}
+func (e *IterationLimitError) Error() string {
+	return fmt.Sprintf("more than %d loop iterations", e.Limit)
+}
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("more than %d nested templates", e.Limit)
+}
+func (e *OutputLimitError) Error() string {
+	return fmt.Sprintf("more than %d bytes written", e.Limit)
+}
+func (e *TimeLimitError) Error() string {
+	return fmt.Sprintf("rendering took more than %s", e.Limit)
+}
+
+// RULE_SYNTAX is the rule of the diagnostics reporting syntax errors.
+const RULE_SYNTAX = "syntax"
+
+// RULE_UNCLOSED is the rule of the diagnostics reporting the blocks not
+// closed by their end tag.
+const RULE_UNCLOSED = "unclosed-block"
+
+// A Diagnostic is a problem found in a template.
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+
+	src *Source // source the problem was found in; or nil
+}
+
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s (%s)", d.File, d.Line, d.Column, d.Message, d.Rule)
+}
+
+// Diagnostics is a list of diagnostics, which is an error when it reports
+// syntax errors.
+type Diagnostics []*Diagnostic
+
+func (ds Diagnostics) Error() string {
+	switch len(ds) {
+	case 0:
+		return "no errors"
+	case 1:
+		return ds[0].String()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", ds[0], len(ds)-1)
+}
+
+// newDiagnostic returns the diagnostic of the syntax error e found in src,
+// at pos unless e tells where it is.
+func newDiagnostic(src *Source, e error, pos Pos) *Diagnostic {
+	d := &Diagnostic{File: src.Identity, Rule: RULE_SYNTAX, Message: e.Error(), src: src}
+	line := 0
+	var se SyntaxError
+	if errors.As(e, &se) {
+		var p Pos
+		_, line, p = se.Location()
+		if p.IsValid() {
+			pos = p
+		}
+		d.Message = se.Brief()
+	}
+	if p := src.Position(pos); p.IsValid() {
+		d.Line, d.Column = p.Line, p.Column
+	} else {
+		d.Line = line
+	}
+	return d
+}
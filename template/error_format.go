@@ -0,0 +1,215 @@
+package template
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// excerptLines is the number of lines shown before and after the line of
+// an error.
+const excerptLines = 2
+
+// An excerpt is the message of an error along with the code around it.
+type excerpt struct {
+	identity string
+	message  string
+	line     int
+	column   int // 0 when only the line is known
+	lines    []*Line
+}
+
+// excerpts returns the excerpts of the errors reported by e, nil when it
+// reports no error located in a source.
+func excerpts(e error) (xs []*excerpt) {
+	var ds Diagnostics
+	if errors.As(e, &ds) {
+		for _, d := range ds {
+			if d.src != nil {
+				xs = append(xs, &excerpt{
+					identity: d.File,
+					message:  d.Message,
+					line:     d.Line,
+					column:   d.Column,
+					lines:    d.src.around(d.Line, excerptLines),
+				})
+			}
+		}
+		return
+	}
+	var se SyntaxError
+	if errors.As(e, &se) {
+		src, line, pos := se.Location()
+		if src == nil {
+			return nil
+		}
+		x := &excerpt{identity: src.Identity, message: se.Brief(), line: line}
+		if p := src.Position(pos); p.IsValid() {
+			x.line, x.column = p.Line, p.Column
+		}
+		x.lines = src.around(x.line, excerptLines)
+		return []*excerpt{x}
+	}
+	return nil
+}
+
+func (x *excerpt) location() string {
+	if x.column == 0 {
+		return fmt.Sprintf("%s:%d", x.identity, x.line)
+	}
+	return fmt.Sprintf("%s:%d:%d", x.identity, x.line, x.column)
+}
+
+// caretIndent returns the whitespace which puts a caret under column of
+// code, keeping its tabs.
+func caretIndent(code string, column int) string {
+	if column-1 < len(code) {
+		code = code[:column-1]
+	}
+	var sb strings.Builder
+	for _, r := range code {
+		if r == '\t' {
+			sb.WriteRune('\t')
+		} else {
+			sb.WriteRune(' ')
+		}
+	}
+	if n := column - 1 - len(code); n > 0 {
+		sb.WriteString(strings.Repeat(" ", n))
+	}
+	return sb.String()
+}
+
+// A textStyle holds the escape sequences of the parts of a text excerpt.
+type textStyle struct {
+	message, gutter, highlight, caret, reset string
+}
+
+var (
+	plainStyle = &textStyle{}
+	ansiStyle  = &textStyle{
+		message:   "\x1b[1;31m",
+		gutter:    "\x1b[34m",
+		highlight: "\x1b[1m",
+		caret:     "\x1b[1;31m",
+		reset:     "\x1b[0m",
+	}
+)
+
+func (st *textStyle) paint(seq, s string) string {
+	if seq == "" {
+		return s
+	}
+	return seq + s + st.reset
+}
+
+// FormatError returns the message of e followed by the code of the template
+// around the error, with a caret under its column. Errors which are not
+// located in a template are returned as is, and nil as "".
+func FormatError(e error) string {
+	return formatText(e, plainStyle)
+}
+
+// FormatErrorANSI is like FormatError, colored with ANSI escape sequences.
+func FormatErrorANSI(e error) string {
+	return formatText(e, ansiStyle)
+}
+
+func formatText(e error, st *textStyle) string {
+	if e == nil {
+		return ""
+	}
+	xs := excerpts(e)
+	if len(xs) == 0 {
+		return e.Error() + "\n"
+	}
+	var sb strings.Builder
+	for i, x := range xs {
+		if i > 0 {
+			sb.WriteByte('\n')
+		}
+		width := 1
+		if n := len(x.lines); n > 0 {
+			width = len(fmt.Sprint(x.lines[n-1].Num))
+		}
+		gutter := strings.Repeat(" ", width)
+		fmt.Fprintf(&sb, "%s\n", st.paint(st.message, "error: "+x.message))
+		fmt.Fprintf(&sb, "%s %s\n", gutter, st.paint(st.gutter, "--> ")+x.location())
+		fmt.Fprintf(&sb, "%s %s\n", gutter, st.paint(st.gutter, "|"))
+		for _, l := range x.lines {
+			num := st.paint(st.gutter, fmt.Sprintf("%*d |", width, l.Num))
+			if !l.Highlight {
+				fmt.Fprintf(&sb, "%s %s\n", num, l.Code)
+				continue
+			}
+			fmt.Fprintf(&sb, "%s %s\n", num, st.paint(st.highlight, l.Code))
+			if x.column > 0 {
+				fmt.Fprintf(&sb, "%s %s %s\n", gutter, st.paint(st.gutter, "|"),
+					caretIndent(l.Code, x.column)+st.paint(st.caret, "^"))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// WriteErrorHTML writes to w a standalone HTML page showing e along with
+// the code of the template around it. Nothing is written when e is nil.
+func WriteErrorHTML(w io.Writer, e error) error {
+	if e == nil {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString(errorPageHead)
+	xs := excerpts(e)
+	if len(xs) == 0 {
+		fmt.Fprintf(&sb, "<section>\n<h2>%s</h2>\n</section>\n", html.EscapeString(e.Error()))
+	}
+	for _, x := range xs {
+		fmt.Fprintf(&sb, "<section>\n<h2>%s</h2>\n", html.EscapeString(x.message))
+		fmt.Fprintf(&sb, "<p class=\"location\">%s</p>\n<pre>", html.EscapeString(x.location()))
+		for _, l := range x.lines {
+			class := "line"
+			if l.Highlight {
+				class += " highlight"
+			}
+			fmt.Fprintf(&sb, "<span class=\"%s\"><span class=\"num\">%d</span>%s</span>\n",
+				class, l.Num, html.EscapeString(l.Code))
+			if l.Highlight && x.column > 0 {
+				fmt.Fprintf(&sb, "<span class=\"line\"><span class=\"num\"></span>%s<span class=\"caret\">^</span></span>\n",
+					caretIndent(l.Code, x.column))
+			}
+		}
+		sb.WriteString("</pre>\n</section>\n")
+	}
+	sb.WriteString(errorPageFoot)
+	_, err := io.WriteString(w, sb.String())
+	return errors.WithStack(err)
+}
+
+const errorPageHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Template error</title>
+<style>
+body { margin: 2em; font-family: sans-serif; color: #222; background: #fafafa; }
+h1 { color: #b00020; }
+h2 { font-size: 1.1em; margin-bottom: .2em; }
+.location { margin-top: 0; color: #666; font-family: monospace; }
+pre { padding: .5em 0; background: #fff; border: 1px solid #ddd; tab-size: 4; }
+.line { display: block; padding: 0 .5em; }
+.num { display: inline-block; min-width: 3em; margin-right: 1em; color: #999; text-align: right; }
+.highlight { background: #fde8e8; }
+.caret { color: #b00020; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Template error</h1>
+`
+
+const errorPageFoot = `</body>
+</html>
+`
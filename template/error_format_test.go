@@ -0,0 +1,146 @@
+package template
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// parseError returns the first syntax error of the template code of t.html.
+func parseError(code string) error {
+	stream, e := NewLexer().Tokenize(&Source{Identity: "t.html", Code: code})
+	if e != nil {
+		return e
+	}
+	_, e = (&TokenFilter{Tr: &Tree{}}).Filter(stream)
+	return e
+}
+
+func TestFormatError(t *testing.T) {
+	_, diags := Parse(&Source{Identity: "t.html", Code: "{% if a b %}\n{{ x y }}"})
+	cases := []struct {
+		e    error
+		want string
+	}{
+		{nil, ""},
+		{errors.New("not located"), "not located\n"},
+		{parseError("a\nb\nc\n{{ 1 + }}\nd\ne\nf"), lines(
+			"error: unexpected end of expression, expecting expression",
+			"  --> t.html:4:7",
+			"  |",
+			"2 | b",
+			"3 | c",
+			"4 | {{ 1 + }}",
+			"  |       ^",
+			"5 | d",
+			"6 | e",
+		)},
+		// the tabs before the column are kept under the code
+		{parseError("\t{{ x y }}"), lines(
+			`error: unexpected token "y", expecting operator`,
+			"  --> t.html:1:7",
+			"  |",
+			"1 | \t{{ x y }}",
+			"  | \t     ^",
+		)},
+		// the gutter is as wide as the last line number
+		{parseError("1\n2\n3\n4\n5\n6\n7\n8\n9\n{% if %}\n11"), lines(
+			`error: unexpected token "%}", expecting expression`,
+			"   --> t.html:10:7",
+			"   |",
+			" 8 | 8",
+			" 9 | 9",
+			"10 | {% if %}",
+			"   |       ^",
+			"11 | 11",
+		)},
+		{errors.Wrap(parseError("{% endif %}"), "wrapped"), lines(
+			`error: unexpected token "endif"`,
+			"  --> t.html:1:4",
+			"  |",
+			"1 | {% endif %}",
+			"  |    ^",
+		)},
+		// each diagnostic has its excerpt
+		{diags, lines(
+			"error: unexpected end of template, expecting endif",
+			"  --> t.html:1:1",
+			"  |",
+			"1 | {% if a b %}",
+			"  | ^",
+			"2 | {{ x y }}",
+			"",
+			`error: unexpected token "b", expecting operator`,
+			"  --> t.html:1:9",
+			"  |",
+			"1 | {% if a b %}",
+			"  |         ^",
+			"2 | {{ x y }}",
+			"",
+			`error: unexpected token "y", expecting operator`,
+			"  --> t.html:2:6",
+			"  |",
+			"1 | {% if a b %}",
+			"2 | {{ x y }}",
+			"  |      ^",
+		)},
+	}
+	for _, c := range cases {
+		if got := FormatError(c.e); got != c.want {
+			t.Errorf("%v:\ngot\n%s\nwant\n%s", c.e, got, c.want)
+		}
+	}
+}
+
+func TestFormatErrorANSI(t *testing.T) {
+	got := FormatErrorANSI(parseError("{{ 1 + }}"))
+	want := lines(
+		"\x1b[1;31merror: unexpected end of expression, expecting expression\x1b[0m",
+		"  \x1b[34m--> \x1b[0mt.html:1:7",
+		"  \x1b[34m|\x1b[0m",
+		"\x1b[34m1 |\x1b[0m \x1b[1m{{ 1 + }}\x1b[0m",
+		"  \x1b[34m|\x1b[0m       \x1b[1;31m^\x1b[0m",
+	)
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestWriteErrorHTML(t *testing.T) {
+	var sb strings.Builder
+	if e := WriteErrorHTML(&sb, parseError("a\n\t{{ <b> + }}")); e != nil {
+		t.Fatal(e)
+	}
+	want := errorPageHead + lines(
+		"<section>",
+		"<h2>unexpected token &#34;&lt;&#34;, expecting expression</h2>",
+		`<p class="location">t.html:2:5</p>`,
+		`<pre><span class="line"><span class="num">1</span>a</span>`,
+		"<span class=\"line highlight\"><span class=\"num\">2</span>\t{{ &lt;b&gt; + }}</span>",
+		"<span class=\"line\"><span class=\"num\"></span>\t   <span class=\"caret\">^</span></span>",
+		"</pre>",
+		"</section>",
+	) + errorPageFoot
+	if got := sb.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	sb.Reset()
+	if e := WriteErrorHTML(&sb, errors.New("<not located>")); e != nil {
+		t.Fatal(e)
+	}
+	if want := "<section>\n<h2>&lt;not located&gt;</h2>\n</section>\n"; !strings.Contains(sb.String(), want) {
+		t.Errorf("got\n%s\nwant it to contain\n%s", sb.String(), want)
+	}
+
+	sb.Reset()
+	if e := WriteErrorHTML(&sb, nil); e != nil || sb.Len() > 0 {
+		t.Errorf("nil error: got %q, %v", sb.String(), e)
+	}
+}
+
+// lines returns the lines joined and terminated by newlines.
+func lines(ls ...string) string {
+	return strings.Join(ls, "\n") + "\n"
+}
@@ -0,0 +1,1182 @@
+package template
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// state represents the state of an execution.
+type state struct {
+	ctx    context.Context
+	ts     *Templates
+	wr     io.Writer
+	scope  *Scope            // innermost variable scope
+	blocks map[string]*block // blocks overridden by child templates
+	frames []*frame          // templates being executed, the outermost first
+	policy *SecurityPolicy   // policy of the sandboxed templates; or nil
+
+	steps    int       // statements executed
+	depth    int       // nested templates being executed
+	deadline time.Time // end of the time of the rendering; or zero
+
+	stack   []any       // operands of the programs being run
+	loops   []loop      // loops of the programs being run, the innermost last
+	saved   []*Scope    // scopes replaced by the programs being run
+	writers []io.Writer // writers replaced by the captures of the programs
+}
+
+// A block is a block overridden by a child template.
+type block struct {
+	stmt *BlockStmt
+	src  *Source  // source of the child template
+	prog *Program // program of the child template; or nil
+}
+
+// A frame is a template, or a block of another template, being executed.
+type frame struct {
+	src   *Source
+	pos   Pos    // position of the statement being executed
+	block string // name of the block being executed; or ""
+}
+
+// newState returns the state of a rendering to w, stopped when ctx is done.
+// The values of ctx are visible to the templates when it is not nil.
+func newState(ctx context.Context, ts *Templates, w io.Writer, data ...any) *state {
+	s := &state{ctx: ctx, ts: ts, wr: w, scope: ts.Globals.Push()}
+	if ts.Config.Sandboxed {
+		s.policy = ts.Config.policy()
+	}
+	s.limit(w)
+	if ctx == nil {
+		s.ctx = context.Background()
+	} else {
+		name := ts.Config.ContextVar
+		if name == "" {
+			name = "ctx"
+		}
+		s.scope.vars[name] = &contextValues{ctx: ctx, value: ts.Config.ContextValue}
+	}
+	for _, d := range data {
+		s.bind(d)
+	}
+	return s
+}
+
+// contextValues exposes the values of a context to templates.
+type contextValues struct {
+	ctx   context.Context
+	value func(ctx context.Context, name string) any // or nil
+}
+
+// lookup returns the value of the context named name.
+func (cv *contextValues) lookup(name string) any {
+	if cv.value != nil {
+		return cv.value(cv.ctx, name)
+	}
+	return cv.ctx.Value(name)
+}
+
+// canceled returns the error of the context of the rendering when it is done.
+func (s *state) canceled() error {
+	return s.ctx.Err()
+}
+
+// bind exposes the content of data to the template as root variables.
+func (s *state) bind(data any) {
+	root := s.scope.vars
+	switch d := data.(type) {
+	case nil:
+	case *Scope:
+		for _, name := range d.Names() {
+			root[name], _ = d.Lookup(name)
+		}
+	case map[string]any:
+		for k, v := range d {
+			root[k] = v
+		}
+	default:
+		v := indirect(reflect.ValueOf(data))
+		switch v.Kind() {
+		case reflect.Map:
+			if v.Type().Key().Kind() == reflect.String {
+				iter := v.MapRange()
+				for iter.Next() {
+					root[iter.Key().String()] = iter.Value().Interface()
+				}
+			}
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				if f := v.Type().Field(i); f.IsExported() {
+					root[f.Name] = v.Field(i).Interface()
+				}
+			}
+		}
+	}
+}
+
+// execute renders t, following the chain of extended templates. Its
+// program is run instead of walking its tree when the templates are
+// compiled to bytecode.
+func (s *state) execute(t *Template) error {
+	tr, p := t.tree(), (*Program)(nil)
+	if s.ts.Config.Bytecode {
+		tr, p = t.compiled()
+	}
+	if tr == nil {
+		return err("execute: template %s is not parsed", t.Source.Identity)
+	}
+	if e := s.nest(); e != nil {
+		return e
+	}
+	s.depth++
+	defer func() { s.depth-- }()
+	return s.enter(&frame{src: t.Source}, func() error {
+		if s.policy != nil {
+			if e := tr.check(t.Source, s.policy); e != nil {
+				return e
+			}
+		}
+		if ps := tr.params(); ps != nil {
+			if e := s.checkParams(ps); e != nil {
+				return e
+			}
+		}
+		if tr.Extend != nil {
+			if s.blocks == nil {
+				s.blocks = make(map[string]*block)
+			}
+			collectBlocks(tr.List, t.Source, p, s.blocks)
+			s.mark(tr.Extend)
+			base, e := s.ts.load(unquote(tr.Extend.Ident.Value))
+			if e != nil {
+				return e
+			}
+			return s.execute(base)
+		}
+		if p != nil {
+			return s.run(p, 0)
+		}
+		for _, node := range tr.List {
+			if e := s.walk(node); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+// collectBlocks registers the blocks of list, from the template of src
+// compiled to p, which are not overridden yet.
+func collectBlocks(list []ASTNode, src *Source, p *Program, blocks map[string]*block) {
+	for _, node := range list {
+		if b, ok := node.(*BlockStmt); ok {
+			if _, ok := blocks[b.Name.Name]; !ok {
+				blocks[b.Name.Name] = &block{stmt: b, src: src, prog: p}
+			}
+			if b.Body != nil {
+				for _, st := range b.Body.List {
+					collectBlocks([]ASTNode{st}, src, p, blocks)
+				}
+			}
+		}
+	}
+}
+
+// enter runs fn in the new frame f. The errors of fn are returned as
+// runtime errors holding the frames being executed when they occurred.
+func (s *state) enter(f *frame, fn func() error) error {
+	s.frames = append(s.frames, f)
+	e := fn()
+	if _, ok := e.(*RuntimeError); e != nil && !ok {
+		e = s.trace(e)
+	}
+	s.frames = s.frames[:len(s.frames)-1]
+	return e
+}
+
+// mark records that node is being executed in the current frame.
+func (s *state) mark(node ASTNode) {
+	if n := len(s.frames); n > 0 {
+		s.frames[n-1].pos = node.Pos()
+	}
+}
+
+// trace returns the runtime error of e, which occurred in the current frames.
+func (s *state) trace(e error) *RuntimeError {
+	re := &RuntimeError{Err: e}
+	for _, f := range s.frames {
+		re.Stack = append(re.Stack, f.export())
+	}
+	return re
+}
+
+// export returns the frame as it is reported by runtime errors.
+func (f *frame) export() Frame {
+	return Frame{Template: f.src.Identity, Line: f.src.Position(f.pos).Line, Block: f.block}
+}
+
+// denied returns the error of the use of the kind of thing name, which the
+// security policy denies.
+func (s *state) denied(kind, name string) error {
+	return &SecurityError{Kind: kind, Name: name}
+}
+
+// walkBlock renders the block bs, or the block overriding it.
+func (s *state) walkBlock(bs *BlockStmt) error {
+	f := s.frames[len(s.frames)-1]
+	if b, ok := s.blocks[bs.Name.Name]; ok && b.src != f.src {
+		return s.enter(&frame{src: b.src, block: bs.Name.Name}, func() error {
+			return s.walkSection(b.stmt.Body)
+		})
+	} else if ok {
+		bs = b.stmt
+	}
+	name := f.block
+	f.block = bs.Name.Name
+	defer func() { f.block = name }()
+	return s.walkSection(bs.Body)
+}
+
+func (s *state) walk(node ASTNode) error {
+	if e := s.canceled(); e != nil {
+		return e
+	}
+	s.mark(node)
+	if e := s.step(); e != nil {
+		return e
+	}
+	switch n := node.(type) {
+	case *TextStmt:
+		_, e := io.WriteString(s.wr, n.Text.(*BasicLit).Value)
+		return e
+	case *RawStmt:
+		_, e := io.WriteString(s.wr, n.Text.(*BasicLit).Value)
+		return e
+	case *ValueStmt:
+		v, e := s.evalExpr(n.Tok)
+		if e != nil {
+			return e
+		}
+		if v != nil {
+			if e = s.printable(v); e != nil {
+				return e
+			}
+			_, e = fmt.Fprint(s.wr, v)
+		}
+		return e
+	case *SectionStmt:
+		return s.walkSection(n)
+	case *SetStmt:
+		return s.assign(n.Assign)
+	case *AssignStmt:
+		return s.assign(n)
+	case *IfStmt:
+		return s.walkIf(n)
+	case *ForStmt:
+		return s.walkFor(n)
+	case *RangeStmt:
+		return s.walkRange(n)
+	case *BlockStmt:
+		return s.walkBlock(n)
+	case *IncludeStmt:
+		return s.walkInclude(n)
+	case *WithStmt:
+		return s.walkWith(n)
+	case *SpacelessStmt:
+		return s.walkSpaceless(n)
+	case *SandboxStmt:
+		return s.walkSandbox(n)
+	case *ExtendStmt, *CommentStmt, *ParamsStmt:
+		return nil
+	}
+	return err("walk: unexpected node %T", node)
+}
+
+func (s *state) walkSection(section *SectionStmt) error {
+	if section == nil {
+		return nil
+	}
+	for _, st := range section.List {
+		if e := s.walk(st); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *state) walkIf(is *IfStmt) error {
+	v, e := s.evalExpr(is.Cond)
+	if e != nil {
+		return e
+	}
+	if truth(v) {
+		return s.walkSection(is.Body)
+	}
+	if is.Else != nil {
+		return s.walk(is.Else)
+	}
+	return nil
+}
+
+func (s *state) walkFor(fs *ForStmt) error {
+	defer s.pop(s.push(s.scope.Push()))
+	if as, ok := fs.Init.(*AssignStmt); ok && as.Tok == "=" {
+		v, e := s.evalExpr(as.Rh)
+		if e != nil {
+			return e
+		}
+		if e = s.scope.Define(as.Lh.(*Ident).Name, v); e != nil {
+			return e
+		}
+	} else if fs.Init != nil {
+		if e := s.walk(fs.Init); e != nil {
+			return e
+		}
+	}
+	for n := 1; ; n++ {
+		if fs.Cond != nil {
+			v, e := s.evalExpr(fs.Cond)
+			if e != nil {
+				return e
+			}
+			if !truth(v) {
+				return nil
+			}
+		}
+		if e := s.canceled(); e != nil {
+			return e
+		}
+		if e := s.iterate(n); e != nil {
+			return e
+		}
+		if e := s.walkSection(fs.Body); e != nil {
+			return e
+		}
+		if fs.Post != nil {
+			if e := s.walk(fs.Post); e != nil {
+				return e
+			}
+		}
+	}
+}
+
+func (s *state) walkRange(rs *RangeStmt) error {
+	x, e := s.evalExpr(rs.X)
+	if e != nil {
+		return e
+	}
+	defer s.pop(s.push(s.scope.Push()))
+	it, e := newIterator(x)
+	if e != nil {
+		return e
+	}
+	for n := 1; ; n++ {
+		k, v, ok := it.next()
+		if !ok {
+			return nil
+		}
+		if e := s.canceled(); e != nil {
+			return e
+		}
+		if e := s.iterate(n); e != nil {
+			return e
+		}
+		if rs.Key != nil {
+			s.scope.Define(rs.Key.(*Ident).Name, k)
+		}
+		if rs.Value != nil {
+			s.scope.Define(rs.Value.(*Ident).Name, v)
+		}
+		if e := s.walkSection(rs.Body); e != nil {
+			return e
+		}
+	}
+}
+
+// An iterator steps through the keys and values of a value ranged over.
+type iterator struct {
+	val   reflect.Value
+	keys  []reflect.Value // sorted keys of a map
+	runes []rune          // runes of a string
+	i, n  int
+}
+
+// newIterator returns the iterator of x, which is empty when x is nil.
+func newIterator(x any) (iterator, error) {
+	it := iterator{val: indirect(reflect.ValueOf(x))}
+	switch it.val.Kind() {
+	case reflect.Invalid:
+	case reflect.Slice, reflect.Array:
+		it.n = it.val.Len()
+	case reflect.String:
+		it.runes = []rune(it.val.String())
+		it.n = len(it.runes)
+	case reflect.Map:
+		it.keys = sortKeys(it.val.MapKeys())
+		it.n = len(it.keys)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		it.n = int(it.val.Int())
+	default:
+		return it, err("walkRange: can't range over %s", it.val.Type())
+	}
+	return it, nil
+}
+
+// next returns the next key and value, and false when there are no more.
+func (it *iterator) next() (k, v any, ok bool) {
+	if it.i >= it.n {
+		return nil, nil, false
+	}
+	i := it.i
+	it.i++
+	switch it.val.Kind() {
+	case reflect.Slice, reflect.Array:
+		return i, it.val.Index(i).Interface(), true
+	case reflect.String:
+		return i, string(it.runes[i]), true
+	case reflect.Map:
+		return it.keys[i].Interface(), it.val.MapIndex(it.keys[i]).Interface(), true
+	}
+	return int64(i), int64(i), true
+}
+
+func (s *state) walkInclude(is *IncludeStmt) error {
+	t, e := s.ts.load(unquote(is.Ident.Value))
+	if e != nil {
+		return e
+	}
+	scope := s.scope.Fork()
+	for _, as := range is.Params {
+		v, e := s.evalExpr(as.Rh)
+		if e != nil {
+			return e
+		}
+		scope.Define(as.Lh.(*Ident).Name, v)
+	}
+	blocks := s.blocks
+	s.blocks = nil
+	defer func() { s.blocks = blocks }()
+	defer s.pop(s.push(scope))
+	return s.execute(t)
+}
+
+func (s *state) walkWith(ws *WithStmt) error {
+	var scope *Scope
+	if ws.Only {
+		scope = s.ts.Globals.Fork()
+	} else {
+		scope = s.scope.Fork()
+	}
+	if ws.X != nil {
+		x, e := s.evalExpr(ws.X)
+		if e != nil {
+			return e
+		}
+		if e = checkHash(x); e != nil {
+			return e
+		}
+		iter := indirect(reflect.ValueOf(x)).MapRange()
+		for iter.Next() {
+			scope.Define(iter.Key().String(), iter.Value().Interface())
+		}
+	}
+	for _, as := range ws.Params {
+		v, e := s.evalExpr(as.Rh)
+		if e != nil {
+			return e
+		}
+		scope.Define(as.Lh.(*Ident).Name, v)
+	}
+	defer s.pop(s.push(scope))
+	return s.walkSection(ws.Body)
+}
+
+// checkHash returns an error when x is not the hash of the variables of
+// a with.
+func checkHash(x any) error {
+	val := indirect(reflect.ValueOf(x))
+	if val.Kind() != reflect.Map || val.Type().Key().Kind() != reflect.String {
+		return err("walkWith: variables of with must be a hash, got %T", x)
+	}
+	return nil
+}
+
+func (s *state) walkSpaceless(ss *SpacelessStmt) error {
+	if isStaticSection(ss.Body) {
+		return s.walkSection(ss.Body)
+	}
+	wr := s.wr
+	buf := &bytes.Buffer{}
+	s.wr = buf
+	e := s.walkSection(ss.Body)
+	s.wr = wr
+	if e != nil {
+		return e
+	}
+	_, e = io.WriteString(s.wr, removeSpaces(buf.String()))
+	return e
+}
+
+// walkSandbox renders the includes of ss under the security policy.
+func (s *state) walkSandbox(ss *SandboxStmt) error {
+	if s.policy != nil {
+		return s.walkSection(ss.Body)
+	}
+	s.policy = s.ts.Config.policy()
+	defer func() { s.policy = nil }()
+	return s.walkSection(ss.Body)
+}
+
+// printable returns an error when printing v calls one of its methods the
+// security policy denies, or would show the values it holds: the structs,
+// maps, slices and arrays, which may hold denied fields, are not printed.
+func (s *state) printable(v any) error {
+	if s.policy == nil || v == nil {
+		return nil
+	}
+	var name string
+	switch v.(type) {
+	case fmt.Formatter:
+		name = "Format"
+	case error:
+		name = "Error"
+	case fmt.Stringer:
+		name = "String"
+	default:
+		switch indirect(reflect.ValueOf(v)).Kind() {
+		case reflect.Bool, reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.Invalid:
+			return nil
+		}
+		return s.denied("print", typeName(reflect.TypeOf(v)))
+	}
+	if !s.policy.allowsMethod(reflect.TypeOf(v), name) {
+		return s.denied("method", name)
+	}
+	return nil
+}
+
+func (s *state) assign(as *AssignStmt) error {
+	name := as.Lh.(*Ident).Name
+	switch as.Tok {
+	case "=":
+		v, e := s.evalExpr(as.Rh)
+		if e != nil {
+			return e
+		}
+		return s.scope.Set(name, v)
+	case "+=", "-=", "&=", "|=", "^=", "<<=", ">>=", "++", "--":
+		x, e := s.lookup(name)
+		if e != nil {
+			return e
+		}
+		var y any = int64(1)
+		if as.Rh != nil {
+			if y, e = s.evalExpr(as.Rh); e != nil {
+				return e
+			}
+		}
+		if x, e = binary(assignOp(as.Tok), x, y); e != nil {
+			return e
+		}
+		return s.scope.Set(name, x)
+	}
+	return err("assign: unexpected token %s", as.Tok)
+}
+
+// assignOp returns the binary operator applied by the assignment operator
+// tok, e.g. + for += and ++, or "" when tok is not such an operator.
+func assignOp(tok string) string {
+	switch tok {
+	case "++", "--":
+		return tok[:1]
+	case "+=", "-=", "&=", "|=", "^=", "<<=", ">>=":
+		return tok[:len(tok)-1]
+	}
+	return ""
+}
+
+// push makes scope the innermost scope and returns the previous one.
+func (s *state) push(scope *Scope) *Scope {
+	prev := s.scope
+	s.scope = scope
+	return prev
+}
+
+// pop restores the scope returned by push.
+func (s *state) pop(prev *Scope) {
+	s.scope = prev
+}
+
+// lookup resolves a possibly dotted name, e.g. user.profile.name.
+func (s *state) lookup(name string) (any, error) {
+	return s.resolve(strings.Split(name, "."))
+}
+
+// resolve returns the value of the variable parts[0], followed by the
+// properties of the rest of parts.
+func (s *state) resolve(parts []string) (any, error) {
+	v, ok := s.scope.Lookup(parts[0])
+	if !ok {
+		return nil, err("lookup: variable %s is not defined", parts[0])
+	}
+	for _, p := range parts[1:] {
+		var e error
+		if v, e = s.property(v, p); e != nil {
+			return nil, e
+		}
+	}
+	return v, nil
+}
+
+func (s *state) evalExpr(expr Expr) (any, error) {
+	switch x := expr.(type) {
+	case *BasicLit:
+		return literal(x)
+	case *Ident:
+		return s.lookup(x.Name)
+	case *IndexExpr:
+		v, e := s.evalExpr(x.X)
+		if e != nil {
+			return nil, e
+		}
+		idx, e := s.evalExpr(x.Index)
+		if e != nil {
+			return nil, e
+		}
+		return index(v, idx)
+	case *SelectorExpr:
+		v, e := s.evalExpr(x.X)
+		if e != nil {
+			return nil, e
+		}
+		return s.property(v, x.Sel.Name)
+	case *CallExpr:
+		return s.evalCall(x)
+	case *UnaryExpr:
+		v, e := s.evalExpr(x.X)
+		if e != nil {
+			return nil, e
+		}
+		return unary(x.Op.Op, v)
+	case *BinaryExpr:
+		v, e := s.evalExpr(x.X)
+		if e != nil {
+			return nil, e
+		}
+		switch x.Op.Op {
+		case "&&", "and":
+			if !truth(v) {
+				return false, nil
+			}
+			v, e = s.evalExpr(x.Y)
+			return truth(v), e
+		case "||", "or":
+			if truth(v) {
+				return true, nil
+			}
+			v, e = s.evalExpr(x.Y)
+			return truth(v), e
+		}
+		y, e := s.evalExpr(x.Y)
+		if e != nil {
+			return nil, e
+		}
+		return binary(x.Op.Op, v, y)
+	case *TestExpr:
+		ok, e := s.evalTest(x)
+		return ok != x.Not, e
+	}
+	return nil, err("evalExpr: unexpected expression %T", expr)
+}
+
+func (s *state) evalCall(call *CallExpr) (any, error) {
+	var (
+		name string
+		fn   reflect.Value
+		e    error
+	)
+	if sel, ok := call.Fun.(*SelectorExpr); ok {
+		name = sel.Sel.Name
+		recv, e := s.evalExpr(sel.X)
+		if e != nil {
+			return nil, e
+		}
+		fn, e = s.method(recv, sel.X, name)
+	} else {
+		name = call.Fun.(*Ident).Name
+		fn, e = s.function(name, call.Pipe.IsValid())
+	}
+	if e != nil {
+		return nil, e
+	}
+	var args []any
+	if call.Args != nil {
+		for _, arg := range call.Args.List {
+			v, e := s.evalExpr(arg)
+			if e != nil {
+				return nil, e
+			}
+			args = append(args, v)
+		}
+	}
+	return s.call(name, fn, args)
+}
+
+// function returns the function, or the method, called by name, or applied
+// as a filter.
+func (s *state) function(name string, filter bool) (reflect.Value, error) {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		recv, e := s.lookup(name[:i])
+		if e != nil {
+			return reflect.Value{}, e
+		}
+		return s.method(recv, &Ident{Name: name[:i]}, name[i+1:])
+	}
+	if s.policy != nil && filter && !s.policy.allowsFilter(name) {
+		return reflect.Value{}, s.denied("filter", name)
+	}
+	if s.policy != nil && !filter && !s.policy.allowsFunction(name) {
+		return reflect.Value{}, s.denied("function", name)
+	}
+	f, ok := s.scope.Lookup(name)
+	if !ok {
+		return reflect.Value{}, err("evalCall: function %s is not defined", name)
+	}
+	return reflect.ValueOf(f), nil
+}
+
+// method returns the method name of recv, the value of x.
+func (s *state) method(recv any, x Expr, name string) (reflect.Value, error) {
+	fn := method(reflect.ValueOf(recv), name)
+	if !fn.IsValid() {
+		return fn, err("evalCall: %s has no method %s", (&printer{}).expr(x), name)
+	}
+	if s.policy != nil && !s.policy.allowsMethod(reflect.TypeOf(recv), name) {
+		return fn, s.denied("method", name)
+	}
+	return fn, nil
+}
+
+// call calls fn with args like callFunc, passing the context of the rendering
+// first when fn accepts it. A panic of fn is returned as a PanicError, unless
+// the templates are configured to let it go through.
+func (s *state) call(name string, fn reflect.Value, args []any) (v any, e error) {
+	if fn.Kind() == reflect.Func && fn.Type().NumIn() > 0 && fn.Type().In(0) == contextType {
+		args = append([]any{s.ctx}, args...)
+	}
+	if !s.ts.Config.Repanic {
+		defer func() {
+			if r := recover(); r != nil {
+				v, e = nil, &PanicError{Func: name, Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return callFunc(name, fn, args)
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// callFunc calls fn with args. fn must return one value, or a value and an error.
+func callFunc(name string, fn reflect.Value, args []any) (any, error) {
+	if fn.Kind() != reflect.Func {
+		return nil, err("callFunc: %s is not a function", name)
+	}
+	typ := fn.Type()
+	numIn := typ.NumIn()
+	if typ.IsVariadic() {
+		if len(args) < numIn-1 {
+			return nil, err("callFunc: wrong number of args for %s: want at least %d got %d", name, numIn-1, len(args))
+		}
+	} else if len(args) != numIn {
+		return nil, err("callFunc: wrong number of args for %s: want %d got %d", name, numIn, len(args))
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var argType reflect.Type
+		if typ.IsVariadic() && i >= numIn-1 {
+			argType = typ.In(numIn - 1).Elem()
+		} else {
+			argType = typ.In(i)
+		}
+		v, e := convert(arg, argType)
+		if e != nil {
+			return nil, err("callFunc: arg %d of %s: %s", i, name, e)
+		}
+		in[i] = v
+	}
+	out := fn.Call(in)
+	switch len(out) {
+	case 1:
+		return out[0].Interface(), nil
+	case 2:
+		if e, _ := out[1].Interface().(error); e != nil {
+			return nil, e
+		}
+		return out[0].Interface(), nil
+	}
+	return nil, err("callFunc: %s must return one value, or a value and an error", name)
+}
+
+func convert(arg any, typ reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		switch typ.Kind() {
+		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice:
+			return reflect.Zero(typ), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use nil as %s", typ)
+	}
+	v := reflect.ValueOf(arg)
+	if v.Type().AssignableTo(typ) {
+		return v, nil
+	}
+	if isNumber(v.Kind()) && isNumber(typ.Kind()) {
+		return v.Convert(typ), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %s as %s", v.Type(), typ)
+}
+
+// property returns the field, the map entry or the result of the method
+// without arguments named name of v.
+func (s *state) property(v any, name string) (any, error) {
+	if cv, ok := v.(*contextValues); ok {
+		return cv.lookup(name), nil
+	}
+	val := reflect.ValueOf(v)
+	if m := method(val, name); m.IsValid() && m.Type().NumIn() == 0 {
+		if s.policy != nil && !s.policy.allowsMethod(val.Type(), name) {
+			return nil, s.denied("method", name)
+		}
+		return s.call(name, m, nil)
+	}
+	val = indirect(val)
+	switch val.Kind() {
+	case reflect.Struct:
+		if f, ok := val.Type().FieldByName(name); ok && f.IsExported() {
+			if s.policy != nil && !s.policy.allowsField(val.Type(), name) {
+				return nil, s.denied("field", name)
+			}
+			return val.FieldByIndex(f.Index).Interface(), nil
+		}
+	case reflect.Map:
+		if val.Type().Key().Kind() == reflect.String {
+			if r := val.MapIndex(reflect.ValueOf(name).Convert(val.Type().Key())); r.IsValid() {
+				return r.Interface(), nil
+			}
+			return nil, nil
+		}
+	}
+	return nil, err("property: can't evaluate field %s of %T", name, v)
+}
+
+func method(v reflect.Value, name string) reflect.Value {
+	if !v.IsValid() {
+		return reflect.Value{}
+	}
+	if m := v.MethodByName(name); m.IsValid() {
+		return m
+	}
+	if v.Kind() != reflect.Pointer && v.CanAddr() {
+		return v.Addr().MethodByName(name)
+	}
+	return reflect.Value{}
+}
+
+func index(v, idx any) (any, error) {
+	if cv, ok := v.(*contextValues); ok {
+		name, ok := idx.(string)
+		if !ok {
+			return nil, err("index: cannot index the context with %T", idx)
+		}
+		return cv.lookup(name), nil
+	}
+	val := indirect(reflect.ValueOf(v))
+	switch val.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+		i, ok := toInt(idx)
+		if !ok {
+			return nil, err("index: cannot index %T with %T", v, idx)
+		}
+		if i < 0 || i >= int64(val.Len()) {
+			return nil, err("index: index %d out of range", i)
+		}
+		if val.Kind() == reflect.String {
+			return string(val.String()[i]), nil
+		}
+		return val.Index(int(i)).Interface(), nil
+	case reflect.Map:
+		k, e := convert(idx, val.Type().Key())
+		if e != nil {
+			return nil, err("index: %s", e)
+		}
+		if r := val.MapIndex(k); r.IsValid() {
+			return r.Interface(), nil
+		}
+		return nil, nil
+	}
+	return nil, err("index: cannot index %T", v)
+}
+
+// binary evaluates the arithmetic or comparison operation op on x and y.
+func binary(op string, x, y any) (any, error) {
+	if xs, ok := x.(string); ok {
+		if ys, ok := y.(string); ok {
+			switch op {
+			case "+":
+				return xs + ys, nil
+			case "==":
+				return xs == ys, nil
+			case "!=":
+				return xs != ys, nil
+			case ">":
+				return xs > ys, nil
+			case "<":
+				return xs < ys, nil
+			case ">=":
+				return xs >= ys, nil
+			case "<=":
+				return xs <= ys, nil
+			}
+			return nil, err("binary: unexpected operator %s on strings", op)
+		}
+	}
+	if xb, ok := x.(bool); ok {
+		if yb, ok := y.(bool); ok {
+			switch op {
+			case "&", "b-and":
+				return xb && yb, nil
+			case "|", "b-or":
+				return xb || yb, nil
+			case "^", "b-xor":
+				return xb != yb, nil
+			}
+		}
+	}
+	xi, xf, xok := toNumber(x)
+	yi, yf, yok := toNumber(y)
+	if !xok || !yok {
+		switch op {
+		case "==":
+			return equal(x, y), nil
+		case "!=":
+			return !equal(x, y), nil
+		}
+		return nil, err("binary: invalid operation %T %s %T", x, op, y)
+	}
+	if xf == nil && yf == nil {
+		switch op {
+		case "+":
+			return xi + yi, nil
+		case "-":
+			return xi - yi, nil
+		case "*":
+			return xi * yi, nil
+		case "/", "%":
+			if yi == 0 {
+				return nil, err("binary: integer divide by zero")
+			}
+			if op == "/" {
+				return xi / yi, nil
+			}
+			return xi % yi, nil
+		case "&", "b-and":
+			return xi & yi, nil
+		case "|", "b-or":
+			return xi | yi, nil
+		case "^", "b-xor":
+			return xi ^ yi, nil
+		case "<<", ">>":
+			if yi < 0 {
+				return nil, err("binary: negative shift count %d", yi)
+			}
+			if op == "<<" {
+				return xi << uint64(yi), nil
+			}
+			return xi >> uint64(yi), nil
+		}
+		return compare(op, float64(xi), float64(yi))
+	}
+	a, b := float64(xi), float64(yi)
+	if xf != nil {
+		a = *xf
+	}
+	if yf != nil {
+		b = *yf
+	}
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	}
+	return compare(op, a, b)
+}
+
+// unary evaluates the unary operation op on x.
+func unary(op string, x any) (any, error) {
+	switch op {
+	case "!", "not":
+		return !truth(x), nil
+	}
+	i, f, ok := toNumber(x)
+	if !ok {
+		return nil, err("unary: invalid operation %s %T", op, x)
+	}
+	switch {
+	case f != nil && op == "-":
+		return -*f, nil
+	case f != nil:
+		return *f, nil
+	case op == "-":
+		return -i, nil
+	}
+	return i, nil
+}
+
+func compare(op string, a, b float64) (any, error) {
+	switch op {
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case ">":
+		return a > b, nil
+	case "<":
+		return a < b, nil
+	case ">=":
+		return a >= b, nil
+	case "<=":
+		return a <= b, nil
+	}
+	return nil, err("binary: unexpected operator %s on numbers", op)
+}
+
+func equal(x, y any) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	if reflect.TypeOf(x).Comparable() && reflect.TypeOf(y).Comparable() {
+		return x == y
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// toNumber returns the value of x as an integer, or as a float when
+// the float pointer is not nil.
+func toNumber(x any) (int64, *float64, bool) {
+	v := reflect.ValueOf(x)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(v.Uint()), nil, true
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		return 0, &f, true
+	}
+	return 0, nil, false
+}
+
+func toInt(x any) (int64, bool) {
+	i, f, ok := toNumber(x)
+	if !ok || f != nil {
+		return 0, false
+	}
+	return i, true
+}
+
+func isNumber(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+// truth reports whether the value is 'true', in the sense of not the zero of its type,
+// and whether the value has a meaningful truth value.
+func truth(v any) bool {
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Invalid:
+		return false
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return val.Len() > 0
+	case reflect.Bool:
+		return val.Bool()
+	case reflect.Complex64, reflect.Complex128:
+		return val.Complex() != 0
+	case reflect.Chan, reflect.Func, reflect.Pointer, reflect.Interface:
+		return !val.IsNil()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int() != 0
+	case reflect.Float32, reflect.Float64:
+		return val.Float() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return val.Uint() != 0
+	}
+	return true
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func literal(lit *BasicLit) (any, error) {
+	switch lit.Kind {
+	case TYPE_NUMBER:
+		if i, e := strconv.ParseInt(lit.Value, 10, 64); e == nil {
+			return i, nil
+		}
+		f, e := strconv.ParseFloat(lit.Value, 64)
+		if e != nil {
+			return nil, err("literal: invalid number %s", lit.Value)
+		}
+		return f, nil
+	case TYPE_STRING:
+		return unquote(lit.Value), nil
+	}
+	return nil, err("literal: unexpected literal %s", lit.Value)
+}
+
+// unquote interprets a single or double quoted string literal.
+func unquote(s string) string {
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return s
+	}
+	if s[0] == '\'' {
+		s = `"` + strings.ReplaceAll(strings.ReplaceAll(s[1:len(s)-1], `\'`, `'`), `"`, `\"`) + `"`
+	}
+	if u, e := strconv.Unquote(s); e == nil {
+		return u
+	}
+	return s[1 : len(s)-1]
+}
+
+func sortKeys(keys []reflect.Value) []reflect.Value {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if ai, af, ok := toNumber(a.Interface()); ok && af == nil {
+			if bi, bf, ok := toNumber(b.Interface()); ok && bf == nil {
+				return ai < bi
+			}
+		}
+		return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+	})
+	return keys
+}
@@ -0,0 +1,254 @@
+package template
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRuntimeErrorStack(t *testing.T) {
+	cases := []struct {
+		path string
+		want []Frame
+	}{
+		{"testdata/stack/inc.html", []Frame{
+			{Template: "testdata/stack/inc.html", Line: 2},
+		}},
+		// the block of a page is executed in the page
+		{"testdata/stack/page.html", []Frame{
+			{Template: "testdata/stack/page.html", Line: 3, Block: "body"},
+			{Template: "testdata/stack/inc.html", Line: 2},
+		}},
+		// the block of a child is executed in its base
+		{"testdata/stack/child.html", []Frame{
+			{Template: "testdata/stack/child.html", Line: 1},
+			{Template: "testdata/stack/base.html", Line: 2},
+			{Template: "testdata/stack/child.html", Line: 3, Block: "body"},
+			{Template: "testdata/stack/inc.html", Line: 2},
+		}},
+	}
+	for _, bytecode := range []bool{false, true} {
+		for _, c := range cases {
+			e := NewTemplates(&Config{Bytecode: bytecode}).Render(io.Discard, c.path)
+			var re *RuntimeError
+			if !errors.As(e, &re) {
+				t.Errorf("%s: got %v, want a runtime error", c.path, e)
+				continue
+			}
+			if !reflect.DeepEqual(re.Stack, c.want) {
+				t.Errorf("%s, bytecode %v:\ngot  %+v\nwant %+v", c.path, bytecode, re.Stack, c.want)
+			}
+			if re.Err == nil || errors.Unwrap(re) != re.Err {
+				t.Errorf("%s: got error %v", c.path, re.Err)
+			}
+		}
+	}
+}
+
+func TestRuntimeErrorString(t *testing.T) {
+	e := &RuntimeError{
+		Stack: []Frame{
+			{Template: "a.html", Line: 1},
+			{Template: "b.html", Line: 3, Block: "body"},
+			{Template: "c.html"},
+		},
+		Err: errors.New("boom"),
+	}
+	if got, want := e.Error(), `a.html:1 -> b.html:3 block "body" -> c.html: boom`; got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+type panicker struct{}
+
+func (panicker) Boom() int { panic("method") }
+
+func TestCallPanics(t *testing.T) {
+	cases := []struct {
+		code  string
+		fn    string
+		value any
+	}{
+		{"a{{ boom() }}", "boom", "function"},
+		{"a{{ 1 | boom }}", "boom", "function"},
+		{"a{{ p.Boom() }}", "p.Boom", "method"},
+		{"a{% for i = 0; i < 3; i++ %}{% if i == 2 %}{{ boom() }}{% endif %}{% endfor %}", "boom", "function"},
+	}
+	templates := func(cfg Config) *Templates {
+		ts := NewTemplates(&cfg)
+		ts.AddGlobal("boom", func(x ...int) int { panic("function") })
+		return ts
+	}
+	for _, bytecode := range []bool{false, true} {
+		for _, c := range cases {
+			w := &bytes.Buffer{}
+			e := templates(Config{Bytecode: bytecode}).RenderString(w, c.code, KS(KV("p", panicker{})))
+			var pe *PanicError
+			var re *RuntimeError
+			if !errors.As(e, &pe) || !errors.As(e, &re) {
+				t.Errorf("%q: got %v, want a runtime error of a panic", c.code, e)
+				continue
+			}
+			if pe.Func != c.fn || pe.Value != c.value || !bytes.Contains(pe.Stack, []byte("panic")) {
+				t.Errorf("%q: got panic of %s: %v", c.code, pe.Func, pe.Value)
+			}
+			if !strings.HasPrefix(w.String(), "a") {
+				t.Errorf("%q: got output %q", c.code, w.String())
+			}
+
+			// the panic goes through with Repanic
+			func() {
+				defer func() {
+					if v := recover(); v != c.value {
+						t.Errorf("%q: Repanic: got panic %v, want %v", c.code, v, c.value)
+					}
+				}()
+				templates(Config{Bytecode: bytecode, Repanic: true}).RenderString(io.Discard, c.code, KS(KV("p", panicker{})))
+			}()
+		}
+	}
+}
+
+type contextKey string
+
+func TestRenderContext(t *testing.T) {
+	for _, bytecode := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "user", "bob"))
+		ts := NewTemplates(&Config{Bytecode: bytecode})
+		ts.AddGlobal("who", func(ctx context.Context) any { return ctx.Value("user") })
+		ts.AddGlobal("greet", func(ctx context.Context, s string) string { return s + " " + ctx.Value("user").(string) })
+		ts.AddGlobal("tag", func(ctx context.Context, s string) string { return "<" + s + ">" })
+		ts.AddGlobal("cancel", func() string { cancel(); return "" })
+
+		w := &strings.Builder{}
+		e := ts.RenderContext(ctx, w, "testdata/context/values.html")
+		if want := "bob||bob|hi bob|<x>\n"; e != nil || w.String() != want {
+			t.Errorf("values, bytecode %v: got %q, %v, want %q", bytecode, w.String(), e, want)
+		}
+		// the rendering stops at the statement following the cancellation
+		w.Reset()
+		e = ts.RenderContext(ctx, w, "testdata/context/loop.html")
+		if want := "0 1 2 "; !errors.Is(e, context.Canceled) || w.String() != want {
+			t.Errorf("loop, bytecode %v: got %q, %v, want %q", bytecode, w.String(), e, want)
+		}
+		w.Reset()
+		e = ts.RenderContext(ctx, w, "testdata/context/values.html")
+		if !errors.Is(e, context.Canceled) || w.Len() > 0 {
+			t.Errorf("canceled, bytecode %v: got %q, %v", bytecode, w.String(), e)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+		ts.AddGlobal("cancel", func() string { time.Sleep(5 * time.Millisecond); return "" })
+		e = ts.RenderContext(ctx, io.Discard, "testdata/context/loop.html")
+		if !errors.Is(e, context.DeadlineExceeded) {
+			t.Errorf("deadline, bytecode %v: got %v", bytecode, e)
+		}
+		cancel()
+	}
+}
+
+func TestContextValue(t *testing.T) {
+	ts := NewTemplates(&Config{
+		ContextVar: "req",
+		ContextValue: func(ctx context.Context, name string) any {
+			return ctx.Value(contextKey(name))
+		},
+	})
+	ctx := context.WithValue(context.Background(), contextKey("user"), "bob")
+	w := &strings.Builder{}
+	if e := ts.RenderContext(ctx, w, "testdata/context/req.html"); e != nil || w.String() != "bob|" {
+		t.Errorf("got %q, %v", w.String(), e)
+	}
+	// without context, the variable is not defined
+	w.Reset()
+	if e := ts.Render(w, "testdata/context/req.html"); e == nil {
+		t.Errorf("got %q, want an error", w.String())
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	data := KS(KV("a", 6), KV("b", 3), KV("t", true), KV("f", false), KV("order", 1), KV("s", "x"))
+	cases := []struct {
+		code string
+		want string
+		err  string
+	}{
+		{"{{ a & b }} {{ a b-and b }}", "2 2", ""},
+		{"{{ a b-or b }} {{ a ^ b }} {{ a b-xor b }}", "7 5 5", ""},
+		{"{{ a << b }} {{ a >> 1 }} {{ -a >> 1 }}", "48 3 -3", ""},
+		{"{{ t & f }} {{ t b-or f }} {{ t ^ t }} {{ t b-xor f }}", "false true false true", ""},
+		{"{{ t and f }} {{ t or f }} {{ f or a }} {{ a and b }}", "false true true true", ""},
+		// and and or do not evaluate their right operand when not needed
+		{"{{ f and nope() }} {{ t or nope() }}", "false true", ""},
+		// the words containing word operators are names
+		{"{{ order or 0 }} {{ a - b }}", "true 3", ""},
+		{"{% set x = a %}{% set x &= b %}{{ x }} {% set x |= 8 %}{{ x }} {% set x ^= 1 %}{{ x }}", "2 10 11", ""},
+		{"{% set x = 1 %}{% set x <<= b %}{{ x }} {% set x >>= 2 %}{{ x }}", "8 2", ""},
+		{"{{ 6 b-and 3 }} {{ 1 << 4 b-or 1 }} {{ 1 and 0 }}", "2 17 false", ""},
+		{"{{ a << -1 }}", "", "binary: negative shift count -1"},
+		{"{{ a & s }}", "", "binary: invalid operation int & string"},
+	}
+	for _, cfg := range []Config{{}, {Bytecode: true}, {Optimize: true}} {
+		for _, c := range cases {
+			w := &strings.Builder{}
+			e := NewTemplates(&cfg).RenderString(w, c.code, data)
+			got := ""
+			var re *RuntimeError
+			if errors.As(e, &re) {
+				got = re.Err.Error()
+			} else if e != nil {
+				got = e.Error()
+			}
+			if w.String() != c.want || got != c.err {
+				t.Errorf("%q (bytecode %v, optimize %v):\ngot  %q, %q\nwant %q, %q", c.code, cfg.Bytecode, cfg.Optimize, w.String(), got, c.want, c.err)
+			}
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	data := KS(KV("a", 0), KV("b", "b"), KV("h", map[string]int{"a": 2, "c": 3}))
+	cases := []struct {
+		code string
+		want string
+		err  string
+	}{
+		{"{% with {a: 1} %}{{ a }}{{ b }}{% endwith %}{{ a }}", "1b0", ""},
+		{"{% with {a: 1, c: a + 1} %}{{ a }}{{ c }}{% endwith %}", "11", ""},
+		{"{% with h %}{{ a }}{{ c }}{{ b }}{% endwith %}", "23b", ""},
+		{"{% with {a: a + 1} %}{% with {a: a + 1} %}{{ a }}{% endwith %}{{ a }}{% endwith %}{{ a }}", "210", ""},
+		// only hides the variables of the enclosing scopes, not the globals
+		{"{% with {c: 1} only %}{{ c }}{{ g }}{{ a is defined }}{% endwith %}", "1gfalse", ""},
+		{"{% with h only %}{{ a }}{{ b is defined }}{% endwith %}", "2false", ""},
+		{"{% with {c: 1} only %}{{ b }}{% endwith %}", "", "lookup: variable b is not defined"},
+		// the variables set in the block do not leak out of it
+		{"{% with {c: 1} %}{% set d = 2 %}{% set a = 3 %}{{ a }}{{ d }}{% endwith %}{{ a }}{{ d is defined }}", "320false", ""},
+		{"{% with {c: 1} %}{% for i = 0; i < 2; i++ %}{% set c += i %}{% endfor %}{{ c }}{% endwith %}{{ c is defined }}", "2false", ""},
+		{"{% with {c: 1} only %}{% set b = 2 %}{% endwith %}{{ b }}", "b", ""},
+		{"{% with b %}{% endwith %}", "", "walkWith: variables of with must be a hash, got string"},
+	}
+	for _, cfg := range []Config{{}, {Bytecode: true}, {Optimize: true}} {
+		for _, c := range cases {
+			ts := NewTemplates(&cfg)
+			ts.AddGlobal("g", "g")
+			w := &strings.Builder{}
+			e := ts.RenderString(w, c.code, data)
+			got := ""
+			var re *RuntimeError
+			if errors.As(e, &re) {
+				got = re.Err.Error()
+			} else if e != nil {
+				got = e.Error()
+			}
+			if w.String() != c.want || got != c.err {
+				t.Errorf("%q (bytecode %v, optimize %v):\ngot  %q, %q\nwant %q, %q", c.code, cfg.Bytecode, cfg.Optimize, w.String(), got, c.want, c.err)
+			}
+		}
+	}
+}
@@ -0,0 +1,877 @@
+package template
+
+import (
+	"fmt"
+	"go/format"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A Generator generates the Go source of a package rendering templates,
+// with one function per template, e.g. RenderIndex(w io.Writer,
+// p *IndexParams) error for index.html. The includes and the extended
+// templates are resolved when the code is generated, so the templates are
+// not parsed at runtime, and the variables read by a template are the
+// fields of its params.
+//
+// The params declared by a params tag are fields of their type, which is
+// resolved in the generated package, and their default value replaces the
+// zero value of the field. Without a params tag, the fields are of type any.
+// The properties of a param of a named type, or a pointer to one, are read
+// as Go selectors checked by the compiler, as long as the template does not
+// assign the param nor give it a default value: they are its fields, and its
+// methods are called with parentheses, e.g. {{ user.FullName() }}.
+//
+// The generated code imports the template package only for what is known
+// at runtime: properties, operators, calls, tests and ranges. Globals are
+// passed as params. The sandbox tag, and the with tags taking their
+// variables from an expression, are not supported.
+type Generator struct {
+	Package string   // name of the package
+	Root    string   // directory the paths of the templates are relative to
+	Config  *Config  // configuration of the lexer; or nil
+	Imports []string // packages of the qualified types of the params
+}
+
+// Generate returns the formatted source of the package rendering the
+// templates of names, relative to the root of g.
+func (g *Generator) Generate(names []string) ([]byte, error) {
+	cfg := g.Config
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	ts := NewTemplates(cfg)
+	imports := map[string]bool{"fmt": true, "io": true}
+	funcs := map[string]string{}
+	var code strings.Builder
+	for _, name := range names {
+		fn := exportedName(strings.TrimSuffix(name, filepath.Ext(name)))
+		if other, ok := funcs[fn]; ok {
+			return nil, err("gen: %s and %s both render as Render%s", other, name, fn)
+		}
+		funcs[fn] = name
+		f := &genFunc{g: g, ts: ts, imports: imports}
+		// The first pass finds the params, so that the second one resolves
+		// the variables assigned before they are read as params.
+		if _, e := f.generate(name); e != nil {
+			return nil, e
+		}
+		body, e := f.generate(name)
+		if e != nil {
+			return nil, e
+		}
+		fields := map[string]string{}
+		for _, p := range f.paramNames() {
+			if other, ok := fields[exportedName(p)]; ok {
+				return nil, err("gen: %s: variables %s and %s are both the param %s", name, other, p, exportedName(p))
+			}
+			fields[exportedName(p)] = p
+			if e := g.importTypes(f.types[p], imports); e != nil {
+				return nil, err("gen: %s: param %s: %s", name, p, e)
+			}
+		}
+		f.declare(&code, fn, name, body)
+	}
+
+	var src strings.Builder
+	fmt.Fprintf(&src, "// Code generated by gotpl gen. DO NOT EDIT.\n\npackage %s\n\nimport (\n", g.Package)
+	var paths []string
+	for path := range imports {
+		if path != templatePackage {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(&src, "%q\n", path)
+	}
+	if imports[templatePackage] {
+		fmt.Fprintf(&src, "\n%q\n", templatePackage)
+	}
+	src.WriteString(")\n")
+	src.WriteString(code.String())
+	src.WriteString(genWriter)
+	out, e := format.Source([]byte(src.String()))
+	if e != nil {
+		return nil, err("gen: %s", e)
+	}
+	return out, nil
+}
+
+const templatePackage = "fbnoi.com/gotpl/template"
+
+// importTypes adds the packages of the qualified types of typ to imports.
+func (g *Generator) importTypes(typ string, imports map[string]bool) error {
+	for _, word := range strings.FieldsFunc(typ, func(r rune) bool {
+		return r == '*' || r == '[' || r == ']'
+	}) {
+		i := strings.LastIndex(word, ".")
+		if i < 0 {
+			continue
+		}
+		found := false
+		for _, path := range g.Imports {
+			if found = pathpkg.Base(path) == word[:i]; found {
+				imports[path] = true
+				break
+			}
+		}
+		if !found {
+			return err("package %s of type %s is not imported", word[:i], typ)
+		}
+	}
+	return nil
+}
+
+// genWriter is the writer of the generated functions.
+const genWriter = `
+// gotplWriter writes the output of a template, and keeps the first error.
+type gotplWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (gw *gotplWriter) text(s string) {
+	if gw.err == nil {
+		_, gw.err = io.WriteString(gw.w, s)
+	}
+}
+
+func (gw *gotplWriter) print(v any) {
+	if gw.err != nil || v == nil {
+		return
+	}
+	if s, ok := v.(string); ok {
+		_, gw.err = io.WriteString(gw.w, s)
+		return
+	}
+	_, gw.err = fmt.Fprint(gw.w, v)
+}
+`
+
+// exportedName returns the Go exported name of the words of s, e.g.
+// AdminUserList for admin/user_list.
+func exportedName(s string) string {
+	var sb strings.Builder
+	for _, word := range strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		rs := []rune(word)
+		rs[0] = unicode.ToUpper(rs[0])
+		sb.WriteString(string(rs))
+	}
+	if sb.Len() == 0 || unicode.IsDigit(rune(sb.String()[0])) {
+		return "T" + sb.String()
+	}
+	return sb.String()
+}
+
+// A genFunc generates the function rendering a template.
+type genFunc struct {
+	g       *Generator
+	ts      *Templates
+	imports map[string]bool
+	params  map[string]bool   // variables read by the template
+	types   map[string]string // types of the params declared by params tags
+	changed map[string]bool   // params assigned by the template, or given a default
+	root    *genScope
+	temps   int
+	src     *Source  // source of the statement being generated
+	pos     Pos      // position of the statement being generated
+	stack   []string // templates being generated, the outermost first
+}
+
+// A genScope is a variable scope of a template, generated as a Go block
+// declaring the variables defined in the scope.
+type genScope struct {
+	parent   *genScope
+	vars     map[string]bool // variables defined in the scope
+	decls    strings.Builder // declarations of the variables
+	isolated bool            // assignments do not reach past the scope
+	only     bool            // the outer variables are not visible
+}
+
+func newGenScope(parent *genScope) *genScope {
+	return &genScope{parent: parent, vars: make(map[string]bool)}
+}
+
+// block returns the Go block of sc, with its declarations before code.
+func (sc *genScope) block(code string) string {
+	return "{\n" + sc.decls.String() + code + "}\n"
+}
+
+// generate returns the body of the function rendering the template name.
+func (f *genFunc) generate(name string) (string, error) {
+	if f.params == nil {
+		f.params, f.types, f.changed = map[string]bool{}, map[string]string{}, map[string]bool{}
+	}
+	f.root, f.temps = newGenScope(nil), 0
+	for _, p := range f.paramNames() {
+		f.root.vars[p] = true
+		if f.typed(p) {
+			fmt.Fprintf(&f.root.decls, "%s := p.%s\n_ = %[1]s\n", goVar(p), exportedName(p))
+		} else {
+			fmt.Fprintf(&f.root.decls, "var %s any = p.%s\n_ = %[1]s\n", goVar(p), exportedName(p))
+		}
+	}
+	var w strings.Builder
+	if e := f.template(name, f.root, &w); e != nil {
+		return "", e
+	}
+	return f.root.decls.String() + w.String(), nil
+}
+
+func (f *genFunc) paramNames() []string {
+	var names []string
+	for p := range f.params {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// declare writes the params and the function fn rendering the template
+// name with body.
+func (f *genFunc) declare(w *strings.Builder, fn, name, body string) {
+	fmt.Fprintf(w, "\n// %sParams holds the variables of %s.\ntype %[1]sParams struct {\n", fn, name)
+	for _, p := range f.paramNames() {
+		typ := f.types[p]
+		if typ == "" {
+			typ = "any"
+		}
+		fmt.Fprintf(w, "%s %s\n", exportedName(p), typ)
+	}
+	fmt.Fprintf(w, "}\n\n// Render%s renders %s to w.\n", fn, name)
+	fmt.Fprintf(w, "func Render%s(w io.Writer, p *%[1]sParams) error {\n", fn)
+	fmt.Fprintf(w, "if p == nil {\np = &%sParams{}\n}\ngw := &gotplWriter{w: w}\n", fn)
+	fmt.Fprintf(w, "%sreturn gw.err\n}\n", body)
+}
+
+// template generates the rendering of the template name in sc, following
+// the chain of extended templates.
+func (f *genFunc) template(name string, sc *genScope, w *strings.Builder) error {
+	for _, n := range f.stack {
+		if n == name {
+			return f.errorf("recursive include of %s", name)
+		}
+	}
+	f.stack = append(f.stack, name)
+	defer func() { f.stack = f.stack[:len(f.stack)-1] }()
+
+	blocks := map[string]*block{}
+	extended := map[string]bool{}
+	for {
+		if extended[name] {
+			return f.errorf("recursive extend of %s", name)
+		}
+		extended[name] = true
+		t, e := f.ts.load(filepath.Join(f.g.Root, name))
+		if e != nil {
+			return e
+		}
+		tr := t.tree()
+		if tr.Extend == nil {
+			src := f.src
+			f.src = t.Source
+			defer func() { f.src = src }()
+			for _, node := range tr.List {
+				if e := f.stmt(node, sc, blocks, w); e != nil {
+					return e
+				}
+			}
+			return nil
+		}
+		collectBlocks(tr.List, t.Source, nil, blocks)
+		name = unquote(tr.Extend.Ident.Value)
+	}
+}
+
+// errorf returns the error of the statement being generated.
+func (f *genFunc) errorf(format string, args ...any) error {
+	if f.src == nil {
+		return err("gen: "+format, args...)
+	}
+	return err("gen: %s:%d: %s", f.src.Identity, f.src.Position(f.pos).Line, fmt.Sprintf(format, args...))
+}
+
+// check writes the assignment of a call to tmp and err, and returns tmp
+// when err is nil.
+func (f *genFunc) check(w *strings.Builder, call string) string {
+	f.temps++
+	t := "t" + strconv.Itoa(f.temps)
+	fmt.Fprintf(w, "%s, err := %s\nif err != nil {\nreturn fmt.Errorf(%q, err)\n}\n", t, call, f.location()+": %w")
+	return t
+}
+
+// location returns the location of the statement being generated, as
+// reported by the errors of the generated code.
+func (f *genFunc) location() string {
+	return fmt.Sprintf("%s:%d", strings.ReplaceAll(f.src.Identity, "%", "%%"), f.src.Position(f.pos).Line)
+}
+
+// runtime returns the name of the function of the template package.
+func (f *genFunc) runtime(fn string) string {
+	f.imports[templatePackage] = true
+	return "template." + fn
+}
+
+func goVar(name string) string {
+	return "v_" + name
+}
+
+// lookup returns the Go variable of name visible from sc, false when it is
+// not defined, or is a global beyond a scope which only sees globals.
+func (f *genFunc) lookup(sc *genScope, name string) (string, bool) {
+	for c := sc; c != nil; c = c.parent {
+		if c.vars[name] {
+			return goVar(name), true
+		}
+		if c.only {
+			break
+		}
+	}
+	return "", false
+}
+
+// read returns the Go expression of the variable name read in sc. The
+// variables defined nowhere are params.
+func (f *genFunc) read(sc *genScope, name string) string {
+	if v, ok := f.lookup(sc, name); ok {
+		return v
+	}
+	f.params[name] = true
+	for c := sc; c != nil; c = c.parent {
+		if c.only {
+			return "p." + exportedName(name)
+		}
+	}
+	f.root.vars[name] = true
+	fmt.Fprintf(&f.root.decls, "var %s any = p.%s\n_ = %[1]s\n", goVar(name), exportedName(name))
+	return goVar(name)
+}
+
+// typed reports whether the variable of the param name has the type declared
+// by a params tag, which it keeps as long as the template does not change it.
+// The first pass of the generation finds the params changed.
+func (f *genFunc) typed(name string) bool {
+	return f.types[name] != "" && !f.changed[name]
+}
+
+// field returns the Go selector of the property name of the variable id read
+// in sc, checked by the compiler, when it is a typed param of a named type or
+// a pointer to one. It writes the check that a pointer is not nil, which
+// fails like Property.
+func (f *genFunc) field(id string, name string, sc *genScope, w *strings.Builder) (string, bool) {
+	if f.local(sc, id) || !f.typed(id) {
+		return "", false
+	}
+	typ := strings.TrimLeft(f.types[id], "*")
+	if !isName(typ) || basicTypes[typ] {
+		return "", false
+	}
+	v := f.read(sc, id)
+	if strings.HasPrefix(f.types[id], "*") {
+		fmt.Fprintf(w, "if %s == nil {\nreturn fmt.Errorf(\"%s: property: can't evaluate field %s of %%T\", %[1]s)\n}\n", v, f.location(), name)
+	}
+	return v + "." + name, true
+}
+
+// basicTypes are the predeclared types of Go, which have no fields.
+var basicTypes = map[string]bool{
+	"any": true, "bool": true, "byte": true, "complex64": true, "complex128": true, "error": true,
+	"float32": true, "float64": true, "int": true, "int8": true, "int16": true, "int32": true,
+	"int64": true, "rune": true, "string": true, "uint": true, "uint8": true, "uint16": true,
+	"uint32": true, "uint64": true, "uintptr": true,
+}
+
+// local reports whether the variable name is defined in sc or its parents
+// below the root scope, i.e. it is not read as a param.
+func (f *genFunc) local(sc *genScope, name string) bool {
+	for c := sc; c != nil && c != f.root; c = c.parent {
+		if c.vars[name] {
+			return true
+		}
+		if c.only {
+			break
+		}
+	}
+	return false
+}
+
+// define defines the variable name in sc, initialized to the outer one,
+// which it shadows, and returns its Go variable.
+func (f *genFunc) define(sc *genScope, name string) string {
+	v := goVar(name)
+	if sc.vars[name] {
+		return v
+	}
+	if outer, ok := f.lookup(sc.parent, name); ok && !sc.only {
+		fmt.Fprintf(&sc.decls, "var %s any = %s\n", v, outer)
+	} else {
+		fmt.Fprintf(&sc.decls, "var %s any\n", v)
+	}
+	fmt.Fprintf(&sc.decls, "_ = %s\n", v)
+	sc.vars[name] = true
+	return v
+}
+
+// set returns the Go variable assigned by the assignment of name in sc,
+// like Scope.Set.
+func (f *genFunc) set(sc *genScope, name string) string {
+	crossed := false
+	for c := sc; c != nil; c = c.parent {
+		if c.vars[name] {
+			if !crossed {
+				if c == f.root {
+					f.changed[name] = true
+				}
+				return goVar(name)
+			}
+			break
+		}
+		crossed = crossed || c.isolated
+		if c.only {
+			break
+		}
+	}
+	return f.define(sc, name)
+}
+
+func (f *genFunc) stmt(node ASTNode, sc *genScope, blocks map[string]*block, w *strings.Builder) error {
+	f.pos = node.Pos()
+	switch n := node.(type) {
+	case *TextStmt:
+		fmt.Fprintf(w, "gw.text(%q)\n", n.Text.(*BasicLit).Value)
+	case *RawStmt:
+		fmt.Fprintf(w, "gw.text(%q)\n", n.Text.(*BasicLit).Value)
+	case *ValueStmt:
+		x, e := f.expr(n.Tok, sc, w)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(w, "gw.print(%s)\n", x)
+	case *SectionStmt:
+		return f.section(n, sc, blocks, w)
+	case *SetStmt:
+		return f.assign(n.Assign, sc, w)
+	case *AssignStmt:
+		return f.assign(n, sc, w)
+	case *IfStmt:
+		c, e := f.expr(n.Cond, sc, w)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(w, "if %s(%s) {\n", f.runtime("Truth"), c)
+		if e := f.section(n.Body, sc, blocks, w); e != nil {
+			return e
+		}
+		if n.Else != nil {
+			w.WriteString("} else {\n")
+			if e := f.stmt(n.Else, sc, blocks, w); e != nil {
+				return e
+			}
+		}
+		w.WriteString("}\n")
+	case *ForStmt:
+		return f.forStmt(n, sc, blocks, w)
+	case *RangeStmt:
+		return f.rangeStmt(n, sc, blocks, w)
+	case *BlockStmt:
+		if b, ok := blocks[n.Name.Name]; ok {
+			// the overriding block is in the child template
+			src := f.src
+			f.src = b.src
+			defer func() { f.src = src }()
+			n = b.stmt
+		}
+		return f.section(n.Body, sc, blocks, w)
+	case *IncludeStmt:
+		inner := newGenScope(sc)
+		inner.isolated = true
+		var code strings.Builder
+		for _, as := range n.Params {
+			x, e := f.expr(as.Rh, sc, w)
+			if e != nil {
+				return e
+			}
+			fmt.Fprintf(&code, "%s = %s\n", f.define(inner, as.Lh.(*Ident).Name), x)
+		}
+		if e := f.template(unquote(n.Ident.Value), inner, &code); e != nil {
+			return e
+		}
+		w.WriteString(inner.block(code.String()))
+	case *WithStmt:
+		return f.withStmt(n, sc, blocks, w)
+	case *SpacelessStmt:
+		if isStaticSection(n.Body) {
+			return f.section(n.Body, sc, blocks, w)
+		}
+		f.imports["strings"] = true
+		w.WriteString("{\nbuf := &strings.Builder{}\nout := gw.w\ngw.w = buf\n")
+		if e := f.section(n.Body, sc, blocks, w); e != nil {
+			return e
+		}
+		fmt.Fprintf(w, "gw.w = out\ngw.text(%s(buf.String()))\n}\n", f.runtime("RemoveSpaces"))
+	case *SandboxStmt:
+		return f.errorf("the sandbox tag is not supported")
+	case *ParamsStmt:
+		return f.paramsStmt(n, sc, w)
+	case *ExtendStmt, *CommentStmt:
+	default:
+		return f.errorf("unexpected node %T", node)
+	}
+	return nil
+}
+
+func (f *genFunc) section(section *SectionStmt, sc *genScope, blocks map[string]*block, w *strings.Builder) error {
+	if section == nil {
+		return nil
+	}
+	for _, st := range section.List {
+		if e := f.stmt(st, sc, blocks, w); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (f *genFunc) assign(as *AssignStmt, sc *genScope, w *strings.Builder) error {
+	name := as.Lh.(*Ident).Name
+	switch as.Tok {
+	case "=":
+		x, e := f.expr(as.Rh, sc, w)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(w, "%s = %s\n", f.set(sc, name), x)
+	case "+=", "-=", "&=", "|=", "^=", "<<=", ">>=", "++", "--":
+		x := f.read(sc, name)
+		y := "int64(1)"
+		if as.Rh != nil {
+			var e error
+			if y, e = f.expr(as.Rh, sc, w); e != nil {
+				return e
+			}
+		}
+		t := f.check(w, fmt.Sprintf("%s(%q, %s, %s)", f.runtime("Binary"), assignOp(as.Tok), x, y))
+		fmt.Fprintf(w, "%s = %s\n", f.set(sc, name), t)
+	default:
+		return f.errorf("unexpected token %s", as.Tok)
+	}
+	return nil
+}
+
+// paramsStmt types the params declared by ps, and writes the assignment of
+// their default value to the ones holding the zero value.
+func (f *genFunc) paramsStmt(ps *ParamsStmt, sc *genScope, w *strings.Builder) error {
+	for _, p := range ps.List {
+		name := p.Name.Name
+		if !f.local(sc, name) {
+			if typ, ok := f.types[name]; ok && typ != p.Type {
+				return f.errorf("param %s is declared as %s and %s", name, typ, p.Type)
+			}
+			f.types[name] = p.Type
+			f.read(sc, name)
+		}
+		if p.Default == nil {
+			continue
+		}
+		f.changed[name] = true
+		x := f.read(sc, name)
+		v := f.define(sc, name)
+		if x != v {
+			fmt.Fprintf(w, "%s = %s\n", v, x)
+		}
+		fmt.Fprintf(w, "if %s(%s) {\n", f.runtime("IsZero"), v)
+		d, e := f.expr(p.Default, sc, w)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(w, "%s = %s\n}\n", v, d)
+	}
+	return nil
+}
+
+func (f *genFunc) forStmt(fs *ForStmt, sc *genScope, blocks map[string]*block, w *strings.Builder) error {
+	inner := newGenScope(sc)
+	var code strings.Builder
+	if as, ok := fs.Init.(*AssignStmt); ok && as.Tok == "=" {
+		x, e := f.expr(as.Rh, inner, &code)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(&code, "%s = %s\n", f.define(inner, as.Lh.(*Ident).Name), x)
+	} else if fs.Init != nil {
+		if e := f.stmt(fs.Init, inner, blocks, &code); e != nil {
+			return e
+		}
+	}
+	code.WriteString("for {\n")
+	if fs.Cond != nil {
+		f.pos = fs.Pos()
+		c, e := f.expr(fs.Cond, inner, &code)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(&code, "if !%s(%s) {\nbreak\n}\n", f.runtime("Truth"), c)
+	}
+	if e := f.section(fs.Body, inner, blocks, &code); e != nil {
+		return e
+	}
+	if fs.Post != nil {
+		if e := f.stmt(fs.Post, inner, blocks, &code); e != nil {
+			return e
+		}
+	}
+	code.WriteString("}\n")
+	w.WriteString(inner.block(code.String()))
+	return nil
+}
+
+func (f *genFunc) rangeStmt(rs *RangeStmt, sc *genScope, blocks map[string]*block, w *strings.Builder) error {
+	x, e := f.expr(rs.X, sc, w)
+	if e != nil {
+		return e
+	}
+	it := f.check(w, fmt.Sprintf("%s(%s)", f.runtime("Iterate"), x))
+	inner := newGenScope(sc)
+	var code strings.Builder
+	fmt.Fprintf(&code, "for %s.Next() {\n", it)
+	if rs.Key != nil {
+		fmt.Fprintf(&code, "%s = %s.Key()\n", f.define(inner, rs.Key.(*Ident).Name), it)
+	}
+	if rs.Value != nil {
+		fmt.Fprintf(&code, "%s = %s.Value()\n", f.define(inner, rs.Value.(*Ident).Name), it)
+	}
+	if e := f.section(rs.Body, inner, blocks, &code); e != nil {
+		return e
+	}
+	code.WriteString("}\n")
+	w.WriteString(inner.block(code.String()))
+	return nil
+}
+
+func (f *genFunc) withStmt(ws *WithStmt, sc *genScope, blocks map[string]*block, w *strings.Builder) error {
+	if ws.X != nil {
+		return f.errorf("the variables of with must be a hash literal")
+	}
+	inner := newGenScope(sc)
+	inner.isolated = true
+	inner.only = ws.Only
+	var code strings.Builder
+	for _, as := range ws.Params {
+		x, e := f.expr(as.Rh, sc, w)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(&code, "%s = %s\n", f.define(inner, as.Lh.(*Ident).Name), x)
+	}
+	if e := f.section(ws.Body, inner, blocks, &code); e != nil {
+		return e
+	}
+	w.WriteString(inner.block(code.String()))
+	return nil
+}
+
+// expr writes the evaluation of x in sc, and returns the Go expression of
+// its value.
+func (f *genFunc) expr(x Expr, sc *genScope, w *strings.Builder) (string, error) {
+	switch x := x.(type) {
+	case *BasicLit:
+		v, e := literal(x)
+		if e != nil {
+			return "", f.errorf("%s", e)
+		}
+		switch v := v.(type) {
+		case int64:
+			return fmt.Sprintf("int64(%d)", v), nil
+		case float64:
+			return fmt.Sprintf("float64(%s)", strconv.FormatFloat(v, 'g', -1, 64)), nil
+		}
+		return strconv.Quote(v.(string)), nil
+	case *Ident:
+		parts := strings.Split(x.Name, ".")
+		v := f.read(sc, parts[0])
+		for i, p := range parts[1:] {
+			if i == 0 {
+				if field, ok := f.field(parts[0], p, sc, w); ok {
+					v = field
+					continue
+				}
+			}
+			v = f.check(w, fmt.Sprintf("%s(%s, %q)", f.runtime("Property"), v, p))
+		}
+		return v, nil
+	case *IndexExpr:
+		v, e := f.expr(x.X, sc, w)
+		if e != nil {
+			return "", e
+		}
+		idx, e := f.expr(x.Index, sc, w)
+		if e != nil {
+			return "", e
+		}
+		return f.check(w, fmt.Sprintf("%s(%s, %s)", f.runtime("Index"), v, idx)), nil
+	case *SelectorExpr:
+		if id, ok := x.X.(*Ident); ok && !strings.Contains(id.Name, ".") {
+			if field, ok := f.field(id.Name, x.Sel.Name, sc, w); ok {
+				return field, nil
+			}
+		}
+		v, e := f.expr(x.X, sc, w)
+		if e != nil {
+			return "", e
+		}
+		return f.check(w, fmt.Sprintf("%s(%s, %q)", f.runtime("Property"), v, x.Sel.Name)), nil
+	case *CallExpr:
+		var fn string
+		if sel, ok := x.Fun.(*SelectorExpr); ok {
+			recv, e := f.expr(sel.X, sc, w)
+			if e != nil {
+				return "", e
+			}
+			fn = fmt.Sprintf("%s(%s, %q", f.runtime("CallMethod"), recv, sel.Sel.Name)
+		} else if name := x.Fun.(*Ident).Name; strings.Contains(name, ".") {
+			i := strings.LastIndex(name, ".")
+			recv, e := f.expr(&Ident{NamePos: x.Pos(), Name: name[:i]}, sc, w)
+			if e != nil {
+				return "", e
+			}
+			fn = fmt.Sprintf("%s(%s, %q", f.runtime("CallMethod"), recv, name[i+1:])
+		} else {
+			fn = fmt.Sprintf("%s(%q, %s", f.runtime("Call"), name, f.read(sc, name))
+		}
+		if x.Args != nil {
+			for _, arg := range x.Args.List {
+				a, e := f.expr(arg, sc, w)
+				if e != nil {
+					return "", e
+				}
+				fn += ", " + a
+			}
+		}
+		return f.check(w, fn+")"), nil
+	case *UnaryExpr:
+		v, e := f.expr(x.X, sc, w)
+		if e != nil {
+			return "", e
+		}
+		return f.check(w, fmt.Sprintf("%s(%q, %s)", f.runtime("Unary"), x.Op.Op, v)), nil
+	case *BinaryExpr:
+		v, e := f.expr(x.X, sc, w)
+		if e != nil {
+			return "", e
+		}
+		switch x.Op.Op {
+		case "&&", "and", "||", "or":
+			f.temps++
+			t := "t" + strconv.Itoa(f.temps)
+			fmt.Fprintf(w, "%s := %s(%s)\n", t, f.runtime("Truth"), v)
+			if x.Op.Op == "&&" || x.Op.Op == "and" {
+				fmt.Fprintf(w, "if %s {\n", t)
+			} else {
+				fmt.Fprintf(w, "if !%s {\n", t)
+			}
+			var y string
+			if y, e = f.expr(x.Y, sc, w); e != nil {
+				return "", e
+			}
+			fmt.Fprintf(w, "%s = %s(%s)\n}\n", t, f.runtime("Truth"), y)
+			return t, nil
+		}
+		y, e := f.expr(x.Y, sc, w)
+		if e != nil {
+			return "", e
+		}
+		return f.check(w, fmt.Sprintf("%s(%q, %s, %s)", f.runtime("Binary"), x.Op.Op, v, y)), nil
+	case *TestExpr:
+		var t string
+		if x.Name.Name == "defined" {
+			if x.Args != nil {
+				return "", f.errorf("test defined takes no arguments")
+			}
+			var e error
+			if t, e = f.defined(x.X, sc, w); e != nil {
+				return "", e
+			}
+		} else {
+			v, e := f.expr(x.X, sc, w)
+			if e != nil {
+				return "", e
+			}
+			test := fmt.Sprintf("%s(%q, %s", f.runtime("ApplyTest"), x.Name.Name, v)
+			if x.Args != nil {
+				for _, arg := range x.Args.List {
+					a, e := f.expr(arg, sc, w)
+					if e != nil {
+						return "", e
+					}
+					test += ", " + a
+				}
+			}
+			t = f.check(w, test+")")
+		}
+		if x.Not {
+			f.temps++
+			fmt.Fprintf(w, "t%d := !%s\n", f.temps, t)
+			t = "t" + strconv.Itoa(f.temps)
+		}
+		return t, nil
+	}
+	return "", f.errorf("unexpected expression %T", x)
+}
+
+// defined writes the code of the test defined of x, and returns its result.
+// A param is defined when it is not nil. The properties and the elements are
+// evaluated in a function whose errors make them not defined.
+func (f *genFunc) defined(x Expr, sc *genScope, w *strings.Builder) (string, error) {
+	f.temps++
+	t := "t" + strconv.Itoa(f.temps)
+	var parent Expr
+	switch x := x.(type) {
+	case *Ident:
+		i := strings.LastIndexByte(x.Name, '.')
+		if i < 0 {
+			if _, ok := f.lookup(sc, x.Name); ok && !f.params[x.Name] {
+				return "true", nil
+			}
+			fmt.Fprintf(w, "%s := any(%s) != nil\n", t, f.read(sc, x.Name))
+			return t, nil
+		}
+		parent = &Ident{NamePos: x.NamePos, Name: x.Name[:i]}
+	case *SelectorExpr:
+		parent = x.X
+	case *IndexExpr:
+		parent = x.X
+	default:
+		v, e := f.expr(x, sc, w)
+		if e != nil {
+			return "", e
+		}
+		fmt.Fprintf(w, "_ = %s\n", v)
+		return "true", nil
+	}
+	fmt.Fprintf(w, "%s := false\n_ = func() error {\n", t)
+	v, e := f.expr(parent, sc, w)
+	if e != nil {
+		return "", e
+	}
+	switch x := x.(type) {
+	case *Ident:
+		fmt.Fprintf(w, "%s = %s(%s, %q)\n", t, f.runtime("HasProperty"), v, x.Name[strings.LastIndexByte(x.Name, '.')+1:])
+	case *SelectorExpr:
+		fmt.Fprintf(w, "%s = %s(%s, %q)\n", t, f.runtime("HasProperty"), v, x.Sel.Name)
+	case *IndexExpr:
+		idx, e := f.expr(x.Index, sc, w)
+		if e != nil {
+			return "", e
+		}
+		fmt.Fprintf(w, "%s = %s(%s, %s)\n", t, f.runtime("HasIndex"), v, idx)
+	}
+	fmt.Fprintf(w, "return nil\n}()\n")
+	return t, nil
+}
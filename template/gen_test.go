@@ -0,0 +1,122 @@
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// genMain is the program printing the outputs of the generated functions,
+// as a JSON object, for the data of the corpus.
+const genMain = `package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+
+	"gentest/gen"
+)
+
+type user struct{ Name string }
+
+func (u *user) Hello(s string) string { return "hello " + s + " " + u.Name }
+
+// fill sets the fields of the params p to the data of the same name.
+func fill(p any) any {
+	v := reflect.ValueOf(p).Elem()
+	data := map[string]any{
+		"user":  &user{"bob"},
+		"list":  []string{"x", "y"},
+		"m":     map[string]int{"b": 2, "a": 1, "c": 3},
+		"add":   func(a, b int) int { return a + b },
+		"title": "T",
+	}
+	for name, x := range data {
+		if f := v.FieldByName(strings.ToUpper(name[:1]) + name[1:]); f.IsValid() {
+			f.Set(reflect.ValueOf(x))
+		}
+	}
+	return p
+}
+
+func main() {
+	out := map[string]string{}
+	var w strings.Builder
+	%s
+	json.NewEncoder(os.Stdout).Encode(out)
+}
+`
+
+// TestGenerate checks that the code generated for the corpus compiles, and
+// renders it like the tree walker.
+func TestGenerate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a program")
+	}
+	goTool, e := exec.LookPath("go")
+	if e != nil {
+		t.Skip("no go tool")
+	}
+	root, e := filepath.Abs("..")
+	if e != nil {
+		t.Fatal(e)
+	}
+	src, e := (&Generator{Package: "gen", Root: "."}).Generate(corpus)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var calls strings.Builder
+	for _, path := range corpus {
+		fn := exportedName(strings.TrimSuffix(path, filepath.Ext(path)))
+		fmt.Fprintf(&calls, `
+	w.Reset()
+	if e := gen.Render%[1]s(&w, fill(&gen.%[1]sParams{}).(*gen.%[1]sParams)); e != nil {
+		w.WriteString("\nerror: " + e.Error())
+	}
+	out[%[2]q] = w.String()`, fn, path)
+	}
+	sum, e := os.ReadFile(filepath.Join(root, "go.sum"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": fmt.Sprintf("module gentest\n\ngo 1.18\n\n"+
+			"require (\n\tfbnoi.com/gotpl v0.0.0\n\tgithub.com/pkg/errors v0.9.1\n)\n\n"+
+			"replace fbnoi.com/gotpl => %s\n", root),
+		"go.sum":     string(sum),
+		"gen/gen.go": string(src),
+		"main.go":    fmt.Sprintf(genMain, calls.String()),
+	}
+	for name, code := range files {
+		path := filepath.Join(dir, name)
+		if e := os.MkdirAll(filepath.Dir(path), 0o755); e != nil {
+			t.Fatal(e)
+		}
+		if e := os.WriteFile(path, []byte(code), 0o644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	cmd := exec.Command(goTool, "run", ".")
+	cmd.Dir = dir
+	cmd.Stderr = &strings.Builder{}
+	stdout, e := cmd.Output()
+	if e != nil {
+		t.Fatalf("go run: %v\n%s", e, cmd.Stderr)
+	}
+	var got map[string]string
+	if e := json.Unmarshal(stdout, &got); e != nil {
+		t.Fatal(e)
+	}
+	for _, path := range corpus {
+		if want := corpusRender(Config{}, path, ""); got[path] != want {
+			t.Errorf("%s:\ngot  %q\nwant %q", path, got[path], want)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package template
 
 import (
 	"fmt"
-	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
@@ -11,272 +13,635 @@ var (
 	TAG_VARIABLE = [...]string{`{{`, `}}`}
 )
 
+// Whitespace control modifiers, written next to the delimiters of a tag, e.g. {%- and -%}.
+const (
+	MODIFIER_TRIM      = '-' // strip all whitespace
+	MODIFIER_TRIM_LINE = '~' // strip spaces and tabs but keep newlines
+)
+
 var (
 	operator = [...]string{
-		"+", "-", "*", "%", "/",
+		"+", "-", "*", "%", "/", "=", ":", "!",
 		"+=", "-=", "++", "--",
-		">", "<", ">=", "<=", "&&", "^", "||",
-		">>", "<<", "&", "|", ">>=", "<<=", "&=", "|=",
-		"or", "and", "is",
+		"==", "!=", ">", "<", ">=", "<=", "&&", "^", "||",
+		">>", "<<", "&", ">>=", "<<=", "&=", "|=", "^=",
+		"or", "and", "not", "is", "b-and", "b-or", "b-xor",
 	}
 )
 
-var (
-	// }}
-	reg_variable = regexp.MustCompile(fmt.Sprintf(`\s*%s`, TAG_VARIABLE[1]))
-	// %}
-	reg_block = regexp.MustCompile(fmt.Sprintf(`\s*%s`, TAG_BLOCK[1]))
-	// {% Endverbatim %}
-	reg_raw_data = regexp.MustCompile(fmt.Sprintf(`%s\s*Endverbatim\s*%s`, TAG_BLOCK[0], TAG_BLOCK[1]))
-	// #}
-	reg_comment = regexp.MustCompile(fmt.Sprintf(`\s*%s`, TAG_COMMENT[1]))
-	// verbatim %}
-	reg_block_raw = regexp.MustCompile(fmt.Sprintf(`\s*verbatim\s*%s`, TAG_BLOCK[1]))
-	// {{ or {% or {#
-	reg_token_start = regexp.MustCompile(fmt.Sprintf(`(@?%s|@?%s|@?%s)`, TAG_VARIABLE[0], TAG_BLOCK[0], TAG_COMMENT[0]))
-	// \r\n \n
-	reg_enter = regexp.MustCompile(`(\r\n|\n)`)
-	// whitespace
-	reg_whitespace = regexp.MustCompile(`^\s+`)
-	// +-*/%&^|><=
-	reg_operator = regexp.MustCompile(`[\+\-\&*\/%\^><=:]{1,3}|(and)|(or)`)
-	// name
-	reg_name = regexp.MustCompile(`[a-zA-Z_\x7f-\xff][a-zA-Z0-9_\x7f-\xff]*(\.[a-zA-Z_\x7f-\xff][a-zA-Z0-9_\x7f-\xff]*)*`)
-	// number
-	reg_number = regexp.MustCompile(`[0-9]+(?:\.[0-9]+)?([Ee][\+\-][0-9]+)?`)
-	// punctuation
-	reg_punctuation   = regexp.MustCompile(`[\(\)\[\]\{\}\?\:;,\|]`)
-	reg_bracket_open  = regexp.MustCompile(`[\{\[\(]`)
-	reg_bracket_close = regexp.MustCompile(`[\}\]\)]`)
-	// string
-	reg_string = regexp.MustCompile(`"([^"\\\\]*(?:\\\\.[^"\\\\]*)*)"|'([^\'\\\\]*(?:\\\\.[^\'\\\\]*)*)'`)
-)
-
 type Bracket struct {
-	ch   string
-	Line int
+	ch     string
+	Line   int
+	offset int
 }
 
+// closingBrackets maps the opening brackets to their closing one.
+var closingBrackets = map[string]string{"{": "}", "(": ")", "[": "]"}
+
 func (b *Bracket) String() string {
 	return fmt.Sprintf("%s at line %d", b.ch, b.Line)
 }
 
 func NewLexer() *Lexer {
-	return &Lexer{}
+	return &Lexer{Config: &Config{}}
 }
 
 type Lexer struct {
-	Source *Source
-	Tokens []*Token
-	Code   string
-	Cursor int
-	Line   int
-	End    int
-	PosIdx int
-	Poss   [][]int
+	Config *Config
+	// Recover makes the lexer skip the tags it cannot split into tokens
+	// instead of stopping, the errors are collected in Diagnostics.
+	Recover     bool
+	Diagnostics Diagnostics
+	// KeepComments makes the lexer push comments as tokens instead of
+	// discarding them.
+	KeepComments bool
+	Source       *Source
+	Tokens       []*Token
+	Code         string
+	Cursor       int
+	Line         int
+	End          int
+	tag          [2]int // offsets of the opening delimiter of the current tag
+	trim         rune   // whitespace to strip from the start of the next text
 }
 
+// Tokenize splits the code of src into tokens. The line endings of src are
+// normalized to "\n" first, in a copy of src which is the source of the
+// stream, so that positions refer to the normalized code.
 func (lex *Lexer) Tokenize(src *Source) (*TokenStream, error) {
-	lex.Source = src
-	lex.Code = reg_enter.ReplaceAllString(src.Code, "\n")
+	lex.Code = strings.ReplaceAll(src.Code, "\r\n", "\n")
+	lex.Source = &Source{Identity: src.Identity, Code: lex.Code, lines: lineStarts(lex.Code)}
 	lex.Cursor = 0
 	lex.Line = 1
 	lex.End = len(lex.Code)
-	lex.PosIdx = -1
-	lex.Poss = reg_token_start.FindAllStringIndex(lex.Code, -1)
-	if len(lex.Poss) == 0 {
-		lex.pushToken(TYPE_TEXT, lex.Code[lex.Cursor:])
-		lex.Cursor = lex.End
-	}
 
-	for lex.PosIdx < len(lex.Poss)-1 {
-		lex.PosIdx++
+	for {
+		start, end := lex.nextTag(lex.Cursor)
+		if start < 0 {
+			break
+		}
+		lex.tag = [2]int{start, end}
 		if err := lex.lexNextPart(); err != nil {
-			return nil, err
+			if !lex.Recover {
+				return nil, err
+			}
+			lex.skipTag(err)
 		}
 	}
 	if lex.Cursor < lex.End {
-		lex.pushToken(TYPE_TEXT, lex.Code[lex.Cursor:lex.End])
+		lex.pushToken(TYPE_TEXT, lex.Code[lex.Cursor:lex.End], lex.Cursor)
+	}
+	lex.pushToken(TYPE_EOF, "", lex.End)
+	return &TokenStream{Source: lex.Source, tokens: lex.Tokens}, nil
+}
+
+// skipTag drops the tokens of the tag which could not be lexed because of
+// e, and moves the cursor after its closing delimiter.
+func (lex *Lexer) skipTag(e error) {
+	pos := lex.tag
+	lex.Diagnostics = append(lex.Diagnostics, newDiagnostic(lex.Source, e, Pos(lex.Cursor+1)))
+	for n := len(lex.Tokens); n > 0 && lex.Tokens[n-1].offset >= pos[0]; n-- {
+		lex.Tokens = lex.Tokens[:n-1]
+	}
+	lex.trim = 0
+	if _, end := lex.closing(pos[1], closingTag(lex.Code[pos[1]-2:pos[1]])); end >= 0 {
+		lex.moveCursor(end)
+	} else {
+		lex.moveCursor(lex.End)
+	}
+}
+
+// nextTag returns the offsets of the first opening delimiter found from
+// offset from, which is escaped when preceded by an @, or -1.
+func (lex *Lexer) nextTag(from int) (int, int) {
+	for i := from; ; i++ {
+		j := strings.IndexByte(lex.Code[i:], '{')
+		if j < 0 {
+			return -1, -1
+		}
+		i += j
+		if i+1 < lex.End && strings.IndexByte("{%#", lex.Code[i+1]) >= 0 {
+			if i > from && lex.Code[i-1] == '@' {
+				return i - 1, i + 2
+			}
+			return i, i + 2
+		}
+	}
+}
+
+// closingTag returns the closing delimiter of the opening delimiter tag.
+func closingTag(tag string) string {
+	switch tag {
+	case TAG_VARIABLE[0]:
+		return TAG_VARIABLE[1]
+	case TAG_COMMENT[0]:
+		return TAG_COMMENT[1]
+	}
+	return TAG_BLOCK[1]
+}
+
+// closing returns the offsets of the first closing delimiter tag found from
+// offset from, along with its modifier and the whitespace preceding it, or
+// -1.
+func (lex *Lexer) closing(from int, tag string) (int, int) {
+	i := strings.Index(lex.Code[from:], tag)
+	if i < 0 {
+		return -1, -1
 	}
-	lex.pushToken(TYPE_EOF, "")
-	return &TokenStream{tokens: lex.Tokens}, nil
+	start := from + i
+	if start > from && isModifier(lex.Code[start-1]) {
+		start--
+	}
+	for start > from && isSpace(lex.Code[start-1]) {
+		start--
+	}
+	return start, from + i + len(tag)
 }
 
 func (lex *Lexer) lexNextPart() error {
-	pos := lex.Poss[lex.PosIdx]
-	if pos[0] < lex.Cursor {
-		return nil
-	} else if pos[0] > lex.Cursor {
-		lex.pushToken(TYPE_TEXT, lex.Code[lex.Cursor:pos[0]])
+	pos := lex.tag
+	if pos[0] > lex.Cursor {
+		lex.pushToken(TYPE_TEXT, lex.Code[lex.Cursor:pos[0]], lex.Cursor)
 	}
 	lex.moveCursor(pos[1])
+	if pos[1]-pos[0] == 2 {
+		lex.lexStartModifier(lex.Code[pos[0]:pos[1]])
+	}
 	switch pos[1] - pos[0] {
 	case 3:
-		var reg *regexp.Regexp
-		switch lex.Code[pos[0]+1 : pos[1]] {
-		case TAG_COMMENT[0]:
-			reg = reg_comment
-		case TAG_BLOCK[0]:
-			reg = reg_block
-		case TAG_VARIABLE[0]:
-			reg = reg_variable
-		}
-		if subp, ok := startWith(reg, lex.Code, lex.Cursor); ok {
-			lex.pushToken(TYPE_TEXT, lex.Code[pos[0]+1:subp[1]])
-			lex.moveCursor(subp[1])
+		// an escaped tag is output as it is, up to its closing delimiter
+		// when nothing but whitespace is in between
+		if start, end := lex.closing(lex.Cursor, closingTag(lex.Code[pos[0]+1:pos[1]])); start == lex.Cursor {
+			lex.pushToken(TYPE_TEXT, lex.Code[pos[0]+1:end], pos[0]+1)
+			lex.moveCursor(end)
 			return nil
 		}
-		return NewUnexpectedToken(lex.Source, lex.Line, lex.Code[pos[0]:pos[1]])
+		return lex.unexpected(pos[0], lex.Code[pos[0]:pos[1]], "")
 	case 2:
 		switch lex.Code[pos[0]:pos[1]] {
 		case TAG_COMMENT[0]:
 			return lex.lexComment()
 		case TAG_BLOCK[0]:
-			if subp, ok := startWith(reg_block_raw, lex.Code, lex.Cursor); ok {
-				lex.moveCursor(subp[1])
-				if subp = findStringIndex(reg_raw_data, lex.Code, lex.Cursor); len(subp) > 0 {
-					lex.pushToken(TYPE_STRING, lex.Code[lex.Cursor:subp[0]])
-					lex.moveCursor(subp[1])
-					return nil
-				}
-				return NewUnexpectedToken(lex.Source, lex.Line, lex.Code[pos[0]:pos[1]])
+			if id, name, start := lex.rawTag(); id != "" {
+				return lex.lexRaw(pos[0], id, name, start)
 			} else {
-				lex.pushToken(TYPE_BLOCK_START, "")
-				if err := lex.LexRegData(reg_block); err != nil {
+				lex.pushToken(TYPE_BLOCK_START, lex.Code[pos[0]:lex.Cursor], pos[0])
+				if err := lex.lexData(TAG_BLOCK[1]); err != nil {
 					return err
 				}
-				lex.pushToken(TYPE_BLOCK_END, "")
+				lex.pushClosingTag(TYPE_BLOCK_END, TAG_BLOCK[1])
+				lex.lexEndModifier(true)
 				return nil
 			}
 		case TAG_VARIABLE[0]:
-			lex.pushToken(TYPE_VAR_START, "")
-			if err := lex.LexRegData(reg_variable); err != nil {
+			lex.pushToken(TYPE_VAR_START, lex.Code[pos[0]:lex.Cursor], pos[0])
+			if err := lex.lexData(TAG_VARIABLE[1]); err != nil {
 				return err
 			}
-			lex.pushToken(TYPE_VAR_END, "")
+			lex.pushClosingTag(TYPE_VAR_END, TAG_VARIABLE[1])
+			lex.lexEndModifier(false)
 			return nil
 		}
 	}
 	return nil
 }
 
+// lexStartModifier consumes the modifier following the opening delimiter tag
+// and strips the whitespace at the end of the preceding text accordingly.
+func (lex *Lexer) lexStartModifier(tag string) {
+	if lex.Cursor < lex.End {
+		if m := rune(lex.Code[lex.Cursor]); m == MODIFIER_TRIM || m == MODIFIER_TRIM_LINE {
+			lex.moveCursor(lex.Cursor + 1)
+			lex.trimPrevious(m)
+			return
+		}
+	}
+	if tag != TAG_VARIABLE[0] && lex.Config.LstripBlocks {
+		lex.lstripPrevious()
+	}
+}
+
+// lexEndModifier records how to strip the text following the closing
+// delimiter just consumed.
+func (lex *Lexer) lexEndModifier(block bool) {
+	if i := lex.Cursor - 3; i >= 0 {
+		if m := rune(lex.Code[i]); m == MODIFIER_TRIM || m == MODIFIER_TRIM_LINE {
+			lex.trim = m
+			return
+		}
+	}
+	if block && lex.Config.TrimBlocks {
+		lex.trim = '\n'
+	}
+}
+
+// trimPrevious strips the whitespace at the end of the preceding text token.
+func (lex *Lexer) trimPrevious(m rune) {
+	if n := len(lex.Tokens); n > 0 && lex.Tokens[n-1].typ == TYPE_TEXT {
+		t := lex.Tokens[n-1]
+		if t.value = strings.TrimRightFunc(t.value, trimFunc(m)); t.value == "" {
+			lex.Tokens = lex.Tokens[:n-1]
+		}
+	}
+}
+
+// lstripPrevious strips the spaces and tabs between the start of the line
+// and a tag when nothing else precedes the tag on that line.
+func (lex *Lexer) lstripPrevious() {
+	n := len(lex.Tokens)
+	if n == 0 || lex.Tokens[n-1].typ != TYPE_TEXT {
+		return
+	}
+	t := lex.Tokens[n-1]
+	i := strings.LastIndexByte(t.value, '\n')
+	// a text without newline must start a line, e.g. after the newline
+	// stripped by TrimBlocks
+	if i < 0 && t.offset > 0 && lex.Code[t.offset-1] != '\n' {
+		return
+	}
+	if strings.TrimFunc(t.value[i+1:], trimFunc(MODIFIER_TRIM_LINE)) == "" {
+		lex.trimPrevious(MODIFIER_TRIM_LINE)
+	}
+}
+
+func trimFunc(m rune) func(rune) bool {
+	if m == MODIFIER_TRIM_LINE {
+		return func(r rune) bool {
+			return r == ' ' || r == '\t'
+		}
+	}
+	return unicode.IsSpace
+}
+
+// rawTag returns the name of the verbatim or raw tag whose opening
+// delimiter precedes the cursor, along with the offset of its name and the
+// offset of its end, or "" when the tag is none of them.
+func (lex *Lexer) rawTag() (string, int, int) {
+	i := lex.skipSpaces(lex.Cursor)
+	for _, id := range [...]string{"verbatim", "raw"} {
+		if strings.HasPrefix(lex.Code[i:], id) {
+			if end := lex.tagEnd(i + len(id)); end >= 0 {
+				return id, i, end
+			}
+		}
+	}
+	return "", 0, 0
+}
+
+// rawEnd returns the offsets of the first tag ending the verbatim or raw
+// block id found from the cursor, along with the offset of its name, or -1.
+func (lex *Lexer) rawEnd(id string) (int, int, int) {
+	for i := lex.Cursor; ; i++ {
+		j := strings.Index(lex.Code[i:], TAG_BLOCK[0])
+		if j < 0 {
+			return -1, -1, -1
+		}
+		i += j
+		name := i + len(TAG_BLOCK[0])
+		if name < lex.End && isModifier(lex.Code[name]) {
+			name++
+		}
+		name = lex.skipSpaces(name)
+		if strings.HasPrefix(lex.Code[name:], "end"+id) {
+			if end := lex.tagEnd(name + len("end"+id)); end >= 0 {
+				return i, name, end
+			}
+		}
+	}
+}
+
+// tagEnd returns the offset of the end of the closing delimiter of a block
+// tag, preceded by whitespace and a modifier from offset i, or -1.
+func (lex *Lexer) tagEnd(i int) int {
+	i = lex.skipSpaces(i)
+	if i < lex.End && isModifier(lex.Code[i]) {
+		i++
+	}
+	if strings.HasPrefix(lex.Code[i:], TAG_BLOCK[1]) {
+		return i + len(TAG_BLOCK[1])
+	}
+	return -1
+}
+
+// lexRaw pushes the tags of a verbatim or raw block, whose opening
+// delimiter is at offset tag, and its content as it is. The name id of the
+// block is at offset name and its opening tag ends at offset start.
+func (lex *Lexer) lexRaw(tag int, id string, name, start int) error {
+	line := lex.Line
+	lex.pushToken(TYPE_BLOCK_START, lex.Code[tag:lex.Cursor], tag)
+	lex.pushToken(TYPE_NAME, id, name)
+	lex.moveCursor(start)
+	lex.pushClosingTag(TYPE_BLOCK_END, TAG_BLOCK[1])
+	lex.lexEndModifier(true)
+	endTag, endName, end := lex.rawEnd(id)
+	if endTag < 0 {
+		e := NewUnexpectedEndOfFile(lex.Source, line, "end"+id)
+		e.Pos = Pos(tag + 1)
+		return e
+	}
+	content := lex.Code[lex.Cursor:endTag]
+	open := endTag + len(TAG_BLOCK[0])
+	if m := rune(lex.Code[open]); m == MODIFIER_TRIM || m == MODIFIER_TRIM_LINE {
+		content = strings.TrimRightFunc(content, trimFunc(m))
+		open++
+	}
+	lex.pushToken(TYPE_RAW, content, lex.Cursor)
+	lex.moveCursor(end)
+	lex.pushToken(TYPE_BLOCK_START, lex.Code[endTag:open], endTag)
+	lex.pushToken(TYPE_NAME, "end"+id, endName)
+	lex.pushClosingTag(TYPE_BLOCK_END, TAG_BLOCK[1])
+	lex.lexEndModifier(true)
+	return nil
+}
+
 func (lex *Lexer) lexComment() error {
-	if p := findStringIndex(reg_comment, lex.Code, lex.Cursor); len(p) > 0 {
-		lex.moveCursor(p[1])
+	if _, end := lex.closing(lex.Cursor, TAG_COMMENT[1]); end >= 0 {
+		if lex.KeepComments {
+			start := strings.LastIndex(lex.Code[:lex.Cursor], TAG_COMMENT[0])
+			lex.pushToken(TYPE_COMMENT, lex.Code[start:end], start)
+		}
+		lex.moveCursor(end)
+		lex.lexEndModifier(true)
 		return nil
 	}
-	return NewParseTemplateFaild(lex.Source, lex.Line)
+	return lex.unclosed(fmt.Sprintf("%q", TAG_COMMENT[1]))
 }
 
-func (lex *Lexer) LexRegData(reg *regexp.Regexp) error {
-	if !reg.MatchString(lex.Code[lex.Cursor:]) {
-		return NewParseTemplateFaild(lex.Source, lex.Line)
+// lexData pushes the tokens of the expressions of the current tag, up to
+// its closing delimiter tag.
+func (lex *Lexer) lexData(tag string) error {
+	start, end := lex.closing(lex.Cursor, tag)
+	if start < 0 {
+		if tag == TAG_VARIABLE[1] {
+			return lex.unclosed(TypeToEnglish(TYPE_VAR_END))
+		}
+		return lex.unclosed(TypeToEnglish(TYPE_BLOCK_END))
 	}
-	lex.lexExpression(reg)
+	if err := lex.lexExpression(start); err != nil {
+		return err
+	}
+	lex.moveCursor(end)
 	return nil
 }
 
-func (lex *Lexer) lexExpression(reg *regexp.Regexp) error {
-	pos := findStringIndex(reg, lex.Code, lex.Cursor)
+// lexExpression pushes the tokens found from the cursor up to offset end.
+func (lex *Lexer) lexExpression(end int) error {
 	var brackets []*Bracket
 
-	for lex.Cursor < pos[0] {
-		// whitespace
-		if subp, ok := startWith(reg_whitespace, lex.Code[:pos[0]], lex.Cursor); ok {
-			lex.moveCursor(subp[1])
+	for lex.Cursor < end {
+		i := lex.Cursor
+		c := lex.Code[i]
+		switch {
+		case isSpace(c):
+			lex.moveCursor(lex.skipSpaces(i))
+			continue
 		}
-		// operator
-		if subp, ok := startWith(reg_operator, lex.Code[:pos[0]], lex.Cursor); ok {
-			lex.pushToken(TYPE_OPERATOR, lex.Code[lex.Cursor:subp[1]])
-			lex.moveCursor(subp[1])
-
-			// name
-		} else if subp, ok := startWith(reg_name, lex.Code[:pos[0]], lex.Cursor); ok {
-			lex.pushToken(TYPE_NAME, lex.Code[lex.Cursor:subp[1]])
-			lex.moveCursor(subp[1])
-
-			// number
-		} else if subp, ok := startWith(reg_number, lex.Code[:pos[0]], lex.Cursor); ok {
-			lex.pushToken(TYPE_NUMBER, lex.Code[lex.Cursor:subp[1]])
-			lex.moveCursor(subp[1])
-
-			// string
-		} else if subp, ok := startWith(reg_string, lex.Code[:pos[0]], lex.Cursor); ok {
-			lex.pushToken(TYPE_STRING, lex.Code[lex.Cursor:subp[1]])
-			lex.moveCursor(subp[1])
-
-			// punctuation
-		} else if _, ok := startWith(reg_punctuation, lex.Code[:pos[0]], lex.Cursor); ok {
-			var (
-				subp []int
-				ok   bool
-			)
-			// bracket open
-			if subp, ok = startWith(reg_bracket_open, lex.Code[:pos[0]], lex.Cursor); ok {
-				brackets = append(brackets, &Bracket{ch: lex.Code[subp[0]:subp[1]], Line: lex.Line})
-
-				// bracket close
-			} else if subp, ok = startWith(reg_bracket_close, lex.Code[:pos[0]], lex.Cursor); ok {
+
+		if n := scanOperator(lex.Code[:end], i); n > i {
+			lex.pushToken(TYPE_OPERATOR, lex.Code[i:n], i)
+			lex.moveCursor(n)
+		} else if n := scanWordOperator(lex.Code[:end], i); n > i {
+			// the word operators are not names
+			lex.pushToken(TYPE_OPERATOR, lex.Code[i:n], i)
+			lex.moveCursor(n)
+		} else if n := scanName(lex.Code[:end], i); n > i {
+			lex.pushToken(TYPE_NAME, lex.Code[i:n], i)
+			lex.moveCursor(n)
+		} else if n := scanNumber(lex.Code[:end], i); n > i {
+			lex.pushToken(TYPE_NUMBER, lex.Code[i:n], i)
+			lex.moveCursor(n)
+		} else if n := scanString(lex.Code[:end], i); n > i {
+			lex.pushToken(TYPE_STRING, lex.Code[i:n], i)
+			lex.moveCursor(n)
+		} else if strings.IndexByte(punctuationChars, c) >= 0 {
+			ch := lex.Code[i : i+1]
+			switch ch {
+			case "{", "[", "(":
+				brackets = append(brackets, &Bracket{ch: ch, Line: lex.Line, offset: i})
+			case "}", "]", ")":
 				if len(brackets) == 0 {
-					return NewParseTemplateFaild(lex.Source, lex.Line)
+					return lex.unexpected(i, ch, "")
 				}
-				b := brackets[len(brackets)-1]
-				switch {
-				case b.ch == "{" && lex.Code[subp[0]:subp[1]] != "}":
-					return NewParseTemplateFaild(lex.Source, lex.Line)
-				case b.ch == "(" && lex.Code[subp[0]:subp[1]] != "}":
-					return NewParseTemplateFaild(lex.Source, lex.Line)
-				case b.ch == "[" && lex.Code[subp[0]:subp[1]] != "}":
-					return NewParseTemplateFaild(lex.Source, lex.Line)
+				if b := brackets[len(brackets)-1]; ch != closingBrackets[b.ch] {
+					return lex.unexpected(i, ch, fmt.Sprintf("%q", closingBrackets[b.ch]))
 				}
 				brackets = brackets[:len(brackets)-1]
-			} else {
-				subp = findStringIndex(reg_punctuation, lex.Code[:pos[0]], lex.Cursor)
-			}
-			lex.pushToken(TYPE_PUNCTUATION, lex.Code[lex.Cursor:subp[1]])
-			if len(subp) > 0 {
-				lex.moveCursor(subp[1])
 			}
+			lex.pushToken(TYPE_PUNCTUATION, ch, i)
+			lex.moveCursor(i + 1)
 		} else {
 			// unkown token
-			return NewUnexpectedToken(lex.Source, brackets[0].Line, lex.Code[lex.Cursor:pos[0]])
+			tok := lex.Code[i:end]
+			if f := strings.Fields(tok); len(f) > 0 {
+				tok = f[0]
+			}
+			return lex.unexpected(i, tok, "")
 		}
 	}
 
 	if len(brackets) > 0 {
-		return NewUnexpectedToken(lex.Source, brackets[0].Line, brackets[0].ch)
+		b := brackets[len(brackets)-1]
+		return lex.unexpected(b.offset, b.ch, fmt.Sprintf("%q", closingBrackets[b.ch]))
 	}
-	lex.moveCursor(pos[1])
 	return nil
 }
 
-func (lex *Lexer) pushToken(typ int, value string) {
+// pushToken appends a token of value found at offset of the code.
+func (lex *Lexer) pushToken(typ int, value string, offset int) {
+	if typ == TYPE_TEXT || typ == TYPE_RAW {
+		n := len(value)
+		switch lex.trim {
+		case MODIFIER_TRIM, MODIFIER_TRIM_LINE:
+			value = strings.TrimLeftFunc(value, trimFunc(lex.trim))
+		case '\n':
+			value = strings.TrimPrefix(value, "\n")
+		}
+		offset += n - len(value)
+	}
+	if typ != TYPE_COMMENT {
+		// a comment is not output, the text following it is still trimmed
+		lex.trim = 0
+	}
 	if typ == TYPE_TEXT && value == "" {
 		return
 	}
-	lex.Tokens = append(lex.Tokens, &Token{typ: typ, value: value, line: lex.Line})
+	p := lex.Source.Position(Pos(offset + 1))
+	lex.Tokens = append(lex.Tokens, &Token{typ: typ, value: value, line: p.Line, col: p.Column, offset: offset})
+}
+
+// pushClosingTag pushes the closing delimiter tag, with its modifier, which
+// ends at the cursor.
+func (lex *Lexer) pushClosingTag(typ int, tag string) {
+	start := lex.Cursor - len(tag)
+	if m := rune(lex.Code[start-1]); m == MODIFIER_TRIM || m == MODIFIER_TRIM_LINE {
+		start--
+	}
+	lex.pushToken(typ, lex.Code[start:lex.Cursor], start)
+}
+
+// unexpected returns the error of the unexpected text tok found at offset,
+// where expected was expected instead.
+func (lex *Lexer) unexpected(offset int, tok, expected string) error {
+	e := NewUnexpectedToken(lex.Source, lex.Source.Position(Pos(offset+1)).Line, tok)
+	e.Pos = Pos(offset + 1)
+	e.Expected = expected
+	return e
+}
+
+// unclosed returns the error of the current tag, which is not closed by
+// the expected delimiter.
+func (lex *Lexer) unclosed(expected string) error {
+	start := lex.tag[0]
+	e := NewUnexpectedEndOfFile(lex.Source, lex.Source.Position(Pos(start+1)).Line, expected)
+	e.Pos = Pos(start + 1)
+	return e
 }
 
 func (lex *Lexer) moveCursor(n int) {
-	lex.Line += len(reg_enter.FindAllString(lex.Code[lex.Cursor:n], -1))
+	lex.Line += strings.Count(lex.Code[lex.Cursor:n], "\n")
 	lex.Cursor = n
 }
 
-func startWith(reg *regexp.Regexp, str string, offset int) ([]int, bool) {
-	pos := findStringIndex(reg, str, offset)
-	if len(pos) == 0 {
-		return []int{}, false
+// skipSpaces returns the offset of the first byte from offset i which is
+// not whitespace.
+func (lex *Lexer) skipSpaces(i int) int {
+	for i < lex.End && isSpace(lex.Code[i]) {
+		i++
 	}
-	if pos[0] == offset {
-		return pos, true
+	return i
+}
+
+const punctuationChars = "()[]{}?;,|."
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+func isModifier(c byte) bool {
+	return c == MODIFIER_TRIM || c == MODIFIER_TRIM_LINE
+}
+
+// isNameRune reports whether r may be in a name, or start one when first.
+func isNameRune(r rune, first bool) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' ||
+		r >= 0x7f && r <= 0xff || !first && r >= '0' && r <= '9'
+}
+
+// scanIdent returns the offset of the end of the identifier of s starting
+// at offset i, i when there is none.
+func scanIdent(s string, i int) int {
+	for first := true; i < len(s); first = false {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		if !isNameRune(r, first) {
+			break
+		}
+		i += n
+	}
+	return i
+}
+
+// scanName returns the offset of the end of the name of s starting at
+// offset i, i.e. the identifiers separated by dots, i when there is none.
+func scanName(s string, i int) int {
+	n := scanIdent(s, i)
+	if n == i {
+		return i
+	}
+	for n < len(s) && s[n] == '.' {
+		m := scanIdent(s, n+1)
+		if m == n+1 {
+			break
+		}
+		n = m
 	}
-	return pos, false
+	return n
 }
 
-func findStringIndex(reg *regexp.Regexp, str string, offset int) []int {
-	pos := reg.FindStringIndex(str[offset:])
-	if len(pos) == 0 {
-		return []int{}
+// isName reports whether s is a name, which is not a word operator.
+func isName(s string) bool {
+	return s != "" && scanName(s, 0) == len(s) && !isWordOperator(s)
+}
+
+// isWordOperator reports whether s is an operator made of words, e.g.
+// and or b-and.
+func isWordOperator(s string) bool {
+	switch s {
+	case "and", "or", "not", "is", "b-and", "b-or", "b-xor":
+		return true
+	}
+	return false
+}
+
+// scanWordOperator returns the offset of the end of the word operator of s
+// starting at offset i, e.g. and or b-xor, i when there is none.
+func scanWordOperator(s string, i int) int {
+	n := scanIdent(s, i)
+	if n < len(s) && s[n] == '-' {
+		if m := scanIdent(s, n+1); isWordOperator(s[i:m]) {
+			return m
+		}
+	}
+	if isWordOperator(s[i:n]) {
+		return n
+	}
+	return i
+}
+
+// scanOperator returns the offset of the end of the longest operator of s
+// starting at offset i, i when there is none.
+func scanOperator(s string, i int) int {
+	n := i
+	for _, op := range operator {
+		if len(op) > n-i && !isWordOperator(op) && strings.HasPrefix(s[i:], op) {
+			n = i + len(op)
+		}
+	}
+	return n
+}
+
+// scanNumber returns the offset of the end of the number of s starting at
+// offset i, i when there is none.
+func scanNumber(s string, i int) int {
+	digits := func(i int) int {
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		return i
+	}
+	n := digits(i)
+	if n == i {
+		return i
+	}
+	if n+1 < len(s) && s[n] == '.' {
+		if m := digits(n + 1); m > n+1 {
+			n = m
+		}
+	}
+	if n+2 < len(s) && (s[n] == 'e' || s[n] == 'E') && (s[n+1] == '+' || s[n+1] == '-') {
+		if m := digits(n + 2); m > n+2 {
+			n = m
+		}
+	}
+	return n
+}
+
+// scanString returns the offset of the end of the quoted string of s
+// starting at offset i, i when there is none. A backslash escapes the
+// character following it, but a newline.
+func scanString(s string, i int) int {
+	if i >= len(s) || s[i] != '"' && s[i] != '\'' {
+		return i
+	}
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case s[i]:
+			return j + 1
+		case '\\':
+			if j+1 == len(s) || s[j+1] == '\n' {
+				return i
+			}
+			j++
+		}
 	}
-	return []int{pos[0] + offset, pos[1] + offset}
+	return i
 }
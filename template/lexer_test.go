@@ -0,0 +1,436 @@
+package template
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// The regular expressions the lexer found its tokens with, before it
+// scanned the code itself.
+var (
+	// }} -}} ~}}
+	reg_variable = regexp.MustCompile(fmt.Sprintf(`\s*[-~]?%s`, TAG_VARIABLE[1]))
+	// %} -%} ~%}
+	reg_block = regexp.MustCompile(fmt.Sprintf(`\s*[-~]?%s`, TAG_BLOCK[1]))
+	// #} -#} ~#}
+	reg_comment = regexp.MustCompile(fmt.Sprintf(`\s*[-~]?%s`, TAG_COMMENT[1]))
+	// verbatim %} raw %}
+	reg_block_raw = regexp.MustCompile(fmt.Sprintf(`^\s*(verbatim|raw)\s*[-~]?%s`, TAG_BLOCK[1]))
+	// {% endverbatim %} {% endraw %}
+	reg_raw_end = map[string]*regexp.Regexp{
+		"verbatim": regexp.MustCompile(fmt.Sprintf(`%s[-~]?\s*endverbatim\s*[-~]?%s`, TAG_BLOCK[0], TAG_BLOCK[1])),
+		"raw":      regexp.MustCompile(fmt.Sprintf(`%s[-~]?\s*endraw\s*[-~]?%s`, TAG_BLOCK[0], TAG_BLOCK[1])),
+	}
+	// {{ or {% or {#
+	reg_token_start = regexp.MustCompile(fmt.Sprintf(`(@?%s|@?%s|@?%s)`, TAG_VARIABLE[0], TAG_BLOCK[0], TAG_COMMENT[0]))
+	// \r\n \n
+	reg_enter = regexp.MustCompile(`(\r\n|\n)`)
+	// whitespace
+	reg_whitespace = regexp.MustCompile(`^\s+`)
+	// +-*/%&^|><=
+	reg_operator = regexp.MustCompile(`[\+\-\&*\/%\^><=:]{1,3}|(and)|(or)`)
+	// name
+	reg_name = regexp.MustCompile(`[a-zA-Z_\x7f-\xff][a-zA-Z0-9_\x7f-\xff]*(\.[a-zA-Z_\x7f-\xff][a-zA-Z0-9_\x7f-\xff]*)*`)
+	// number
+	reg_number = regexp.MustCompile(`[0-9]+(?:\.[0-9]+)?([Ee][\+\-][0-9]+)?`)
+	// punctuation
+	reg_punctuation   = regexp.MustCompile(`[\(\)\[\]\{\}\?\:;,\|]`)
+	reg_bracket_open  = regexp.MustCompile(`[\{\[\(]`)
+	reg_bracket_close = regexp.MustCompile(`[\}\]\)]`)
+	// string
+	reg_string = regexp.MustCompile(`"([^"\\\\]*(?:\\\\.[^"\\\\]*)*)"|'([^\'\\\\]*(?:\\\\.[^\'\\\\]*)*)'`)
+)
+
+// A regexLexer splits code into tokens with the regular expressions, the
+// way the lexer did before it scanned the code itself. The whitespace
+// control and the tokens are those of the Lexer.
+type regexLexer struct {
+	*Lexer
+	poss [][]int // offsets of the opening delimiters
+}
+
+func (lex *regexLexer) Tokenize(src *Source) (*TokenStream, error) {
+	lex.Code = reg_enter.ReplaceAllString(src.Code, "\n")
+	lex.Source = &Source{Identity: src.Identity, Code: lex.Code, lines: lineStarts(lex.Code)}
+	lex.Cursor = 0
+	lex.Line = 1
+	lex.End = len(lex.Code)
+	lex.poss = reg_token_start.FindAllStringIndex(lex.Code, -1)
+	for _, pos := range lex.poss {
+		if pos[0] < lex.Cursor {
+			continue
+		}
+		lex.tag = [2]int{pos[0], pos[1]}
+		if e := lex.lexNextPart(); e != nil {
+			return nil, e
+		}
+	}
+	if lex.Cursor < lex.End {
+		lex.pushToken(TYPE_TEXT, lex.Code[lex.Cursor:lex.End], lex.Cursor)
+	}
+	lex.pushToken(TYPE_EOF, "", lex.End)
+	return &TokenStream{Source: lex.Source, tokens: lex.Tokens}, nil
+}
+
+func (lex *regexLexer) lexNextPart() error {
+	pos := lex.tag
+	if pos[0] > lex.Cursor {
+		lex.pushToken(TYPE_TEXT, lex.Code[lex.Cursor:pos[0]], lex.Cursor)
+	}
+	lex.moveCursor(pos[1])
+	if pos[1]-pos[0] == 2 {
+		lex.lexStartModifier(lex.Code[pos[0]:pos[1]])
+	}
+	switch pos[1] - pos[0] {
+	case 3:
+		var reg *regexp.Regexp
+		switch lex.Code[pos[0]+1 : pos[1]] {
+		case TAG_COMMENT[0]:
+			reg = reg_comment
+		case TAG_BLOCK[0]:
+			reg = reg_block
+		case TAG_VARIABLE[0]:
+			reg = reg_variable
+		}
+		if subp, ok := startWith(reg, lex.Code, lex.Cursor); ok {
+			lex.pushToken(TYPE_TEXT, lex.Code[pos[0]+1:subp[1]], pos[0]+1)
+			lex.moveCursor(subp[1])
+			return nil
+		}
+		return lex.unexpected(pos[0], lex.Code[pos[0]:pos[1]], "")
+	case 2:
+		switch lex.Code[pos[0]:pos[1]] {
+		case TAG_COMMENT[0]:
+			return lex.lexComment()
+		case TAG_BLOCK[0]:
+			if subp := reg_block_raw.FindStringSubmatchIndex(lex.Code[lex.Cursor:]); subp != nil {
+				name := lex.Code[lex.Cursor+subp[2] : lex.Cursor+subp[3]]
+				return lex.lexRaw(pos[0], name, lex.Cursor+subp[2], lex.Cursor+subp[1])
+			}
+			lex.pushToken(TYPE_BLOCK_START, lex.Code[pos[0]:lex.Cursor], pos[0])
+			if e := lex.lexData(reg_block); e != nil {
+				return e
+			}
+			lex.pushClosingTag(TYPE_BLOCK_END, TAG_BLOCK[1])
+			lex.lexEndModifier(true)
+		case TAG_VARIABLE[0]:
+			lex.pushToken(TYPE_VAR_START, lex.Code[pos[0]:lex.Cursor], pos[0])
+			if e := lex.lexData(reg_variable); e != nil {
+				return e
+			}
+			lex.pushClosingTag(TYPE_VAR_END, TAG_VARIABLE[1])
+			lex.lexEndModifier(false)
+		}
+	}
+	return nil
+}
+
+func (lex *regexLexer) lexRaw(tag int, id string, name, start int) error {
+	line := lex.Line
+	lex.pushToken(TYPE_BLOCK_START, lex.Code[tag:lex.Cursor], tag)
+	lex.pushToken(TYPE_NAME, id, name)
+	lex.moveCursor(start)
+	lex.pushClosingTag(TYPE_BLOCK_END, TAG_BLOCK[1])
+	lex.lexEndModifier(true)
+	end := findStringIndex(reg_raw_end[id], lex.Code, lex.Cursor)
+	if len(end) == 0 {
+		e := NewUnexpectedEndOfFile(lex.Source, line, "end"+id)
+		e.Pos = Pos(tag + 1)
+		return e
+	}
+	content := lex.Code[lex.Cursor:end[0]]
+	open := end[0] + len(TAG_BLOCK[0])
+	if m := rune(lex.Code[open]); m == MODIFIER_TRIM || m == MODIFIER_TRIM_LINE {
+		content = strings.TrimRightFunc(content, trimFunc(m))
+		open++
+	}
+	lex.pushToken(TYPE_RAW, content, lex.Cursor)
+	lex.moveCursor(end[1])
+	lex.pushToken(TYPE_BLOCK_START, lex.Code[end[0]:open], end[0])
+	lex.pushToken(TYPE_NAME, "end"+id, end[0]+strings.Index(lex.Code[end[0]:end[1]], "end"+id))
+	lex.pushClosingTag(TYPE_BLOCK_END, TAG_BLOCK[1])
+	lex.lexEndModifier(true)
+	return nil
+}
+
+func (lex *regexLexer) lexComment() error {
+	if p := findStringIndex(reg_comment, lex.Code, lex.Cursor); len(p) > 0 {
+		if lex.KeepComments {
+			start := strings.LastIndex(lex.Code[:lex.Cursor], TAG_COMMENT[0])
+			lex.pushToken(TYPE_COMMENT, lex.Code[start:p[1]], start)
+		}
+		lex.moveCursor(p[1])
+		lex.lexEndModifier(true)
+		return nil
+	}
+	return lex.unclosed(fmt.Sprintf("%q", TAG_COMMENT[1]))
+}
+
+func (lex *regexLexer) lexData(reg *regexp.Regexp) error {
+	if !reg.MatchString(lex.Code[lex.Cursor:]) {
+		if reg == reg_variable {
+			return lex.unclosed(TypeToEnglish(TYPE_VAR_END))
+		}
+		return lex.unclosed(TypeToEnglish(TYPE_BLOCK_END))
+	}
+	return lex.lexExpression(reg)
+}
+
+func (lex *regexLexer) lexExpression(reg *regexp.Regexp) error {
+	pos := findStringIndex(reg, lex.Code, lex.Cursor)
+	var brackets []*Bracket
+
+	for lex.Cursor < pos[0] {
+		if subp, ok := startWith(reg_whitespace, lex.Code[:pos[0]], lex.Cursor); ok {
+			lex.moveCursor(subp[1])
+		}
+		if subp, ok := startWith(reg_operator, lex.Code[:pos[0]], lex.Cursor); ok {
+			lex.pushToken(TYPE_OPERATOR, lex.Code[lex.Cursor:subp[1]], lex.Cursor)
+			lex.moveCursor(subp[1])
+		} else if subp, ok := startWith(reg_name, lex.Code[:pos[0]], lex.Cursor); ok {
+			lex.pushToken(TYPE_NAME, lex.Code[lex.Cursor:subp[1]], lex.Cursor)
+			lex.moveCursor(subp[1])
+		} else if subp, ok := startWith(reg_number, lex.Code[:pos[0]], lex.Cursor); ok {
+			lex.pushToken(TYPE_NUMBER, lex.Code[lex.Cursor:subp[1]], lex.Cursor)
+			lex.moveCursor(subp[1])
+		} else if subp, ok := startWith(reg_string, lex.Code[:pos[0]], lex.Cursor); ok {
+			lex.pushToken(TYPE_STRING, lex.Code[lex.Cursor:subp[1]], lex.Cursor)
+			lex.moveCursor(subp[1])
+		} else if _, ok := startWith(reg_punctuation, lex.Code[:pos[0]], lex.Cursor); ok {
+			var (
+				subp []int
+				ok   bool
+			)
+			if subp, ok = startWith(reg_bracket_open, lex.Code[:pos[0]], lex.Cursor); ok {
+				brackets = append(brackets, &Bracket{ch: lex.Code[subp[0]:subp[1]], Line: lex.Line, offset: subp[0]})
+			} else if subp, ok = startWith(reg_bracket_close, lex.Code[:pos[0]], lex.Cursor); ok {
+				ch := lex.Code[subp[0]:subp[1]]
+				if len(brackets) == 0 {
+					return lex.unexpected(subp[0], ch, "")
+				}
+				if b := brackets[len(brackets)-1]; ch != closingBrackets[b.ch] {
+					return lex.unexpected(subp[0], ch, fmt.Sprintf("%q", closingBrackets[b.ch]))
+				}
+				brackets = brackets[:len(brackets)-1]
+			} else {
+				subp = findStringIndex(reg_punctuation, lex.Code[:pos[0]], lex.Cursor)
+			}
+			lex.pushToken(TYPE_PUNCTUATION, lex.Code[lex.Cursor:subp[1]], lex.Cursor)
+			lex.moveCursor(subp[1])
+		} else {
+			tok := lex.Code[lex.Cursor:pos[0]]
+			if f := strings.Fields(tok); len(f) > 0 {
+				tok = f[0]
+			}
+			return lex.unexpected(lex.Cursor, tok, "")
+		}
+	}
+
+	if len(brackets) > 0 {
+		b := brackets[len(brackets)-1]
+		return lex.unexpected(b.offset, b.ch, fmt.Sprintf("%q", closingBrackets[b.ch]))
+	}
+	lex.moveCursor(pos[1])
+	return nil
+}
+
+func startWith(reg *regexp.Regexp, str string, offset int) ([]int, bool) {
+	pos := findStringIndex(reg, str, offset)
+	if len(pos) == 0 {
+		return []int{}, false
+	}
+	return pos, pos[0] == offset
+}
+
+func findStringIndex(reg *regexp.Regexp, str string, offset int) []int {
+	pos := reg.FindStringIndex(str[offset:])
+	if len(pos) == 0 {
+		return []int{}
+	}
+	return []int{pos[0] + offset, pos[1] + offset}
+}
+
+// lexParts are the pieces of the random templates lexed by the tests. They
+// leave out the strings with escapes, which the regular expressions did not
+// read as unquote does, the names starting with and or or, which they
+// split, and the operators and the punctuation added since, e.g. !, ||, is
+// and the dot. The operators are followed by a space, the regular
+// expressions reading any run of operator characters as one operator, and
+// the numbers are between spaces, their dot being read as a selector after
+// a name.
+var lexParts = []string{
+	"{{", "}}", "{%", "%}", "{#", "#}", "-", "~", "@", "if", "endif", "for", "in",
+	"a", "b.c", "(", ")", "[", "]", ",", "|", "+", "==", "&&", "'s'", `"t"`,
+	`"a\\b"`, "1", "2.5", "1e+3", "1e3", " ", "\n", "\r\n", "\t", "set", "=", "++",
+	"verbatim", "endverbatim", "raw", "endraw", "block", "else", ";", ":", "{", "}",
+	"x", "é", "ж", "?", "<<=", ">>", "%", "^", "*", "/", "trim",
+	"_z9", "\xff", "#",
+}
+
+// dumpTokens returns the tokens of code split by lex, or the error of lex.
+func dumpTokens(lex interface {
+	Tokenize(*Source) (*TokenStream, error)
+}, code string) string {
+	stream, e := lex.Tokenize(NewSource(code))
+	if e != nil {
+		return "error: " + e.Error()
+	}
+	sb := &strings.Builder{}
+	for _, t := range stream.tokens {
+		fmt.Fprintf(sb, "%s %q %d:%d@%d\n", TypeToEnglish(t.Type()), t.Value(), t.Line(), t.Column(), t.Offset())
+	}
+	return sb.String()
+}
+
+func TestTokenizeRegex(t *testing.T) {
+	var codes []string
+	for _, path := range corpus {
+		code, e := os.ReadFile(path)
+		if e != nil {
+			t.Fatal(e)
+		}
+		// the templates using the operators added since are left out
+		if _, e := (&regexLexer{Lexer: NewLexer()}).Tokenize(NewSource(string(code))); e == nil {
+			codes = append(codes, string(code))
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		var sb strings.Builder
+		for n := r.Intn(24); n > 0; n-- {
+			part := lexParts[r.Intn(len(lexParts))]
+			number := scanNumber(part, 0) > 0
+			if number {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(part)
+			if r.Intn(3) == 0 || number || scanOperator(part, 0) == len(part) && part != "-" {
+				sb.WriteByte(' ')
+			}
+		}
+		codes = append(codes, sb.String())
+	}
+	configs := []Config{{}, {TrimBlocks: true}, {TrimBlocks: true, LstripBlocks: true}}
+	for _, code := range codes {
+		for _, cfg := range configs {
+			for _, keep := range []bool{false, true} {
+				cfg := cfg
+				got := dumpTokens(&Lexer{Config: &cfg, KeepComments: keep}, code)
+				want := dumpTokens(&regexLexer{Lexer: &Lexer{Config: &cfg, KeepComments: keep}}, code)
+				if got != want {
+					g, w := strings.Split(got, "\n"), strings.Split(want, "\n")
+					i := 0
+					for i < len(g) && i < len(w) && g[i] == w[i] {
+						i++
+					}
+					t.Fatalf("%q, %+v, comments %v: token %d:\ngot  %q\nwant %q", code, cfg, keep, i, g[i:], w[i:])
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkTokenize(b *testing.B) {
+	for _, path := range corpus {
+		code, e := os.ReadFile(path)
+		if e != nil {
+			b.Fatal(e)
+		}
+		b.Run(path+"/scanner", func(b *testing.B) {
+			b.SetBytes(int64(len(code)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				NewLexer().Tokenize(NewSource(string(code)))
+			}
+		})
+		b.Run(path+"/regex", func(b *testing.B) {
+			if _, e := (&regexLexer{Lexer: NewLexer()}).Tokenize(NewSource(string(code))); e != nil {
+				b.Skip("the operators added since are unknown to the regular expressions")
+			}
+			b.SetBytes(int64(len(code)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				(&regexLexer{Lexer: NewLexer()}).Tokenize(NewSource(string(code)))
+			}
+		})
+	}
+}
+
+func TestWhitespaceControl(t *testing.T) {
+	cases := []struct {
+		cfg  Config
+		code string
+		want string
+	}{
+		{Config{}, "a  {{- 1 -}}  b", "a1b"},
+		{Config{}, "a \n {{- 1 }} \n b", "a1 \n b"},
+		{Config{}, "a \n {{ 1 -}} \n b", "a \n 1b"},
+		{Config{}, "a \t\n\t{{~ 1 ~}}\t \n b", "a \t\n1\n b"},
+		{Config{}, "<ul>\n  {%- for i = 0; i < 2; i++ -%}\n  <li>{{ i }}</li>\n  {%- endfor %}\n</ul>", "<ul><li>0</li><li>1</li>\n</ul>"},
+		{Config{}, "a {#- c -#} b", "ab"},
+		{Config{}, "a {%- verbatim -%} {{ x }} {%- endverbatim -%} b", "a{{ x }}b"},
+		{Config{TrimBlocks: true}, "{% if 1 %}\na\n{% endif %}\nb\n", "a\nb\n"},
+		{Config{TrimBlocks: true}, "{% if 1 %} \na{{ 1 }}\nb{% endif %}", " \na1\nb"},
+		{Config{TrimBlocks: true}, "{# c #}\na", "a"},
+		{Config{LstripBlocks: true}, "  {% if 1 %}a\n\t{% endif %}b\n  {{ 1 }}", "a\nb\n  1"},
+		{Config{LstripBlocks: true}, "x {% if 1 %}a{% endif %}", "x a"},
+		{Config{TrimBlocks: true, LstripBlocks: true}, "<ul>\n  {% for i = 0; i < 2; i++ %}\n  <li>{{ i }}</li>\n  {% endfor %}\n</ul>", "<ul>\n  <li>0</li>\n  <li>1</li>\n</ul>"},
+		{Config{TrimBlocks: true, LstripBlocks: true}, "{% if 1 %}\n    {% if 1 %}\n    a\n    {% endif %}\n{% endif %}\n", "    a\n"},
+	}
+	for _, c := range cases {
+		cfg := c.cfg
+		w := &strings.Builder{}
+		if e := NewTemplates(&cfg).RenderString(w, c.code); e != nil {
+			t.Errorf("%q: %v", c.code, e)
+		} else if got := w.String(); got != c.want {
+			t.Errorf("%+v %q:\ngot  %q\nwant %q", c.cfg, c.code, got, c.want)
+		}
+	}
+}
+
+func TestRawBlockLines(t *testing.T) {
+	cases := []struct {
+		code  string
+		diags []string // syntax errors
+		line  int      // line of the runtime error, when there is none
+	}{
+		{"{% verbatim %}\n{{ a\nb }}\n{% endverbatim %}\n{{ 1 + }}", []string{
+			"5:7: unexpected end of expression, expecting expression",
+		}, 0},
+		{"a\n{% raw -%}\n\n{% if %}\n{%- endraw %}{% if %}\n", []string{
+			"5:14: unexpected end of template, expecting endif",
+			`5:20: unexpected token "%}", expecting expression`,
+		}, 0},
+		{"{% verbatim %}{% verbatim %}\n{% endverbatim %}\n{% endverbatim %}", []string{
+			`3:4: unexpected token "endverbatim"`,
+		}, 0},
+		{"x\n{% verbatim %}\n{{ a }}\n", []string{
+			"2:1: unexpected end of template, expecting endverbatim",
+		}, 0},
+		{"{% raw %}\n\n{% endraw %}{% verbatim %}\n{% endverbatim %}\n\n{{ nope() }}", nil, 6},
+		{"{% if 1 %}{% verbatim %}a\nb{% endverbatim %}\n{{ nope() }}{% endif %}", nil, 3},
+	}
+	for _, c := range cases {
+		if got := diagnose(c.code); !reflect.DeepEqual(got, c.diags) {
+			t.Errorf("%q:\ngot  %q\nwant %q", c.code, got, c.diags)
+		}
+		if c.diags != nil {
+			continue
+		}
+		for _, cfg := range []Config{{}, {Bytecode: true}} {
+			e := NewTemplates(&cfg).RenderString(io.Discard, c.code)
+			var re *RuntimeError
+			if !errors.As(e, &re) || len(re.Stack) != 1 || re.Stack[0].Line != c.line {
+				t.Errorf("%q (bytecode %v): got %v, want an error at line %d", c.code, cfg.Bytecode, e, c.line)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package template
+
+import (
+	"io"
+	"time"
+)
+
+// Limits bound the resources used by a rendering. A zero limit is no limit.
+type Limits struct {
+	MaxSteps      int           // statements executed
+	MaxIterations int           // iterations of a single loop
+	MaxDepth      int           // nested templates, included or extended
+	MaxOutput     int64         // bytes written
+	MaxDuration   time.Duration // time spent
+}
+
+// limit applies the limits of the templates to the rendering s to w.
+func (s *state) limit(w io.Writer) {
+	l := &s.ts.Config.Limits
+	if l.MaxOutput > 0 {
+		s.wr = &limitWriter{w: w, s: s, max: l.MaxOutput}
+	}
+	if l.MaxDuration > 0 {
+		s.deadline = time.Now().Add(l.MaxDuration)
+	}
+}
+
+// step counts a statement executed, and returns an error when the rendering
+// exceeds its number of steps or its time.
+func (s *state) step() error {
+	l := &s.ts.Config.Limits
+	s.steps++
+	if l.MaxSteps > 0 && s.steps > l.MaxSteps {
+		return &StepLimitError{Limit: l.MaxSteps, At: s.here()}
+	}
+	if !s.deadline.IsZero() && time.Now().After(s.deadline) {
+		return &TimeLimitError{Limit: l.MaxDuration, At: s.here()}
+	}
+	return nil
+}
+
+// iterate returns an error when the n-th iteration of a loop exceeds the
+// number of iterations.
+func (s *state) iterate(n int) error {
+	if max := s.ts.Config.Limits.MaxIterations; max > 0 && n > max {
+		return &IterationLimitError{Limit: max, At: s.here()}
+	}
+	return nil
+}
+
+// nest returns an error when one more template would exceed the depth.
+func (s *state) nest() error {
+	if max := s.ts.Config.Limits.MaxDepth; max > 0 && s.depth >= max {
+		return &DepthLimitError{Limit: max, At: s.here()}
+	}
+	return nil
+}
+
+// here returns the frame of the statement being executed.
+func (s *state) here() Frame {
+	if n := len(s.frames); n > 0 {
+		return s.frames[n-1].export()
+	}
+	return Frame{}
+}
+
+// A limitWriter fails the writes beyond max bytes.
+type limitWriter struct {
+	w   io.Writer
+	s   *state
+	n   int64 // bytes written
+	max int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.n+int64(len(p)) > lw.max {
+		return 0, &OutputLimitError{Limit: lw.max, At: lw.s.here()}
+	}
+	n, e := lw.w.Write(p)
+	lw.n += int64(n)
+	return n, e
+}
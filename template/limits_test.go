@@ -0,0 +1,68 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLimits(t *testing.T) {
+	loop := "a\n{% for i = 0; i < 5; i++ %}{{ i }}{% endfor %}"
+	cases := []struct {
+		limits Limits
+		code   string
+		want   string // output
+		err    string // error, without its stack
+		at     Frame
+	}{
+		{Limits{MaxSteps: 20, MaxIterations: 5, MaxDepth: 1, MaxOutput: 7}, loop, "a\n01234", "", Frame{}},
+		{Limits{MaxSteps: 5}, loop, "a\n01", "more than 5 statements executed", Frame{Line: 2}},
+		{Limits{MaxIterations: 3}, loop, "a\n012", "more than 3 loop iterations", Frame{Line: 2}},
+		{Limits{MaxIterations: 1}, "{% range v = list %}{{ v }}{% endrange %}", "0", "more than 1 loop iterations", Frame{Line: 1}},
+		{Limits{MaxOutput: 4}, loop, "a\n01", "more than 4 bytes written", Frame{Line: 2}},
+		{Limits{MaxDepth: 1}, `a{% include "testdata/inc.html" %}`, "a", "more than 1 nested templates", Frame{Line: 1}},
+		{Limits{MaxDepth: 2}, `{% include "testdata/inc.html" %}`, "inc=7 1\n", "", Frame{}},
+		{Limits{MaxDuration: time.Millisecond}, "{% for i = 0; i < 5; i++ %}{{ i }}{{ sleep() }}{% endfor %}", "0", "rendering took more than 1ms", Frame{Line: 1}},
+	}
+	for _, cfg := range []Config{{}, {Bytecode: true}} {
+		for _, c := range cases {
+			cfg.Limits = c.limits
+			ts := NewTemplates(&cfg)
+			ts.AddGlobal("sleep", func() string { time.Sleep(2 * time.Millisecond); return "" })
+			w := &strings.Builder{}
+			e := ts.RenderString(w, c.code, KS(KV("list", []string{"x", "y"})))
+			var re *RuntimeError
+			got, at := "", Frame{}
+			if errors.As(e, &re) {
+				got = re.Err.Error()
+				at = limitFrame(re.Err)
+				at.Template = ""
+			} else if e != nil {
+				got = e.Error()
+			}
+			if w.String() != c.want || got != c.err || at != c.at {
+				t.Errorf("%+v %q:\ngot  %q, %q at %+v\nwant %q, %q at %+v", c.limits, c.code, w.String(), got, at, c.want, c.err, c.at)
+			}
+		}
+	}
+}
+
+// limitFrame returns the frame the limit error e was hit at.
+func limitFrame(e error) Frame {
+	switch e := e.(type) {
+	case *StepLimitError:
+		return e.At
+	case *IterationLimitError:
+		return e.At
+	case *DepthLimitError:
+		return e.At
+	case *OutputLimitError:
+		return e.At
+	case *TimeLimitError:
+		return e.At
+	}
+	panic(fmt.Sprintf("%T is not a limit error", e))
+}
@@ -0,0 +1,566 @@
+package template
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// knownTags are the names of the block tags the token filter understands.
+var knownTags = map[string]bool{
+	"if": true, "elseif": true, "else": true, "endif": true,
+	"for": true, "endfor": true, "range": true, "endrange": true,
+	"block": true, "endblock": true, "set": true, "include": true,
+	"extend": true, "with": true, "endwith": true,
+	"spaceless": true, "endspaceless": true,
+	"sandbox": true, "endsandbox": true, "params": true,
+	"verbatim": true, "endverbatim": true, "raw": true, "endraw": true,
+}
+
+// deprecatedTags maps the deprecated block tags to their replacement.
+var deprecatedTags = map[string]string{}
+
+// A LintRule checks a template for one kind of problem.
+type LintRule struct {
+	Name string
+	Doc  string
+	run  func(f *lintFile)
+}
+
+// LintRules are all the rules of the linter.
+var LintRules = []*LintRule{
+	{
+		Name: "unknown-tag",
+		Doc:  "block tags the parser does not know",
+		run:  lintUnknownTags,
+	},
+	{
+		Name: RULE_UNCLOSED,
+		Doc:  "blocks not closed by their end tag",
+		run:  lintUnclosedBlocks,
+	},
+	{
+		Name: "duplicate-block",
+		Doc:  "block names defined more than once in a template",
+		run:  lintDuplicateBlocks,
+	},
+	{
+		Name: "unused-set",
+		Doc:  "variables set but never used in a template without includes",
+		run:  lintUnusedSets,
+	},
+	{
+		Name: "block-not-in-base",
+		Doc:  "blocks of a child template its base templates do not define",
+		run:  lintChildBlocks,
+	},
+	{
+		Name: "missing-template",
+		Doc:  "included or extended templates which do not exist",
+		run:  lintMissingTemplates,
+	},
+	{
+		Name: "deprecated-tag",
+		Doc:  "usage of deprecated block tags",
+		run:  lintDeprecatedTags,
+	},
+	{
+		Name: "undefined-variable",
+		Doc:  "variables neither declared by the params nor defined in a template declaring params",
+		run:  lintUndefinedVars,
+	},
+}
+
+// LookupLintRule returns the rule of the given name, nil if there is none.
+func LookupLintRule(name string) *LintRule {
+	for _, r := range LintRules {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// A Linter checks templates with a set of rules.
+type Linter struct {
+	Root    string      // directory the paths of includes and extends are relative to
+	Rules   []*LintRule // rules to run; all of them when nil
+	Globals []string    // variables defined for every template, besides the params
+}
+
+// LintFile checks the template file of path.
+func (l *Linter) LintFile(path string) ([]*Diagnostic, error) {
+	code, e := os.ReadFile(path)
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
+	return l.Lint(path, code), nil
+}
+
+// Lint checks the template code read from the file of path.
+func (l *Linter) Lint(path string, code []byte) []*Diagnostic {
+	f := &lintFile{linter: l, path: path, src: &Source{Code: string(code), Identity: path}}
+	rules := l.Rules
+	if rules == nil {
+		rules = LintRules
+	}
+	f.parse()
+	for _, r := range rules {
+		f.rule = r.Name
+		r.run(f)
+	}
+	sort.SliceStable(f.diags, func(i, j int) bool {
+		a, b := f.diags[i], f.diags[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return f.diags
+}
+
+// lintFile is a template being checked.
+type lintFile struct {
+	linter   *Linter
+	path     string
+	src      *Source
+	tree     *Tree
+	unknown  []*Token      // names of the unknown tags
+	unclosed []*Diagnostic // blocks not closed by their end tag
+	rule     string        // rule being run
+	diags    []*Diagnostic
+}
+
+// parse parses the template, leaving its unknown tags out, and reports
+// its syntax errors, but for the unclosed blocks reported by their rule. The rules are run on the tree of the tags which could
+// be parsed.
+func (f *lintFile) parse() {
+	lex := NewLexer()
+	lex.Recover = true
+	stream, e := lex.Tokenize(f.src)
+	f.diags = append(f.diags, lex.Diagnostics...)
+	if e != nil {
+		f.diags = append(f.diags, newDiagnostic(f.src, e, NoPos))
+		stream = &TokenStream{Source: f.src, tokens: []*Token{}}
+	}
+	f.src = stream.Source
+	stream.tokens, f.unknown = stripUnknownTags(stream.tokens)
+	filter := &TokenFilter{Tr: &Tree{}, Recover: true}
+	if f.tree, _ = filter.Filter(stream); f.tree == nil {
+		f.tree = filter.Tr
+	}
+	for _, d := range filter.Diagnostics {
+		if d.Rule == RULE_UNCLOSED {
+			f.unclosed = append(f.unclosed, d)
+		} else {
+			f.diags = append(f.diags, d)
+		}
+	}
+}
+
+// report reports a problem found at pos by the rule being run.
+func (f *lintFile) report(pos Pos, format string, args ...any) {
+	p := f.src.Position(pos)
+	f.diags = append(f.diags, &Diagnostic{
+		File:    f.path,
+		Line:    p.Line,
+		Column:  p.Column,
+		Rule:    f.rule,
+		Message: fmt.Sprintf(format, args...),
+		src:     f.src,
+	})
+}
+
+// resolve returns the path of the file of a template path in the code.
+func (f *lintFile) resolve(path string) string {
+	return filepath.Join(f.linter.Root, unquote(path))
+}
+
+// stripUnknownTags removes the block tags with an unknown name from tokens
+// and returns their names.
+func stripUnknownTags(tokens []*Token) (kept, unknown []*Token) {
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.Type() == TYPE_BLOCK_START && i+1 < len(tokens) {
+			if name := tokens[i+1]; name.Type() == TYPE_NAME && !knownTags[name.Value()] {
+				unknown = append(unknown, name)
+				for i < len(tokens)-1 && tokens[i].Type() != TYPE_BLOCK_END {
+					i++
+				}
+				continue
+			}
+		}
+		kept = append(kept, t)
+	}
+	return
+}
+
+func lintUnknownTags(f *lintFile) {
+	for _, t := range f.unknown {
+		f.report(t.Pos(), "unknown tag %s", t.Value())
+	}
+}
+
+func lintUnclosedBlocks(f *lintFile) {
+	f.diags = append(f.diags, f.unclosed...)
+}
+
+func lintDuplicateBlocks(f *lintFile) {
+	blocks := map[string]*BlockStmt{}
+	Inspect(f.tree, func(n ASTNode) bool {
+		if bs, ok := n.(*BlockStmt); ok {
+			if first, ok := blocks[bs.Name.Name]; ok {
+				f.report(bs.Name.Pos(), "block %s is already defined at line %d",
+					bs.Name.Name, f.src.Position(first.Pos()).Line)
+			} else {
+				blocks[bs.Name.Name] = bs
+			}
+		}
+		return true
+	})
+}
+
+func lintUnusedSets(f *lintFile) {
+	var (
+		sets     []*Ident
+		used     = map[string]bool{}
+		included bool
+	)
+	var use func(n ASTNode) bool
+	use = func(n ASTNode) bool {
+		switch n := n.(type) {
+		case *SelectorExpr:
+			// the selector is a field, not a variable
+			Inspect(n.X, use)
+			return false
+		case *TestExpr:
+			// neither is the name of a test
+			Inspect(n.X, use)
+			if n.Args != nil {
+				Inspect(n.Args, use)
+			}
+			return false
+		case *Ident:
+			used[strings.SplitN(n.Name, ".", 2)[0]] = true
+		case *SetStmt:
+			if id, ok := n.Assign.Lh.(*Ident); ok && n.Assign.Tok == "=" {
+				sets = append(sets, id)
+			}
+		case *IncludeStmt:
+			// the included template may use any variable
+			included = true
+		case *AssignStmt:
+			// the assigned variable is not used
+			if n.Rh != nil {
+				Inspect(n.Rh, use)
+			}
+			return false
+		case *RangeStmt:
+			Inspect(n.X, use)
+			if n.Body != nil {
+				Inspect(n.Body, use)
+			}
+			return false
+		case *BlockStmt:
+			if n.Body != nil {
+				Inspect(n.Body, use)
+			}
+			return false
+		}
+		return true
+	}
+	Inspect(f.tree, use)
+	if included {
+		return
+	}
+	reported := map[string]bool{}
+	for _, id := range sets {
+		if !used[id.Name] && !reported[id.Name] {
+			reported[id.Name] = true
+			f.report(id.Pos(), "variable %s is set but never used", id.Name)
+		}
+	}
+}
+
+func lintChildBlocks(f *lintFile) {
+	if f.tree.Extend == nil {
+		return
+	}
+	base := map[string]bool{}
+	visited := map[string]bool{}
+	for path := f.resolve(f.tree.Extend.Ident.Value); path != "" && !visited[path]; {
+		visited[path] = true
+		tr := parseLintFile(path)
+		if tr == nil {
+			// a missing or malformed base is reported on its own
+			return
+		}
+		Inspect(tr, func(n ASTNode) bool {
+			if bs, ok := n.(*BlockStmt); ok {
+				base[bs.Name.Name] = true
+			}
+			return true
+		})
+		path = ""
+		if tr.Extend != nil {
+			path = f.resolve(tr.Extend.Ident.Value)
+		}
+	}
+	Inspect(f.tree, func(n ASTNode) bool {
+		if bs, ok := n.(*BlockStmt); ok && !base[bs.Name.Name] {
+			f.report(bs.Name.Pos(), "block %s is not defined in the base templates", bs.Name.Name)
+		}
+		return true
+	})
+}
+
+// parseLintFile parses the template file of path, nil if it cannot be.
+func parseLintFile(path string) *Tree {
+	code, e := os.ReadFile(path)
+	if e != nil {
+		return nil
+	}
+	tr, diags := Parse(NewSource(string(code)))
+	if len(diags) > 0 {
+		return nil
+	}
+	return tr
+}
+
+func lintMissingTemplates(f *lintFile) {
+	Inspect(f.tree, func(n ASTNode) bool {
+		var lit *BasicLit
+		switch n := n.(type) {
+		case *IncludeStmt:
+			lit = n.Ident
+		case *ExtendStmt:
+			lit = n.Ident
+		default:
+			return true
+		}
+		if _, e := os.Stat(f.resolve(lit.Value)); e != nil {
+			f.report(lit.Pos(), "template %s does not exist", lit.Value)
+		}
+		return true
+	})
+}
+
+func lintDeprecatedTags(f *lintFile) {
+	Inspect(f.tree, func(n ASTNode) bool {
+		if tag := tagName(n); tag != "" {
+			if by, ok := deprecatedTags[tag]; ok {
+				f.report(n.Pos(), "tag %s is deprecated, use %s instead", tag, by)
+			}
+		}
+		return true
+	})
+}
+
+func lintUndefinedVars(f *lintFile) {
+	ps := f.tree.params()
+	if ps == nil {
+		return
+	}
+	c := &varChecker{f: f, reported: map[string]bool{}}
+	c.push(false)
+	for _, name := range f.linter.Globals {
+		c.define(name)
+	}
+	c.push(false)
+	for _, p := range ps.List {
+		c.expr(p.Default)
+		c.define(p.Name.Name)
+	}
+	// the blocks of a child template are executed in the scopes of its base
+	// templates, which may define any variable they declare or set
+	visited := map[string]bool{}
+	for tr := f.tree; tr.Extend != nil; {
+		path := f.resolve(tr.Extend.Ident.Value)
+		if visited[path] {
+			break
+		}
+		visited[path] = true
+		if tr = parseLintFile(path); tr == nil {
+			return
+		}
+		Inspect(tr, func(n ASTNode) bool {
+			switch n := n.(type) {
+			case *Param:
+				c.define(n.Name.Name)
+			case *AssignStmt:
+				if id, ok := n.Lh.(*Ident); ok {
+					c.define(id.Name)
+				}
+			case *RangeStmt:
+				for _, x := range []Expr{n.Key, n.Value} {
+					if id, ok := x.(*Ident); ok {
+						c.define(id.Name)
+					}
+				}
+			}
+			return true
+		})
+	}
+	for _, node := range f.tree.List {
+		c.stmt(node)
+	}
+}
+
+// A varChecker reports the variables used by a template which are not
+// defined, following the scopes of the statements defining them.
+type varChecker struct {
+	f        *lintFile
+	scopes   []map[string]bool // the globals first, the innermost last
+	reported map[string]bool
+}
+
+// push pushes a scope; an open one defines any variable.
+func (c *varChecker) push(open bool) {
+	c.scopes = append(c.scopes, map[string]bool{"": open})
+}
+
+func (c *varChecker) pop() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+func (c *varChecker) define(name string) {
+	c.scopes[len(c.scopes)-1][name] = true
+}
+
+func (c *varChecker) defined(name string) bool {
+	for _, scope := range c.scopes {
+		if scope[name] || scope[""] {
+			return true
+		}
+	}
+	return false
+}
+
+// set defines the variable assigned by as where Scope.Set would.
+func (c *varChecker) set(as *AssignStmt) {
+	if as.Rh != nil {
+		c.expr(as.Rh)
+	}
+	if id, ok := as.Lh.(*Ident); ok {
+		if as.Tok != "=" {
+			c.expr(id)
+		} else if !c.defined(id.Name) {
+			c.define(id.Name)
+		}
+	}
+}
+
+func (c *varChecker) section(section *SectionStmt) {
+	if section != nil {
+		for _, st := range section.List {
+			c.stmt(st)
+		}
+	}
+}
+
+func (c *varChecker) stmt(node ASTNode) {
+	switch n := node.(type) {
+	case *ValueStmt:
+		c.expr(n.Tok)
+	case *SetStmt:
+		c.set(n.Assign)
+	case *IfStmt:
+		c.expr(n.Cond)
+		c.section(n.Body)
+		if n.Else != nil {
+			c.stmt(n.Else)
+		}
+	case *SectionStmt:
+		c.section(n)
+	case *ForStmt:
+		c.push(false)
+		if as, ok := n.Init.(*AssignStmt); ok {
+			c.set(as)
+		}
+		if n.Cond != nil {
+			c.expr(n.Cond)
+		}
+		if as, ok := n.Post.(*AssignStmt); ok {
+			c.set(as)
+		}
+		c.section(n.Body)
+		c.pop()
+	case *RangeStmt:
+		c.expr(n.X)
+		c.push(false)
+		for _, x := range []Expr{n.Key, n.Value} {
+			if id, ok := x.(*Ident); ok {
+				c.define(id.Name)
+			}
+		}
+		c.section(n.Body)
+		c.pop()
+	case *BlockStmt:
+		c.section(n.Body)
+	case *IncludeStmt:
+		for _, as := range n.Params {
+			c.expr(as.Rh)
+		}
+	case *WithStmt:
+		for _, as := range n.Params {
+			c.expr(as.Rh)
+		}
+		if n.X != nil {
+			c.expr(n.X)
+		}
+		scopes := c.scopes
+		if n.Only {
+			c.scopes = c.scopes[:1:1]
+		}
+		// the variables of the hash of X are not known
+		c.push(n.X != nil)
+		for _, as := range n.Params {
+			c.define(as.Lh.(*Ident).Name)
+		}
+		c.section(n.Body)
+		c.scopes = scopes
+	case *SpacelessStmt:
+		c.section(n.Body)
+	case *SandboxStmt:
+		c.section(n.Body)
+	}
+}
+
+func (c *varChecker) expr(x Expr) {
+	if x == nil {
+		return
+	}
+	Inspect(x, func(n ASTNode) bool {
+		switch n := n.(type) {
+		case *CallExpr:
+			// functions are not variables, unlike the receivers of methods
+			if id, ok := n.Fun.(*Ident); !ok || strings.Contains(id.Name, ".") {
+				c.expr(n.Fun)
+			}
+			if n.Args != nil {
+				c.expr(n.Args)
+			}
+			return false
+		case *SelectorExpr:
+			c.expr(n.X)
+			return false
+		case *TestExpr:
+			// the variable tested by defined may well not be
+			if n.Name.Name != "defined" {
+				c.expr(n.X)
+			}
+			if n.Args != nil {
+				c.expr(n.Args)
+			}
+			return false
+		case *Ident:
+			name := strings.SplitN(n.Name, ".", 2)[0]
+			if !c.defined(name) && !c.reported[name] {
+				c.reported[name] = true
+				c.f.report(n.Pos(), "variable %s is not defined", name)
+			}
+		}
+		return true
+	})
+}
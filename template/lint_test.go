@@ -0,0 +1,86 @@
+package template
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLintRules(t *testing.T) {
+	cases := []struct {
+		rule string
+		code string
+		want []string
+	}{
+		{"unknown-tag", "a{% foo x %}b{% if a %}{% endif %}", []string{
+			"1:5: unknown tag foo (unknown-tag)",
+		}},
+		{"unclosed-block", "{% if a %}{% for i = 0; i < 2; i++ %}x{% endif %}", []string{
+			"1:11: unclosed block, expecting endfor (unclosed-block)",
+		}},
+		{"unclosed-block", "a\n{% if a %}{% with {b: 1} %}", []string{
+			"2:1: unexpected end of template, expecting endif (unclosed-block)",
+			"2:11: unexpected end of template, expecting endwith (unclosed-block)",
+		}},
+		{"unclosed-block", "{% if a %}{% endif %}{% endif %}", []string{
+			`1:25: unexpected token "endif" (syntax)`,
+		}},
+		{"duplicate-block", "{% block a %}{% endblock %}\n{% block b %}{% block a %}{% endblock %}{% endblock %}", []string{
+			"2:23: block a is already defined at line 1 (duplicate-block)",
+		}},
+		{"unused-set", "{% set x = 1 %}{% set y = 2 %}{{ y }}{% set x = 3 %}", []string{
+			"1:8: variable x is set but never used (unused-set)",
+		}},
+		{"unused-set", `{% set x = 1 %}{% include "base.html" %}`, nil},
+		{"block-not-in-base", `{% extend "base.html" %}{% block title %}{% endblock %}{% block nope %}{% endblock %}`, []string{
+			"1:65: block nope is not defined in the base templates (block-not-in-base)",
+		}},
+		{"missing-template", `{% include "base.html" %}{% include "nope.html" %}`, []string{
+			`1:37: template "nope.html" does not exist (missing-template)`,
+		}},
+		{"deprecated-tag", "{% raw %}a{% endraw %}{% verbatim %}b{% endverbatim %}", nil},
+		{"undefined-variable", "{% params a: int %}{{ a }}{{ b }}{% set c = b %}{{ c }}{{ g }}", []string{
+			"1:30: variable b is not defined (undefined-variable)",
+		}},
+		{"undefined-variable", "{{ b }}", nil},
+	}
+	for _, c := range cases {
+		l := &Linter{Root: "testdata/lint", Rules: []*LintRule{LookupLintRule(c.rule)}, Globals: []string{"g"}}
+		if got := lintStrings(l, c.code); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %q:\ngot  %q\nwant %q", c.rule, c.code, got, c.want)
+		}
+		// the other rules do not report the problem
+		var others []*LintRule
+		for _, r := range LintRules {
+			if r.Name != c.rule {
+				others = append(others, r)
+			}
+		}
+		l.Rules = others
+		for _, d := range lintStrings(l, c.code) {
+			if contains(c.want, d) && !strings.HasSuffix(d, "(syntax)") {
+				t.Errorf("%s %q: reported by another rule: %s", c.rule, c.code, d)
+			}
+		}
+	}
+}
+
+func TestLintDeprecatedTags(t *testing.T) {
+	deprecatedTags["spaceless"] = "minify"
+	defer delete(deprecatedTags, "spaceless")
+	l := &Linter{Rules: []*LintRule{LookupLintRule("deprecated-tag")}}
+	got := lintStrings(l, "a\n {% spaceless %} {% endspaceless %}{% raw %}{% endraw %}")
+	want := []string{"2:2: tag spaceless is deprecated, use minify instead (deprecated-tag)"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+// lintStrings returns the diagnostics of code linted by l, without their file.
+func lintStrings(l *Linter, code string) []string {
+	var got []string
+	for _, d := range l.Lint("t.html", []byte(code)) {
+		got = append(got, d.String()[len("t.html:"):])
+	}
+	return got
+}
@@ -0,0 +1,137 @@
+package template
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// whitespace between two tags, e.g. "</li>\n  <li>"
+	reg_between_tags = regexp.MustCompile(`>\s+<`)
+	// <!-- comment -->
+	reg_html_comment = regexp.MustCompile(`(?s)<!--.*?-->`)
+	// opening tag of an element whose content is kept as it is
+	reg_preserved_open = regexp.MustCompile(`(?i)<(pre|textarea|script)\b`)
+	// closing tags of the elements whose content is kept as it is
+	reg_preserved_close = map[string]*regexp.Regexp{
+		"pre":      regexp.MustCompile(`(?i)</pre\s*>`),
+		"textarea": regexp.MustCompile(`(?i)</textarea\s*>`),
+		"script":   regexp.MustCompile(`(?i)</script\s*>`),
+	}
+	// runs of whitespace
+	reg_whitespace_run = regexp.MustCompile(`\s+`)
+)
+
+// removeSpaces removes the whitespace between HTML tags and around the text.
+func removeSpaces(s string) string {
+	return strings.TrimSpace(reg_between_tags.ReplaceAllString(s, "><"))
+}
+
+// spaceless strips the static text of a spaceless block once. When the body
+// is all text, it is merged into a single text which can be written as it is,
+// otherwise the rendered body still has to be cleaned up at runtime.
+func spaceless(ss *SpacelessStmt) {
+	if ss.Body == nil {
+		return
+	}
+	static := true
+	eachText(ss.Body, func(t *BasicLit) {
+		t.Value = reg_between_tags.ReplaceAllString(t.Value, "><")
+	})
+	var sb strings.Builder
+	for _, st := range ss.Body.List {
+		if ts, ok := st.(*TextStmt); ok {
+			sb.WriteString(ts.Text.(*BasicLit).Value)
+		} else {
+			static = false
+		}
+	}
+	if static && len(ss.Body.List) > 0 {
+		ss.Body.List = []Stmt{&TextStmt{&BasicLit{
+			ValuePos: ss.Body.List[0].Pos(),
+			Kind:     TYPE_STRING,
+			Value:    removeSpaces(sb.String()),
+		}}}
+	}
+}
+
+// stripSpaceless strips the static text of every spaceless block of tr.
+func stripSpaceless(tr *Tree) {
+	Inspect(tr, func(n ASTNode) bool {
+		if ss, ok := n.(*SpacelessStmt); ok {
+			spaceless(ss)
+		}
+		return true
+	})
+}
+
+// isStaticSection reports whether the section is nothing but a text.
+func isStaticSection(section *SectionStmt) bool {
+	if section == nil || len(section.List) != 1 {
+		return false
+	}
+	_, ok := section.List[0].(*TextStmt)
+	return ok
+}
+
+// minify collapses the whitespace and strips the comments of the static HTML
+// of the tree. The content of pre, textarea and script elements is kept.
+func minify(tr *Tree) {
+	m := &minifier{}
+	eachText(tr, func(t *BasicLit) {
+		t.Value = m.minify(t.Value)
+	})
+}
+
+type minifier struct {
+	keep string // name of the element whose content is being kept
+}
+
+func (m *minifier) minify(s string) string {
+	var sb strings.Builder
+	for len(s) > 0 {
+		if m.keep != "" {
+			end := reg_preserved_close[m.keep].FindStringIndex(s)
+			if end == nil {
+				sb.WriteString(s)
+				break
+			}
+			sb.WriteString(s[:end[1]])
+			s = s[end[1]:]
+			m.keep = ""
+			continue
+		}
+		chunk := s
+		loc := reg_preserved_open.FindStringSubmatchIndex(s)
+		if loc != nil {
+			chunk = s[:loc[0]]
+		}
+		chunk = reg_html_comment.ReplaceAllStringFunc(chunk, func(c string) string {
+			// conditional comments are meaningful to some browsers
+			if strings.HasPrefix(c, "<!--[if") {
+				return c
+			}
+			return ""
+		})
+		sb.WriteString(reg_whitespace_run.ReplaceAllString(chunk, " "))
+		if loc == nil {
+			break
+		}
+		sb.WriteString(s[loc[0]:loc[1]])
+		m.keep = strings.ToLower(s[loc[2]:loc[3]])
+		s = s[loc[1]:]
+	}
+	return sb.String()
+}
+
+// eachText calls fn with the text of every TextStmt under node, in the
+// order of the source.
+func eachText(node ASTNode, fn func(*BasicLit)) {
+	Inspect(node, func(n ASTNode) bool {
+		if ts, ok := n.(*TextStmt); ok {
+			fn(ts.Text.(*BasicLit))
+			return false
+		}
+		return true
+	})
+}
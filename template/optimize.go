@@ -0,0 +1,173 @@
+package template
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// optimize rewrites the tree into a simpler one rendering the same output:
+// the operators applied to literals are folded into literals, the if
+// statements whose condition is constant are replaced with the branch taken,
+// and the adjacent texts are merged. Templates are output verbatim, there
+// is no escaped form of the text to precompute.
+func optimize(tr *Tree) {
+	Rewrite(tr, func(node ASTNode) ASTNode {
+		switch n := node.(type) {
+		case *UnaryExpr, *BinaryExpr:
+			return fold(n.(Expr))
+		case *IfStmt:
+			return prune(n)
+		case *SectionStmt:
+			n.List = mergeTexts(n.List)
+		case *SpacelessStmt:
+			// the body may have become all text
+			spaceless(n)
+		case *Tree:
+			n.List = mergeTexts(n.List)
+		}
+		return node
+	})
+}
+
+// fold returns the literal of the value of x when its operands are
+// literals, x otherwise. The logical operators, and the comparisons, whose
+// value is a bool, have no literal.
+func fold(x Expr) Expr {
+	v, ok := constant(x)
+	if !ok {
+		return x
+	}
+	lit := &BasicLit{ValuePos: x.Pos()}
+	switch v := v.(type) {
+	case int64:
+		lit.Kind, lit.Value = TYPE_NUMBER, strconv.FormatInt(v, 10)
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return x
+		}
+		lit.Kind, lit.Value = TYPE_NUMBER, strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(lit.Value, ".e") {
+			// keep it a float
+			lit.Value += ".0"
+		}
+	case string:
+		lit.Kind, lit.Value = TYPE_STRING, strconv.Quote(v)
+	default:
+		return x
+	}
+	return lit
+}
+
+// constant returns the value of x when it only depends on literals.
+func constant(x Expr) (any, bool) {
+	switch x := x.(type) {
+	case *BasicLit:
+		v, e := literal(x)
+		return v, e == nil
+	case *BinaryExpr:
+		a, ok := constant(x.X)
+		if !ok {
+			return nil, false
+		}
+		switch x.Op.Op {
+		case "&&", "and":
+			if !truth(a) {
+				return false, true
+			}
+		case "||", "or":
+			if truth(a) {
+				return true, true
+			}
+		}
+		b, ok := constant(x.Y)
+		if !ok {
+			return nil, false
+		}
+		switch x.Op.Op {
+		case "&&", "and", "||", "or":
+			return truth(b), true
+		}
+		v, e := binary(x.Op.Op, a, b)
+		return v, e == nil
+	case *UnaryExpr:
+		a, ok := constant(x.X)
+		if !ok {
+			return nil, false
+		}
+		v, e := unary(x.Op.Op, a)
+		return v, e == nil
+	}
+	return nil, false
+}
+
+// prune returns the branch of is taken when its condition is constant, nil
+// when there is none. The body of a branch is not a scope of its own, it is
+// merged in the enclosing list.
+func prune(is *IfStmt) ASTNode {
+	v, ok := constant(is.Cond)
+	if !ok {
+		return is
+	}
+	if truth(v) {
+		if is.Body == nil || len(is.Body.List) == 0 {
+			return nil
+		}
+		return is.Body
+	}
+	if is.Else == nil {
+		return nil
+	}
+	return is.Else
+}
+
+// mergeTexts returns list with the sections left by pruned branches merged
+// in, the comments removed and the adjacent texts merged into one. The
+// sections holding blocks are kept, since only the blocks at the top of a
+// child template override the blocks of its base.
+func mergeTexts[T ASTNode](list []T) []T {
+	var out []T
+	var text *BasicLit // last text of out; or nil
+	for _, node := range list {
+		if ss, ok := any(node).(*SectionStmt); ok && !holdsBlock(ss) {
+			for _, st := range ss.List {
+				out, text = appendStmt(out, text, any(st).(T))
+			}
+			continue
+		}
+		out, text = appendStmt(out, text, node)
+	}
+	return out
+}
+
+// appendStmt appends node to list, whose last text is text, and returns
+// the list along with its last text.
+func appendStmt[T ASTNode](list []T, text *BasicLit, node T) ([]T, *BasicLit) {
+	var value string
+	switch n := any(node).(type) {
+	case *CommentStmt:
+		return list, text
+	case *TextStmt:
+		value = n.Text.(*BasicLit).Value
+	case *RawStmt:
+		value = n.Text.(*BasicLit).Value
+	default:
+		return append(list, node), nil
+	}
+	if text != nil {
+		text.Value += value
+		return list, text
+	}
+	text = &BasicLit{ValuePos: node.Pos(), Kind: TYPE_STRING, Value: value}
+	return append(list, any(&TextStmt{Text: text}).(T)), text
+}
+
+// holdsBlock reports whether a block statement is in the list of ss.
+func holdsBlock(ss *SectionStmt) bool {
+	for _, st := range ss.List {
+		if _, ok := st.(*BlockStmt); ok {
+			return true
+		}
+	}
+	return false
+}
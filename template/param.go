@@ -5,24 +5,15 @@ type kv struct {
 	Value any
 }
 
-func KS(kvs ...kv) Params {
-	p := Params{}
+// KS builds a root scope holding the given variables.
+func KS(kvs ...*kv) *Scope {
+	s := NewScope(nil)
 	for _, kv := range kvs {
-		p[kv.Key] = kv.Value
+		s.vars[kv.Key] = kv.Value
 	}
-	return p
+	return s
 }
 
 func KV(key string, value any) *kv {
 	return &kv{Key: key, Value: value}
 }
-
-type Params map[string]any
-
-func (p Params) Set(name string, val any) string {
-	if _, ok := p[name]; ok {
-		panic("")
-	}
-	p[name] = val
-	return ""
-}
@@ -0,0 +1,136 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// checkParams checks the variables of the current scope against the
+// parameters ps declares, and defines the missing ones which have a default
+// value.
+func (s *state) checkParams(ps *ParamsStmt) error {
+	s.mark(ps)
+	for _, p := range ps.List {
+		v, ok := s.scope.Lookup(p.Name.Name)
+		if !ok {
+			if p.Default == nil {
+				return &ParamError{Name: p.Name.Name, Type: p.Type, Missing: true}
+			}
+			var e error
+			if v, e = s.evalExpr(p.Default); e != nil {
+				return e
+			}
+			if e = s.scope.Define(p.Name.Name, v); e != nil {
+				return e
+			}
+		}
+		if !matchType(p.Type, reflect.ValueOf(v)) {
+			return &ParamError{Name: p.Name.Name, Type: p.Type, Value: v}
+		}
+	}
+	return nil
+}
+
+// checkParamList returns the message of the error of the parameters list,
+// "" when there is none: a parameter is declared twice, or its default
+// value, when it is constant, is of another kind than its type.
+func checkParamList(list []*Param) string {
+	declared := map[string]bool{}
+	for _, p := range list {
+		if declared[p.Name.Name] {
+			return fmt.Sprintf("param %s is declared twice", p.Name.Name)
+		}
+		declared[p.Name.Name] = true
+		if p.Default == nil {
+			continue
+		}
+		if v, ok := constant(p.Default); ok && !matchType(p.Type, reflect.ValueOf(v)) {
+			return fmt.Sprintf("default value of param %s of type %s is %T", p.Name.Name, p.Type, v)
+		}
+	}
+	return ""
+}
+
+// matchType reports whether v is of the kind of the Go type typ. The
+// elements of slices and maps are checked too. A value of a named type
+// matches when its type, without pointers, has the same name, qualified by
+// its package if typ is.
+func matchType(typ string, v reflect.Value) bool {
+	if typ == "any" {
+		return true
+	}
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return strings.HasPrefix(typ, "*") || strings.HasPrefix(typ, "[]") || strings.HasPrefix(typ, "map[")
+	}
+	switch {
+	case strings.HasPrefix(typ, "*"):
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return true
+			}
+			v = v.Elem()
+		}
+		return matchType(typ[1:], v)
+	case strings.HasPrefix(typ, "[]"):
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return false
+		}
+		for i := 0; i < v.Len(); i++ {
+			if !matchType(typ[2:], v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case strings.HasPrefix(typ, "map["):
+		if v.Kind() != reflect.Map {
+			return false
+		}
+		key, elem := splitMapType(typ)
+		iter := v.MapRange()
+		for iter.Next() {
+			if !matchType(key, iter.Key()) || !matchType(elem, iter.Value()) {
+				return false
+			}
+		}
+		return true
+	}
+	switch typ {
+	case "string":
+		return v.Kind() == reflect.String
+	case "bool":
+		return v.Kind() == reflect.Bool
+	case "int", "int8", "int16", "int32", "int64", "rune",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr", "byte":
+		return v.CanInt() || v.CanUint()
+	case "float32", "float64":
+		return v.CanFloat() || v.CanInt() || v.CanUint()
+	}
+	t := v.Type()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if strings.Contains(typ, ".") {
+		return t.String() == typ
+	}
+	return t.Name() == typ
+}
+
+// splitMapType returns the key and element types of the map type typ.
+func splitMapType(typ string) (key, elem string) {
+	depth := 0
+	for i := len("map"); i < len(typ); i++ {
+		switch typ[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return typ[len("map["):i], typ[i+1:]
+			}
+		}
+	}
+	return typ, ""
+}
@@ -0,0 +1,108 @@
+package template
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type paramUser struct{ Name string }
+
+func TestParams(t *testing.T) {
+	data := KS(
+		KV("n", 1),
+		KV("s", "x"),
+		KV("u", &paramUser{"bob"}),
+		KV("nilUser", (*paramUser)(nil)),
+		KV("null", nil),
+		KV("list", []int{1, 2}),
+		KV("m", map[string]int{"a": 1}),
+	)
+	cases := []struct {
+		code string
+		want string // output
+		err  *ParamError
+	}{
+		{"{% params n: int, s: string %}{{ n }}{{ s }}", "1x", nil},
+		{"{% params n: float64, u: *paramUser %}{{ n }}{{ u.Name }}", "1bob", nil},
+		{"{% params u: paramUser, list: []int, m: map[string]int %}ok", "ok", nil},
+		{"{% params x: any, nilUser: *paramUser %}ok", "", &ParamError{Name: "x", Type: "any", Missing: true}},
+		{"{% params nilUser: *paramUser, list: []int %}ok", "ok", nil},
+		{"{% params x: int = 2, y: string = s %}{{ x }}{{ y }}", "2x", nil},
+		{"{% params n: int = 2 %}{{ n }}", "1", nil},
+		// the params are checked before anything is rendered
+		{"a{% params x: int %}b", "", &ParamError{Name: "x", Type: "int", Missing: true}},
+		{"{% params n: string %}", "", &ParamError{Name: "n", Type: "string", Value: 1}},
+		{"{% params s: int %}", "", &ParamError{Name: "s", Type: "int", Value: "x"}},
+		{"{% params list: []string %}", "", &ParamError{Name: "list", Type: "[]string", Value: []int{1, 2}}},
+		{"{% params m: map[string]string %}", "", &ParamError{Name: "m", Type: "map[string]string", Value: map[string]int{"a": 1}}},
+		{"{% params u: user %}", "", &ParamError{Name: "u", Type: "user", Value: &paramUser{"bob"}}},
+		{"{% params null: string %}", "", &ParamError{Name: "null", Type: "string"}},
+		{"{% params null: []int %}ok", "ok", nil},
+		{"{% params x: int = s %}", "", &ParamError{Name: "x", Type: "int", Value: "x"}},
+	}
+	for _, cfg := range []Config{{}, {Bytecode: true}} {
+		for _, c := range cases {
+			w := &strings.Builder{}
+			e := NewTemplates(&cfg).RenderString(w, c.code, data)
+			var got *ParamError
+			if e != nil && !errors.As(e, &got) {
+				t.Errorf("%q: %v", c.code, e)
+				continue
+			}
+			if w.String() != c.want || !paramErrorEqual(got, c.err) {
+				t.Errorf("%q (bytecode %v):\ngot  %q, %v\nwant %q, %v", c.code, cfg.Bytecode, w.String(), got, c.want, c.err)
+			}
+		}
+	}
+}
+
+// paramErrorEqual reports whether the param errors a and b are the same.
+func paramErrorEqual(a, b *ParamError) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Error() == b.Error() && a.Missing == b.Missing
+}
+
+func TestParamErrorString(t *testing.T) {
+	cases := []struct {
+		e    *ParamError
+		want string
+	}{
+		{&ParamError{Name: "x", Type: "int", Missing: true}, "missing param x of type int"},
+		{&ParamError{Name: "x", Type: "string"}, "param x of type string is nil"},
+		{&ParamError{Name: "x", Type: "string", Value: 1}, "param x of type string is int"},
+	}
+	for _, c := range cases {
+		if got := c.e.Error(); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	cases := []struct {
+		code string
+		want []string
+	}{
+		{"{% params x: int, y: string = \"a\" %}", nil},
+		{"{% params %}", []string{"1:1: params declares no parameter"}},
+		{"{% params x: int, x: string %}", []string{"1:1: param x is declared twice"}},
+		{"{% params x: int = \"a\" %}", []string{"1:1: default value of param x of type int is string"}},
+		{"{% params x: int %}{% params y: int %}", []string{"1:20: params must be declared once, outside of blocks"}},
+		{"{% if 1 %}{% params x: int %}{% endif %}", []string{"1:11: params must be declared once, outside of blocks"}},
+		{"{% params x int %}", []string{`1:13: unexpected token "int", expecting ":"`}},
+		{"{% params x: %}", []string{`1:14: unexpected token "%}", expecting type`}},
+		{"{% params x: int y %}", []string{`1:18: unexpected token "y", expecting "=" or ","`}},
+		{"{% params x: int, %}", nil},
+		{"{% params , x: int %}", []string{`1:11: unexpected token ",", expecting name`}},
+	}
+	for _, c := range cases {
+		if got := diagnose(c.code); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q:\ngot  %q\nwant %q", c.code, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package template
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Kinds of the tags written by the printer, which decide their indentation.
+const (
+	tagPlain  = iota // a tag on its own, e.g. set
+	tagOpen          // a tag opening a block, e.g. if
+	tagMiddle        // a tag between the sections of a block, e.g. else
+	tagClose         // a tag closing a block, e.g. endif
+	tagRawEnd        // a tag closing raw content, which is never indented
+)
+
+// A Printer writes the canonical source of a syntax tree: expressions and
+// tags are evenly spaced, strings are double quoted when it needs no escape
+// and the tags starting a line in a block are indented one level deeper
+// than the block, when their modifier strips the indentation from the
+// output. The other whitespace, which is output, is kept.
+type Printer struct {
+	Indent string // indentation of a nesting level
+}
+
+// Fprint writes the source of node to w. The source src node was parsed
+// from, if not nil, supplies the whitespace control modifiers of the tags
+// and the whitespace they trimmed.
+func (cfg *Printer) Fprint(w io.Writer, src *Source, node ASTNode) error {
+	p := &printer{Printer: cfg, src: src}
+	if src != nil {
+		p.last = Pos(1)
+	}
+	p.node(node)
+	_, e := w.Write(p.buf.Bytes())
+	return e
+}
+
+// Fprint writes the source of node to w with the default printer.
+func Fprint(w io.Writer, src *Source, node ASTNode) error {
+	return (&Printer{Indent: "    "}).Fprint(w, src, node)
+}
+
+// Format parses the template code, comments included, and returns its
+// canonical source.
+func Format(code []byte) ([]byte, error) {
+	src := NewSource(string(code))
+	lex := NewLexer()
+	lex.KeepComments = true
+	stream, e := lex.Tokenize(src)
+	if e != nil {
+		return nil, e
+	}
+	tr, e := (&TokenFilter{Tr: &Tree{}}).Filter(stream)
+	if e != nil {
+		return nil, e
+	}
+	buf := &bytes.Buffer{}
+	if e = Fprint(buf, stream.Source, tr); e != nil {
+		return nil, e
+	}
+	if !sameText(src, NewSource(buf.String())) {
+		return nil, err("Format: the formatted template renders differently")
+	}
+	return buf.Bytes(), nil
+}
+
+// sameText reports whether the templates a and b output the same text
+// around their tags.
+func sameText(a, b *Source) bool {
+	x, e := NewLexer().Tokenize(a)
+	if e != nil {
+		return false
+	}
+	y, e := NewLexer().Tokenize(b)
+	if e != nil {
+		return false
+	}
+	text := func(ts []*Token) (texts []string) {
+		for _, t := range ts {
+			if t.Type() == TYPE_TEXT || t.Type() == TYPE_RAW {
+				texts = append(texts, t.Value())
+			}
+		}
+		return texts
+	}
+	return reflect.DeepEqual(text(x.tokens), text(y.tokens))
+}
+
+type printer struct {
+	*Printer
+	src     *Source
+	buf     bytes.Buffer
+	last    Pos      // position in the source after what has been printed
+	indents []string // indentation of the lines of the enclosing blocks
+}
+
+func (p *printer) node(node ASTNode) {
+	switch n := node.(type) {
+	case *Tree:
+		extend := n.Extend
+		for _, x := range n.List {
+			if extend != nil && (!extend.Pos().IsValid() || extend.Pos() < x.Pos()) {
+				p.node(extend)
+				extend = nil
+			}
+			p.node(x)
+		}
+		if extend != nil {
+			p.node(extend)
+		}
+
+	case *SectionStmt:
+		p.section(n)
+
+	case *TextStmt:
+		lit := n.Text.(*BasicLit)
+		p.gap(lit.Pos())
+		p.buf.WriteString(lit.Value)
+		p.advance(lit.End())
+
+	case *RawStmt:
+		var open, close Pos
+		if p.src != nil && n.TagPos.IsValid() && n.EndPos.IsValid() {
+			code := p.src.Code
+			open = n.TagPos + Pos(strings.Index(code[n.TagPos-1:], TAG_BLOCK[1])+len(TAG_BLOCK[1]))
+			close = Pos(strings.LastIndex(code[:n.EndPos-1], TAG_BLOCK[0]) + 1)
+		}
+		p.tag(tagPlain, n.TagPos, open, n.Name)
+		lit := n.Text.(*BasicLit)
+		p.gap(lit.Pos())
+		p.buf.WriteString(lit.Value)
+		p.advance(lit.End())
+		p.tag(tagRawEnd, close, n.EndPos, "end"+n.Name)
+
+	case *CommentStmt:
+		p.gap(n.TagPos)
+		p.align(tagPlain, n.TagPos)
+		p.buf.WriteString(TAG_COMMENT[0] + p.modAfter(n.TagPos) + n.Text + p.modBefore(n.EndPos) + TAG_COMMENT[1])
+		p.advance(n.EndPos)
+
+	case *ValueStmt:
+		p.gap(n.TagPos)
+		p.buf.WriteString(TAG_VARIABLE[0] + p.modAfter(n.TagPos) + " " + p.expr(n.Tok) + " " + p.modBefore(n.EndPos) + TAG_VARIABLE[1])
+		p.advance(n.EndPos)
+
+	case *SetStmt:
+		p.tag(tagPlain, n.TagPos, n.EndPos, "set "+p.assign(n.Assign))
+
+	case *IncludeStmt:
+		content := "include " + p.expr(n.Ident)
+		if len(n.Params) > 0 {
+			params := make([]string, len(n.Params))
+			for i, as := range n.Params {
+				params[i] = p.assign(as)
+			}
+			content += " with " + strings.Join(params, "; ")
+		}
+		p.tag(tagPlain, n.TagPos, n.EndPos, content)
+
+	case *ExtendStmt:
+		p.tag(tagPlain, n.TagPos, n.EndPos, "extend "+p.expr(n.Ident))
+
+	case *IfStmt:
+		p.tag(tagOpen, n.TagPos, lbrace(n.Body), "if "+p.expr(n.Cond))
+		p.section(n.Body)
+		last := n
+		for last.Else != nil {
+			if es, ok := last.Else.(*IfStmt); ok {
+				p.tag(tagMiddle, rbrace(last.Body), lbrace(es.Body), "elseif "+p.expr(es.Cond))
+				p.section(es.Body)
+				last = es
+				continue
+			}
+			es := last.Else.(*SectionStmt)
+			p.tag(tagMiddle, rbrace(last.Body), es.Lbrace, "else")
+			p.section(es)
+			p.tag(tagClose, es.Rbrace, last.EndPos, "endif")
+			return
+		}
+		p.tag(tagClose, rbrace(last.Body), last.EndPos, "endif")
+
+	case *ForStmt:
+		content := "for " + p.expr(n.Cond)
+		if n.Init != nil || n.Post != nil {
+			content = "for " + p.stmt(n.Init) + "; " + p.expr(n.Cond) + "; " + p.stmt(n.Post)
+		}
+		p.block(n.TagPos, n.Body, n.EndPos, content, "endfor")
+
+	case *RangeStmt:
+		content := "range " + p.expr(n.Key)
+		if n.Value != nil {
+			content += ", " + p.expr(n.Value)
+		}
+		p.block(n.TagPos, n.Body, n.EndPos, content+" = "+p.expr(n.X), "endrange")
+
+	case *BlockStmt:
+		p.block(n.TagPos, n.Body, n.EndPos, "block "+n.Name.Name, "endblock")
+
+	case *WithStmt:
+		content := "with"
+		if len(n.Params) > 0 {
+			params := make([]string, len(n.Params))
+			for i, as := range n.Params {
+				params[i] = hashKey(as.Lh.(*Ident).Name) + ": " + p.expr(as.Rh)
+			}
+			content += " {" + strings.Join(params, ", ") + "}"
+		} else if n.X != nil {
+			content += " " + p.expr(n.X)
+		}
+		if n.Only {
+			content += " only"
+		}
+		p.block(n.TagPos, n.Body, n.EndPos, content, "endwith")
+
+	case *SpacelessStmt:
+		p.block(n.TagPos, n.Body, n.EndPos, "spaceless", "endspaceless")
+
+	case *SandboxStmt:
+		p.block(n.TagPos, n.Body, n.EndPos, "sandbox", "endsandbox")
+
+	case *ParamsStmt:
+		params := make([]string, len(n.List))
+		for i, param := range n.List {
+			params[i] = param.Name.Name + ": " + param.Type
+			if param.Default != nil {
+				params[i] += " = " + p.expr(param.Default)
+			}
+		}
+		p.tag(tagPlain, n.TagPos, n.EndPos, "params "+strings.Join(params, ", "))
+
+	case *AssignStmt:
+		p.buf.WriteString(p.assign(n))
+
+	case Expr:
+		p.buf.WriteString(p.expr(n))
+	}
+}
+
+func (p *printer) section(section *SectionStmt) {
+	if section == nil {
+		return
+	}
+	for _, st := range section.List {
+		p.node(st)
+	}
+}
+
+// block prints a block statement with a single section.
+func (p *printer) block(tag Pos, body *SectionStmt, end Pos, open, close string) {
+	p.tag(tagOpen, tag, lbrace(body), open)
+	p.section(body)
+	p.tag(tagClose, rbrace(body), end, close)
+}
+
+// tag prints the block tag with content found between start and end in the
+// source.
+func (p *printer) tag(kind int, start, end Pos, content string) {
+	p.gap(start)
+	p.align(kind, start)
+	p.buf.WriteString(TAG_BLOCK[0] + p.modAfter(start) + " " + content + " " + p.modBefore(end) + TAG_BLOCK[1])
+	switch kind {
+	case tagOpen:
+		p.indents = append(p.indents, p.lineIndent())
+	case tagClose:
+		if len(p.indents) > 0 {
+			p.indents = p.indents[:len(p.indents)-1]
+		}
+	}
+	p.advance(end)
+}
+
+// gap prints the whitespace of the source between what has been printed
+// and pos, which was trimmed by a whitespace control modifier.
+func (p *printer) gap(pos Pos) {
+	if p.src == nil || !p.last.IsValid() || !pos.IsValid() || pos <= p.last {
+		return
+	}
+	if gap := p.src.Code[p.last-1 : pos-1]; strings.TrimSpace(gap) == "" {
+		p.buf.WriteString(gap)
+	}
+}
+
+func (p *printer) advance(end Pos) {
+	if end.IsValid() {
+		p.last = end
+	}
+}
+
+// align indents a tag of kind at pos starting a line in a block, when its
+// modifier strips the indentation from the output.
+func (p *printer) align(kind int, pos Pos) {
+	if len(p.indents) == 0 || kind == tagRawEnd || p.modAfter(pos) == "" {
+		return
+	}
+	b := p.buf.Bytes()
+	start := bytes.LastIndexByte(b, '\n') + 1
+	if len(bytes.TrimLeft(b[start:], " \t")) > 0 {
+		return
+	}
+	p.buf.Truncate(start)
+	p.buf.WriteString(p.indents[len(p.indents)-1])
+	if kind == tagPlain || kind == tagOpen {
+		p.buf.WriteString(p.Indent)
+	}
+}
+
+// lineIndent returns the indentation of the line being printed.
+func (p *printer) lineIndent() string {
+	b := p.buf.Bytes()
+	line := b[bytes.LastIndexByte(b, '\n')+1:]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// modAfter returns the modifier following the opening delimiter at pos.
+func (p *printer) modAfter(pos Pos) string {
+	if !pos.IsValid() {
+		return ""
+	}
+	return p.modifier(int(pos) - 1 + 2)
+}
+
+// modBefore returns the modifier preceding the closing delimiter ending
+// at end.
+func (p *printer) modBefore(end Pos) string {
+	if !end.IsValid() {
+		return ""
+	}
+	return p.modifier(int(end) - 1 - 3)
+}
+
+func (p *printer) modifier(offset int) string {
+	if p.src == nil || offset < 0 || offset >= len(p.src.Code) {
+		return ""
+	}
+	if m := rune(p.src.Code[offset]); m == MODIFIER_TRIM || m == MODIFIER_TRIM_LINE {
+		return string(m)
+	}
+	return ""
+}
+
+func (p *printer) stmt(s Stmt) string {
+	if as, ok := s.(*AssignStmt); ok {
+		return p.assign(as)
+	}
+	return ""
+}
+
+func (p *printer) assign(as *AssignStmt) string {
+	if as == nil {
+		return ""
+	}
+	if as.Rh == nil {
+		return p.expr(as.Lh) + as.Tok
+	}
+	return p.expr(as.Lh) + " " + as.Tok + " " + p.expr(as.Rh)
+}
+
+func (p *printer) expr(x Expr) string {
+	return p.operand(x, 0)
+}
+
+// operand prints x as the operand of an operator of priority prec.
+func (p *printer) operand(x Expr, prec int) string {
+	switch n := x.(type) {
+	case *BadExpr:
+		if p.src != nil && n.From.IsValid() && n.To >= n.From {
+			return p.src.Code[n.From-1 : n.To-1]
+		}
+		return ""
+	case *Ident:
+		return n.Name
+	case *BasicLit:
+		if n.Kind == TYPE_STRING {
+			return quote(n.Value)
+		}
+		return n.Value
+	case *IndexExpr:
+		return p.operand(n.X, postfixPrec) + "[" + p.expr(n.Index) + "]"
+	case *SelectorExpr:
+		return p.operand(n.X, postfixPrec) + "." + n.Sel.Name
+	case *CallExpr:
+		if n.Pipe.IsValid() {
+			s := p.operand(n.Args.List[0], postfixPrec) + " | " + p.expr(n.Fun)
+			if n.Lparen.IsValid() {
+				s += "(" + p.expr(&ArgsExpr{List: n.Args.List[1:]}) + ")"
+			}
+			return s
+		}
+		args := ""
+		if n.Args != nil {
+			args = p.expr(n.Args)
+		}
+		return p.expr(n.Fun) + "(" + args + ")"
+	case *ArgsExpr:
+		list := make([]string, len(n.List))
+		for i, x := range n.List {
+			list[i] = p.expr(x)
+		}
+		return strings.Join(list, ", ")
+	case *UnaryExpr:
+		if n.Op.Op == "not" {
+			x := p.operand(n.X, notPrec)
+			if y, ok := n.X.(*UnaryExpr); ok && y.Op.Op == "not" {
+				x = p.operand(n.X, 0)
+			}
+			// not a == b is not (a == b)
+			if notPrec <= prec {
+				return "(not " + x + ")"
+			}
+			return "not " + x
+		}
+		s, x := n.Op.Op, p.operand(n.X, unaryPrec)
+		if strings.IndexAny(x[:1], "+-!") >= 0 {
+			// - -x is not --x
+			s += " "
+		}
+		s += x
+		if unaryPrec < prec {
+			return "(" + s + ")"
+		}
+		return s
+	case *BinaryExpr:
+		op := binaryPrec[n.Op.Op]
+		y := p.operand(n.Y, op+1)
+		if u, ok := n.Y.(*UnaryExpr); ok && u.Op.Op == "not" && op < notPrec {
+			// no operator binding tighter follows a and not b
+			y = p.operand(n.Y, op)
+		}
+		s := p.operand(n.X, op) + " " + n.Op.Op + " " + y
+		if op < prec {
+			return "(" + s + ")"
+		}
+		return s
+	case *TestExpr:
+		op := binaryPrec["is"]
+		s := p.operand(n.X, op) + " is "
+		if n.Not {
+			s += "not "
+		}
+		s += n.Name.Name
+		if n.Args != nil {
+			s += "(" + p.expr(n.Args) + ")"
+		}
+		if op < prec {
+			return "(" + s + ")"
+		}
+		return s
+	}
+	return ""
+}
+
+func lbrace(section *SectionStmt) Pos {
+	if section == nil {
+		return NoPos
+	}
+	return section.Lbrace
+}
+
+func rbrace(section *SectionStmt) Pos {
+	if section == nil {
+		return NoPos
+	}
+	return section.Rbrace
+}
+
+// quote double quotes a single quoted string literal unless it would need
+// an escape.
+func quote(lit string) string {
+	if len(lit) < 2 || lit[0] != '\'' || strings.ContainsAny(lit[1:len(lit)-1], `"\`) {
+		return lit
+	}
+	return `"` + lit[1:len(lit)-1] + `"`
+}
+
+// hashKey returns the key of a hash item, quoted when it is not a name.
+func hashKey(key string) string {
+	if isName(key) {
+		return key
+	}
+	return `"` + strings.ReplaceAll(key, `"`, `\"`) + `"`
+}
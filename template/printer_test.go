@@ -0,0 +1,76 @@
+package template
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFormat checks the formatting of the templates of testdata/fmt against
+// their golden file, and that formatting is idempotent.
+func TestFormat(t *testing.T) {
+	inputs, e := filepath.Glob("testdata/fmt/*.input")
+	if e != nil || len(inputs) == 0 {
+		t.Fatal("no input", e)
+	}
+	for _, input := range inputs {
+		src, e := os.ReadFile(input)
+		if e != nil {
+			t.Fatal(e)
+		}
+		want, e := os.ReadFile(strings.TrimSuffix(input, ".input") + ".golden")
+		if e != nil {
+			t.Fatal(e)
+		}
+		got, e := Format(src)
+		if e != nil {
+			t.Errorf("%s: %v", input, e)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s:\ngot\n%s\nwant\n%s", input, got, want)
+		}
+		testFormatTwice(t, input, got)
+	}
+	for _, path := range append(corpus, "testdata/inc.html", "testdata/part.html") {
+		src, e := os.ReadFile(path)
+		if e != nil {
+			t.Fatal(e)
+		}
+		got, e := Format(src)
+		if e != nil {
+			t.Errorf("%s: %v", path, e)
+			continue
+		}
+		testFormatTwice(t, path, got)
+	}
+}
+
+// testFormatTwice checks that the formatted source src is left unchanged by
+// Format.
+func testFormatTwice(t *testing.T, name string, src []byte) {
+	t.Helper()
+	again, e := Format(src)
+	if e != nil {
+		t.Errorf("%s formatted twice: %v", name, e)
+	} else if !bytes.Equal(again, src) {
+		t.Errorf("%s formatted twice:\ngot\n%s\nwant\n%s", name, again, src)
+	}
+}
+
+func TestFormatComments(t *testing.T) {
+	// the comments are kept verbatim, whatever their modifiers
+	for _, code := range []string{
+		"{#  a  #}",
+		"a {#- b -#} c",
+		"{# {{ x }} {% if %} #}",
+		"{#\n\tline\n#}\n",
+	} {
+		got, e := Format([]byte(code))
+		if e != nil || string(got) != code {
+			t.Errorf("%q: got %q, %v", code, got, e)
+		}
+	}
+}
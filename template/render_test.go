@@ -0,0 +1,178 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+// corpus are the templates of testdata rendered by the tests and the
+// benchmarks, whatever the configuration of the templates.
+var corpus = []string{
+	"testdata/all.html",
+	"testdata/base.html",
+	"testdata/child.html",
+	"testdata/fold.html",
+	"testdata/loop.html",
+	"testdata/scope.html",
+	"testdata/space.html",
+}
+
+// corpusCases are inline templates of the corpus, most of them failing.
+var corpusCases = []string{
+	"{{ undefined }}",
+	"{{ nofn(1) }}",
+	"{% range x = user %}{% endrange %}",
+	"{% with list %}{% endwith %}",
+	"{{ list[9] }}",
+	"{{ boom() }}",
+	"{% for i = 0; i < 100; i++ %}x{% endfor %}",
+	`a{% include "testdata/nope.html" %}`,
+	`{{ 1 - "a" }}`,
+	"{% range v = list %}{% range i = 50 %}{{ i }}{% endrange %}{% endrange %}",
+	"{{ user.Nope }}",
+	`{% sandbox %}{% include "testdata/part.html" %}{% endsandbox %}`,
+	// the tags pruned by the optimizer are denied all the same
+	`{% sandbox %}{% include "testdata/sandbox.html" %}{% endsandbox %}`,
+	"{% block b %}{{ undefinedInBlock }}{% endblock %}",
+	"{% spaceless %}<a> {{ undefined2 }} </a>{% endspaceless %}",
+	// constant expressions failing at render time, even when they are folded
+	"a{{ 1 / 0 }}",
+	"a{{ 1 % 0 }}",
+	"a{{ 1 << -1 }}",
+	"a{% set x = 2 / (1 - 1) %}",
+	`a{{ 1 - "a" }}`,
+	"a{% if 1 %}{{ 1 / 0 }}{% endif %}",
+}
+
+// corpusLimits are the limits the corpus is also rendered with.
+var corpusLimits = []Limits{
+	{MaxSteps: 1},
+	{MaxSteps: 17},
+	{MaxIterations: 2},
+	{MaxDepth: 1},
+	{MaxOutput: 5},
+	{MaxOutput: 40},
+}
+
+type corpusUser struct{ Name string }
+
+func (u *corpusUser) Hello(s string) string { return "hello " + s + " " + u.Name }
+
+func corpusData() *Scope {
+	return KS(
+		KV("user", &corpusUser{"bob"}),
+		KV("list", []string{"x", "y"}),
+		KV("m", map[string]int{"b": 2, "a": 1, "c": 3}),
+		KV("add", func(a, b int) int { return a + b }),
+		KV("title", "T"),
+		KV("nothing", nil),
+	)
+}
+
+// corpusRender renders the template of path, or the code of the case when
+// path is "", by templates configured by cfg, and returns its output
+// followed by its error.
+func corpusRender(cfg Config, path, code string) string {
+	ts := NewTemplates(&cfg)
+	ts.AddGlobal("boom", func() int { panic("boom") })
+	w := &bytes.Buffer{}
+	var e error
+	if path != "" {
+		e = ts.Render(w, path, corpusData())
+	} else {
+		e = ts.RenderString(w, code, corpusData())
+	}
+	if e != nil {
+		fmt.Fprintf(w, "\nerror: %v", e)
+	}
+	return w.String()
+}
+
+// testCorpus checks that the corpus is rendered the same, without limits and
+// with each of limits, by the templates configured by cfg and by the
+// templates walking the syntax trees.
+func testCorpus(t *testing.T, cfg Config, limits []Limits) {
+	check := func(name string, limits Limits, path, code string) {
+		ref, c := Config{Limits: limits}, cfg
+		c.Limits = limits
+		want, got := corpusRender(ref, path, code), corpusRender(c, path, code)
+		if got != want {
+			t.Errorf("%s, limits %+v:\ngot  %q\nwant %q", name, limits, got, want)
+		}
+	}
+	for _, path := range corpus {
+		check(path, Limits{}, path, "")
+		for _, l := range limits {
+			check(path, l, path, "")
+		}
+	}
+	for _, code := range corpusCases {
+		check(code, Limits{MaxIterations: 60}, "", code)
+		check(code, Limits{MaxDepth: 1}, "", code)
+	}
+}
+
+func TestBytecode(t *testing.T) {
+	testCorpus(t, Config{Bytecode: true}, corpusLimits)
+}
+
+func TestOptimize(t *testing.T) {
+	// the optimized trees execute fewer statements, the texts being merged
+	// and the dead branches pruned, so they are not compared under a limit
+	// of statements
+	var limits []Limits
+	for _, l := range corpusLimits {
+		if l.MaxSteps == 0 {
+			limits = append(limits, l)
+		}
+	}
+	testCorpus(t, Config{Optimize: true}, limits)
+	testCorpus(t, Config{Optimize: true, Bytecode: true}, limits)
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, path := range corpus {
+		code, e := os.ReadFile(path)
+		if e != nil {
+			b.Fatal(e)
+		}
+		b.Run(path, func(b *testing.B) {
+			b.SetBytes(int64(len(code)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if e := EmptyTemplate().ParseString(string(code)); e != nil {
+					b.Fatal(e)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	configs := []struct {
+		name string
+		cfg  Config
+	}{
+		{"tree", Config{}},
+		{"bytecode", Config{Bytecode: true}},
+		{"optimized", Config{Optimize: true}},
+		{"optimized+bytecode", Config{Optimize: true, Bytecode: true}},
+	}
+	for _, path := range corpus {
+		for _, c := range configs {
+			ts := NewTemplates(&c.cfg)
+			if e := ts.Render(io.Discard, path, corpusData()); e != nil {
+				b.Fatal(e)
+			}
+			b.Run(path+"/"+c.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					ts.Render(io.Discard, path, corpusData())
+				}
+			})
+		}
+	}
+}
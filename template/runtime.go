@@ -0,0 +1,115 @@
+package template
+
+import (
+	"context"
+	"reflect"
+)
+
+// The functions of this file are called by the code generated by
+// Generator, to evaluate what is only known when templates are rendered.
+
+// genState is the state the generated code evaluates its values in: no
+// security policy applies, and functions are passed a background context.
+var genState = &state{ctx: context.Background(), ts: defaultTemplates}
+
+// Property returns the field, the map entry or the result of the method
+// without arguments named name of v.
+func Property(v any, name string) (any, error) {
+	return genState.property(v, name)
+}
+
+// Index returns the element of v at idx.
+func Index(v, idx any) (any, error) {
+	return index(v, idx)
+}
+
+// Binary returns the result of the arithmetic or comparison operator op
+// applied to x and y.
+func Binary(op string, x, y any) (any, error) {
+	return binary(op, x, y)
+}
+
+// Unary returns the result of the unary operator op applied to x.
+func Unary(op string, x any) (any, error) {
+	return unary(op, x)
+}
+
+// ApplyTest applies the test name, builtin or added with AddTest, to v with
+// args.
+func ApplyTest(name string, v any, args ...any) (bool, error) {
+	return genState.test(name, v, args)
+}
+
+// HasProperty reports whether v has the property name, e.g. not a missing
+// key of a map.
+func HasProperty(v any, name string) bool {
+	return genState.has(v, name, true)
+}
+
+// HasIndex reports whether v has the element idx.
+func HasIndex(v, idx any) bool {
+	return genState.has(v, idx, false)
+}
+
+// Truth reports whether v is true, i.e. not the zero value of its type.
+func Truth(v any) bool {
+	return truth(v)
+}
+
+// IsZero reports whether v is nil or the zero value of its type.
+func IsZero(v any) bool {
+	return v == nil || reflect.ValueOf(v).IsZero()
+}
+
+// Call calls the function fn named name with args.
+func Call(name string, fn any, args ...any) (any, error) {
+	return genState.call(name, reflect.ValueOf(fn), args)
+}
+
+// CallMethod calls the method name of recv with args.
+func CallMethod(recv any, name string, args ...any) (any, error) {
+	fn := method(reflect.ValueOf(recv), name)
+	if !fn.IsValid() {
+		return nil, err("CallMethod: %T has no method %s", recv, name)
+	}
+	return genState.call(name, fn, args)
+}
+
+// An Iterator steps through the keys and values of a value ranged over,
+// in the order of the range statements.
+type Iterator struct {
+	it   iterator
+	k, v any
+}
+
+// Iterate returns the iterator of x, which is empty when x is nil.
+func Iterate(x any) (*Iterator, error) {
+	it, e := newIterator(x)
+	if e != nil {
+		return nil, e
+	}
+	return &Iterator{it: it}, nil
+}
+
+// Next advances to the next key and value, and reports whether there is one.
+func (it *Iterator) Next() bool {
+	var ok bool
+	it.k, it.v, ok = it.it.next()
+	return ok
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() any {
+	return it.k
+}
+
+// Value returns the current value.
+func (it *Iterator) Value() any {
+	return it.v
+}
+
+// RemoveSpaces removes the whitespace between the HTML tags of s, like
+// the spaceless tag.
+func RemoveSpaces(s string) string {
+	return removeSpaces(s)
+}
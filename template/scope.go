@@ -0,0 +1,105 @@
+package template
+
+import "sort"
+
+// A Scope holds the variables visible at some point of a template and
+// links to the scope it is nested in.
+//
+// Reading a variable walks up the chain, so inner scopes shadow the outer
+// ones. Defining a variable always happens in the scope itself, while
+// assigning one updates the nearest scope that already defines it. An
+// isolated scope, as created by Fork for includes, is copy-on-write:
+// assignments never reach past it. A read-only scope, such as the engine
+// globals, can not be changed from templates at all.
+type Scope struct {
+	parent   *Scope
+	vars     map[string]any
+	readonly bool
+	isolated bool
+}
+
+// NewScope creates an empty scope nested in parent, which may be nil.
+func NewScope(parent *Scope) *Scope {
+	return &Scope{parent: parent, vars: make(map[string]any)}
+}
+
+// Parent returns the scope s is nested in, or nil.
+func (s *Scope) Parent() *Scope {
+	return s.parent
+}
+
+// Push returns a new scope nested in s.
+func (s *Scope) Push() *Scope {
+	return NewScope(s)
+}
+
+// Fork returns a new copy-on-write scope nested in s: it reads the variables
+// of s, but assignments made in it or its children stay in it.
+func (s *Scope) Fork() *Scope {
+	c := NewScope(s)
+	c.isolated = true
+	return c
+}
+
+// Lookup returns the value of the variable name, searching the whole chain.
+func (s *Scope) Lookup(name string) (any, bool) {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Local returns the value of the variable name defined in s itself.
+func (s *Scope) Local(name string) (any, bool) {
+	v, ok := s.vars[name]
+	return v, ok
+}
+
+// Define defines the variable name in s, shadowing any outer variable of the
+// same name.
+func (s *Scope) Define(name string, value any) error {
+	if s.readonly {
+		return err("Define: variable %s can not be defined in a read-only scope", name)
+	}
+	s.vars[name] = value
+	return nil
+}
+
+// Set assigns value to the variable name. The nearest scope defining name is
+// updated, unless it is beyond an isolated scope; otherwise the variable is
+// defined in s.
+func (s *Scope) Set(name string, value any) error {
+	crossed := false
+	for c := s; c != nil; c = c.parent {
+		if _, ok := c.vars[name]; ok {
+			if c.readonly {
+				return err("Set: variable %s is read-only", name)
+			}
+			if !crossed {
+				c.vars[name] = value
+				return nil
+			}
+			break
+		}
+		crossed = crossed || c.isolated
+	}
+	return s.Define(name, value)
+}
+
+// Names returns the sorted names of all the variables visible from s.
+func (s *Scope) Names() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for c := s; c != nil; c = c.parent {
+		for name := range c.vars {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
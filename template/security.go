@@ -0,0 +1,114 @@
+package template
+
+import (
+	"reflect"
+	"strings"
+)
+
+// A SecurityPolicy lists what sandboxed templates may use, anything else is
+// denied. Types are named as printed by reflect without their pointers,
+// e.g. "main.User".
+type SecurityPolicy struct {
+	Tags      []string            // block tags, which allows their middle and end tags
+	Functions []string            // functions called by name
+	Filters   []string            // functions applied as filters, e.g. upper for x | upper
+	Fields    map[string][]string // struct fields by type
+	Methods   map[string][]string // methods by type
+}
+
+// Check returns the first tag, function or filter of the template tr of src
+// the policy denies, as a SecurityError, nil if there is none. The fields and
+// methods, and the values printed, are checked when the template is executed.
+func (p *SecurityPolicy) Check(src *Source, tr *Tree) error {
+	var e error
+	Inspect(tr, func(n ASTNode) bool {
+		if e != nil {
+			return false
+		}
+		if tag := tagName(n); tag != "" && !contains(p.Tags, tag) {
+			e = &SecurityError{Source: src, Pos: n.Pos(), Kind: "tag", Name: tag}
+		} else if call, ok := n.(*CallExpr); ok {
+			// the methods are checked like the fields
+			id, ok := call.Fun.(*Ident)
+			if !ok || strings.Contains(id.Name, ".") {
+				return true
+			}
+			if call.Pipe.IsValid() && !contains(p.Filters, id.Name) {
+				e = &SecurityError{Source: src, Pos: id.Pos(), Kind: "filter", Name: id.Name}
+			} else if !call.Pipe.IsValid() && !contains(p.Functions, id.Name) {
+				e = &SecurityError{Source: src, Pos: call.Pos(), Kind: "function", Name: id.Name}
+			}
+		}
+		return e == nil
+	})
+	return e
+}
+
+// allowsFunction reports whether the function name may be called.
+func (p *SecurityPolicy) allowsFunction(name string) bool {
+	return contains(p.Functions, name)
+}
+
+// allowsFilter reports whether the function name may be applied as a filter.
+func (p *SecurityPolicy) allowsFilter(name string) bool {
+	return contains(p.Filters, name)
+}
+
+// allowsField reports whether the field name of the values of typ may
+// be read.
+func (p *SecurityPolicy) allowsField(typ reflect.Type, name string) bool {
+	return contains(p.Fields[typeName(typ)], name)
+}
+
+// allowsMethod reports whether the method name of the values of typ may
+// be called.
+func (p *SecurityPolicy) allowsMethod(typ reflect.Type, name string) bool {
+	return contains(p.Methods[typeName(typ)], name)
+}
+
+// tagName returns the name of the block tag of the statement n, "" if n is
+// not one.
+func tagName(n ASTNode) string {
+	switch n := n.(type) {
+	case *IfStmt:
+		return "if"
+	case *ForStmt:
+		return "for"
+	case *RangeStmt:
+		return "range"
+	case *BlockStmt:
+		return "block"
+	case *SetStmt:
+		return "set"
+	case *IncludeStmt:
+		return "include"
+	case *ExtendStmt:
+		return "extend"
+	case *WithStmt:
+		return "with"
+	case *SpacelessStmt:
+		return "spaceless"
+	case *SandboxStmt:
+		return "sandbox"
+	case *RawStmt:
+		return n.Name
+	}
+	return ""
+}
+
+// typeName returns the name of typ without its pointers.
+func typeName(typ reflect.Type) string {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	return typ.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
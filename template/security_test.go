@@ -0,0 +1,100 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type secUser struct {
+	Name   string
+	Secret string
+}
+
+func (u *secUser) Hello() string  { return "hello " + u.Name }
+func (u *secUser) Delete() string { return "deleted" }
+
+type secStringer struct{}
+
+func (secStringer) String() string { return "stringer" }
+
+var secPolicy = &SecurityPolicy{
+	Tags:      []string{"if", "for"},
+	Functions: []string{"add"},
+	Filters:   []string{"upper"},
+	Fields:    map[string][]string{"template.secUser": {"Name"}},
+	Methods:   map[string][]string{"template.secUser": {"Hello"}},
+}
+
+func TestSecurityPolicy(t *testing.T) {
+	cases := []struct {
+		code       string
+		want       string // output
+		kind, name string // of the security error; or ""
+	}{
+		{`{% if 1 %}{{ add(1, 2) }} {{ "a" | upper }} {{ u.Name }} {{ u.Hello() }}{% endif %}`, "3 A bob hello bob", "", ""},
+		{"{% for i = 0; i < 2; i++ %}{{ i }}{% endfor %}", "01", "", ""},
+		{"{% set x = 1 %}", "", "tag", "set"},
+		{"{% with {a: 1} %}{% endwith %}", "", "tag", "with"},
+		{"{% verbatim %}x{% endverbatim %}", "", "tag", "verbatim"},
+		{"{% raw %}x{% endraw %}", "", "tag", "raw"},
+		{"{% if 1 %}{% spaceless %}{% endspaceless %}{% endif %}", "", "tag", "spaceless"},
+		{"a{{ sub(1, 2) }}", "", "function", "sub"},
+		{`a{{ "a" | lower }}`, "", "filter", "lower"},
+		// an allowed function is not an allowed filter, and the reverse
+		{"a{{ 1 | add(2) }}", "", "filter", "add"},
+		{`a{{ upper("a") }}`, "", "function", "upper"},
+		{"a{{ u.Secret }}b", "a", "field", "Secret"},
+		{"a{{ u.Delete() }}b", "a", "method", "Delete"},
+		{"a{{ u }}b", "a", "print", "template.secUser"},
+		{"a{{ list }}b", "a", "print", "[]int"},
+		{"a{{ s }}b", "a", "method", "String"},
+		{"a{{ list[1] }}", "a2", "", ""},
+	}
+	for _, cfg := range []Config{{}, {Bytecode: true}, {Optimize: true}} {
+		cfg.Sandboxed, cfg.Policy = true, secPolicy
+		for _, c := range cases {
+			ts := NewTemplates(&cfg)
+			ts.AddGlobal("add", func(a, b int) int { return a + b })
+			ts.AddGlobal("sub", func(a, b int) int { return a - b })
+			ts.AddGlobal("upper", strings.ToUpper)
+			ts.AddGlobal("lower", strings.ToLower)
+			w := &strings.Builder{}
+			e := ts.RenderString(w, c.code, KS(
+				KV("u", &secUser{"bob", "pw"}),
+				KV("list", []int{1, 2}),
+				KV("s", secStringer{}),
+			))
+			var se *SecurityError
+			got := ""
+			if errors.As(e, &se) {
+				got = se.Kind + " " + se.Name
+			} else if e != nil {
+				t.Errorf("%+v %q: got error %v", cfg, c.code, e)
+				continue
+			}
+			if want := strings.TrimSpace(c.kind + " " + c.name); got != want || w.String() != c.want {
+				t.Errorf("%+v %q:\ngot  %q, error %q\nwant %q, error %q", cfg, c.code, w.String(), got, c.want, want)
+			}
+		}
+	}
+}
+
+func TestSandboxTag(t *testing.T) {
+	for _, cfg := range []Config{{}, {Bytecode: true}, {Optimize: true}} {
+		cfg.Policy = secPolicy
+		ts := NewTemplates(&cfg)
+		// the templates outside the sandbox tag are not checked
+		w := &strings.Builder{}
+		e := ts.RenderString(w, `{% set x = 1 %}{{ x }}{% sandbox %}{% include "testdata/sandbox.html" %}{% endsandbox %}`)
+		var se *SecurityError
+		if !errors.As(e, &se) || se.Kind != "tag" || se.Name != "verbatim" || w.String() != "1" {
+			t.Errorf("%+v: got %q, %v", cfg, w.String(), e)
+		}
+		if !strings.HasPrefix(fmt.Sprint(se), "testdata/sandbox.html:1:") {
+			t.Errorf("%+v: got error %v, want it located in the included template", cfg, se)
+		}
+	}
+}
@@ -3,12 +3,59 @@ package template
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
 type Source struct {
 	Identity string
 	Code     string
+	lines    []int // offsets of the first byte of each line
+}
+
+// Position describes a location in the source of a template.
+type Position struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // byte column number, starting at 1
+}
+
+// IsValid reports whether the position is valid.
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Position returns the line and column of p in the source.
+func (s *Source) Position(p Pos) Position {
+	if !p.IsValid() || int(p)-1 > len(s.Code) {
+		return Position{}
+	}
+	lines := s.lines
+	if lines == nil {
+		lines = lineStarts(s.Code)
+	}
+	offset := int(p) - 1
+	i := sort.Search(len(lines), func(i int) bool { return lines[i] > offset }) - 1
+	return Position{Offset: offset, Line: i + 1, Column: offset - lines[i] + 1}
+}
+
+func lineStarts(code string) []int {
+	lines := []int{0}
+	for i := 0; i < len(code); i++ {
+		if code[i] == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
 }
 
 type Line struct {
@@ -17,29 +64,39 @@ type Line struct {
 	Highlight bool
 }
 
-//Overview returns nearby code
-func (s *Source) Overview(line int) (codes []*Line) {
-	pos := reg_enter.FindAllStringIndex(s.Code, -1)
-	len := len(pos)
-	if line < 0 {
-		return nil
+// Overview returns the code of the lines around line, which is highlighted.
+func (s *Source) Overview(line int) []*Line {
+	return s.around(line, 5)
+}
+
+// around returns the code of line, which is highlighted, and of the n
+// lines before and after it.
+func (s *Source) around(line, n int) (codes []*Line) {
+	lines := s.lines
+	if lines == nil {
+		lines = lineStarts(s.Code)
 	}
-	if len < line || len == 0 {
+	if line < 1 || line > len(lines) {
 		return nil
 	}
-	var (
-		startLine, endLine int
-	)
-	endLine = line + 5
-	if endLine > len {
-		endLine = len
+	from, to := line-n, line+n
+	if from < 1 {
+		from = 1
+	}
+	if to > len(lines) {
+		to = len(lines)
 	}
-	startLine = line - 5
-	if startLine < 1 {
-		startLine = 1
+	if to > line && lines[to-1] == len(s.Code) {
+		// the empty line following the final newline
+		to--
 	}
-	for i := startLine; i < endLine; i++ {
-		codes = append(codes, &Line{Num: i, Code: s.Code[pos[i-1][1]:pos[i][0]], Highlight: i == line})
+	for i := from; i <= to; i++ {
+		end := len(s.Code)
+		if i < len(lines) {
+			end = lines[i] - 1
+		}
+		code := strings.TrimSuffix(s.Code[lines[i-1]:end], "\r")
+		codes = append(codes, &Line{Num: i, Code: code, Highlight: i == line})
 	}
 	return
 }
@@ -48,12 +105,12 @@ func NewSource(code string) *Source {
 	return &Source{Code: code, Identity: abstract([]byte(code))}
 }
 
-func NewSourceFile(path string) *Source {
+func NewSourceFile(path string) (*Source, error) {
 	bs, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, errors.WithStack(err)
 	}
-	return &Source{Code: string(bs), Identity: path}
+	return &Source{Code: string(bs), Identity: path}, nil
 }
 
 func abstract(content []byte) string {
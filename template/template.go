@@ -1,7 +1,7 @@
 package template
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -12,11 +12,7 @@ import (
 )
 
 var (
-	defaultTemplates = &Templates{
-		Cache:  make(map[string]*Template),
-		Lock:   &sync.RWMutex{},
-		Update: make(chan *Template, 20),
-	}
+	defaultTemplates = NewTemplates(&Config{})
 )
 
 const (
@@ -25,12 +21,68 @@ const (
 )
 
 type Config struct {
+	// TrimBlocks removes the first newline after a block or comment tag.
+	TrimBlocks bool
+	// LstripBlocks strips the spaces and tabs from the start of a line to a
+	// block or comment tag.
+	LstripBlocks bool
+	// Minify collapses the whitespace and strips the comments of the HTML
+	// text of templates when they are parsed.
+	Minify bool
+	// Repanic lets the panics of the functions and methods called by
+	// templates go through, to debug them, instead of returning them as
+	// runtime errors.
+	Repanic bool
+	// ContextVar is the name of the variable through which the templates
+	// rendered with a context read its values, e.g. {{ ctx.user }}; "ctx"
+	// when empty.
+	ContextVar string
+	// ContextValue returns the value of ctx named name. The value of the key
+	// name is returned when it is nil.
+	ContextValue func(ctx context.Context, name string) any
+	// Policy is the security policy of the sandboxed templates; nothing is
+	// allowed when it is nil.
+	Policy *SecurityPolicy
+	// Sandboxed applies the security policy to every template, instead of
+	// the templates included in a sandbox tag only.
+	Sandboxed bool
+	// Limits bound the resources used by each rendering.
+	Limits Limits
+	// Bytecode compiles the templates to bytecode run by a stack machine,
+	// instead of walking their syntax trees. The output is the same.
+	Bytecode bool
+	// Optimize folds the constant expressions of templates, removes the
+	// branches never taken and merges their adjacent texts when they are
+	// parsed. The output is the same.
+	Optimize bool
+}
+
+// policy returns the security policy of the sandboxed templates.
+func (cfg *Config) policy() *SecurityPolicy {
+	if cfg.Policy == nil {
+		return &SecurityPolicy{}
+	}
+	return cfg.Policy
 }
 
 type Templates struct {
-	Cache  map[string]*Template
-	Lock   *sync.RWMutex
-	Update chan *Template
+	Config  *Config
+	Cache   map[string]*Template
+	Lock    *sync.RWMutex
+	Update  chan *Template
+	Globals *Scope          // variables visible to every template, read-only for templates
+	Tests   map[string]Test // tests added to the builtin ones, by name
+}
+
+func NewTemplates(cfg *Config) *Templates {
+	return &Templates{
+		Config:  cfg,
+		Cache:   make(map[string]*Template),
+		Lock:    &sync.RWMutex{},
+		Update:  make(chan *Template, 20),
+		Globals: &Scope{vars: make(map[string]any), readonly: true},
+		Tests:   make(map[string]Test),
+	}
 }
 
 func (ts *Templates) Watch() {
@@ -47,6 +99,24 @@ func (ts *Templates) Watch() {
 	}
 }
 
+// AddGlobal makes value visible to every template as name. Globals should be
+// added before rendering starts.
+func (ts *Templates) AddGlobal(name string, value any) {
+	ts.Lock.Lock()
+	ts.Globals.vars[name] = value
+	ts.Lock.Unlock()
+}
+
+// AddTest makes test usable by every template as name, e.g. admin for
+// {% if user is admin %}, replacing the builtin test of that name. The name
+// may be made of words, e.g. "member of". Tests should be added before
+// rendering starts.
+func (ts *Templates) AddTest(name string, test Test) {
+	ts.Lock.Lock()
+	ts.Tests[testName(name)] = test
+	ts.Lock.Unlock()
+}
+
 func (ts *Templates) checkVersion(t *Template) {
 	if t.checkVersion() {
 		ts.Update <- t
@@ -54,19 +124,21 @@ func (ts *Templates) checkVersion(t *Template) {
 }
 
 func (ts *Templates) hasTemplate(view string) bool {
-	_, ok := defaultTemplates.Cache[view]
+	ts.Lock.RLock()
+	defer ts.Lock.RUnlock()
+	_, ok := ts.Cache[view]
 	return ok
 }
 
 func (ts *Templates) addTemplate(t *Template) {
-	defaultTemplates.Lock.Lock()
-	defaultTemplates.Cache[t.Source.Identity] = t
-	defaultTemplates.Lock.Unlock()
+	ts.Lock.Lock()
+	ts.Cache[t.Source.Identity] = t
+	ts.Lock.Unlock()
 }
 
 func (ts *Templates) getTemplate(view string) *Template {
-	defaultTemplates.Lock.RLock()
-	defer defaultTemplates.Lock.RUnlock()
+	ts.Lock.RLock()
+	defer ts.Lock.RUnlock()
 
 	if t, ok := ts.Cache[view]; ok {
 		return t
@@ -74,6 +146,68 @@ func (ts *Templates) getTemplate(view string) *Template {
 	return nil
 }
 
+// load returns the template of the given path, parsing it on first use.
+func (ts *Templates) load(viewPath string) (*Template, error) {
+	if t := ts.getTemplate(viewPath); t != nil {
+		return t, nil
+	}
+	t := EmptyTemplate()
+	t.ts = ts
+	if err := t.ParseFile(viewPath); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ts.addTemplate(t)
+	return t, nil
+}
+
+// Render renders the template file of viewPath to w.
+func (ts *Templates) Render(w io.Writer, viewPath string, data ...any) error {
+	t, err := ts.load(viewPath)
+	if err != nil {
+		return err
+	}
+	if err := t.Execute(w, data...); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// RenderContext renders the template file of viewPath to w, and stops
+// when ctx is done. The values of ctx are visible to the template.
+func (ts *Templates) RenderContext(ctx context.Context, w io.Writer, viewPath string, data ...any) error {
+	t, err := ts.load(viewPath)
+	if err != nil {
+		return err
+	}
+	if err := t.ExecuteContext(ctx, w, data...); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// RenderString renders the template source view to w.
+func (ts *Templates) RenderString(w io.Writer, view string, data ...any) error {
+	identity := abstract([]byte(view))
+
+	if !ts.hasTemplate(identity) {
+		t := EmptyTemplate()
+		t.ts = ts
+		if err := t.ParseString(view); err != nil {
+			return errors.WithStack(err)
+		}
+		ts.addTemplate(t)
+	}
+
+	if t := ts.getTemplate(identity); t != nil {
+		if err := t.Execute(w, data...); err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("Template\n %s \nparsed error", view))
+}
+
 func EmptyTemplate() *Template {
 	return &Template{
 		Lock:          &sync.Mutex{},
@@ -87,11 +221,17 @@ type Template struct {
 	LastParseTime time.Time
 	Type          int
 	Source        *Source
+	ts            *Templates // templates the template belongs to
+	prog          *Program   // bytecode of Tr; or nil
 }
 
 func (t *Template) ParseFile(path string) error {
 	t.Type = TPL_TYPE_FILE
-	return t.parse(NewSourceFile(path))
+	src, err := NewSourceFile(path)
+	if err != nil {
+		return err
+	}
+	return t.parse(src)
 }
 
 func (t *Template) ParseString(tpl string) error {
@@ -99,20 +239,74 @@ func (t *Template) ParseString(tpl string) error {
 	return t.parse(NewSource(tpl))
 }
 
-func (t *Template) Execute(data ...any) []byte {
-	ds, _ := json.MarshalIndent(t.Tr, "tpl", "····")
-	return ds
+// Execute renders the template to w. Included and extended templates
+// are loaded from the templates t belongs to.
+func (t *Template) Execute(w io.Writer, data ...any) error {
+	return newState(nil, t.templates(), w, data...).execute(t)
+}
+
+// ExecuteContext renders the template to w like Execute, and stops when ctx
+// is done. The functions accepting a context.Context as first argument are
+// passed ctx, and its values are visible to the template.
+func (t *Template) ExecuteContext(ctx context.Context, w io.Writer, data ...any) error {
+	return newState(ctx, t.templates(), w, data...).execute(t)
+}
+
+// templates returns the templates t belongs to, the default ones for
+// a template created alone.
+func (t *Template) templates() *Templates {
+	if t.ts == nil {
+		return defaultTemplates
+	}
+	return t.ts
+}
+
+// tree returns the current syntax tree, which is replaced when the
+// template file changes.
+func (t *Template) tree() *Tree {
+	t.Lock.Lock()
+	defer t.Lock.Unlock()
+	return t.Tr
+}
+
+// compiled returns the current syntax tree along with its program, which
+// is compiled on first use.
+func (t *Template) compiled() (*Tree, *Program) {
+	t.Lock.Lock()
+	defer t.Lock.Unlock()
+	if t.Tr != nil && (t.prog == nil || t.prog.tree != t.Tr) {
+		t.prog = Compile(t.Tr)
+	}
+	return t.Tr, t.prog
 }
 
 func (t *Template) parse(s *Source) (err error) {
 	t.Source = s
 	var stream *TokenStream
-	stream, err = NewLexer().Tokenize(t.Source)
+	lex := NewLexer()
+	lex.Config = t.templates().Config
+	stream, err = lex.Tokenize(t.Source)
 	if err == nil {
+		t.Source = stream.Source
 		filter := &TokenFilter{Tr: &Tree{}}
 		if t.Tr, err = filter.Filter(stream); err != nil {
 			return
 		}
+		if lex.Config.Sandboxed {
+			if err = lex.Config.policy().Check(t.Source, t.Tr); err != nil {
+				t.Tr = nil
+				return
+			}
+		}
+		stripSpaceless(t.Tr)
+		if lex.Config.Minify {
+			minify(t.Tr)
+		}
+		if lex.Config.Optimize {
+			t.Tr.denied = lex.Config.policy().Check(t.Source, t.Tr)
+			t.Tr.optimized = true
+			optimize(t.Tr)
+		}
 		return
 	}
 	return errors.WithStack(err)
@@ -122,7 +316,11 @@ func (t *Template) update() error {
 	if t.Type == TPL_TYPE_FILE {
 		t.Lock.Lock()
 		defer t.Lock.Unlock()
-		return t.parse(NewSourceFile(t.Source.Identity))
+		src, err := NewSourceFile(t.Source.Identity)
+		if err != nil {
+			return err
+		}
+		return t.parse(src)
 	}
 	return nil
 }
@@ -138,43 +336,33 @@ func (t *Template) checkVersion() bool {
 	return false
 }
 
-func RenderString(w io.Writer, view string, data ...any) error {
-	identity := abstract([]byte(view))
+func AddGlobal(name string, value any) {
+	defaultTemplates.AddGlobal(name, value)
+}
 
-	if !defaultTemplates.hasTemplate(identity) {
-		t := EmptyTemplate()
-		if err := t.ParseString(view); err != nil {
-			return errors.WithStack(err)
-		}
-		defaultTemplates.addTemplate(t)
-	}
+// AddTest makes test usable by the default templates, and by the generated
+// code, as name.
+func AddTest(name string, test Test) {
+	defaultTemplates.AddTest(name, test)
+}
 
-	if t := defaultTemplates.getTemplate(identity); t != nil {
-		if _, err := w.Write(t.Execute(data)); err != nil {
-			return errors.WithStack(err)
-		}
-		return nil
-	}
+// Configure replaces the config of the default templates and drops the
+// templates parsed with the previous one.
+func Configure(cfg *Config) {
+	defaultTemplates.Lock.Lock()
+	defaultTemplates.Config = cfg
+	defaultTemplates.Cache = make(map[string]*Template)
+	defaultTemplates.Lock.Unlock()
+}
 
-	return errors.New(fmt.Sprintf("Template\n %s \nparsed error", view))
+func RenderString(w io.Writer, view string, data ...any) error {
+	return defaultTemplates.RenderString(w, view, data...)
 }
 
 func Render(w io.Writer, viewPath string, data ...any) error {
+	return defaultTemplates.Render(w, viewPath, data...)
+}
 
-	if !defaultTemplates.hasTemplate(viewPath) {
-		t := EmptyTemplate()
-		if err := t.ParseFile(viewPath); err != nil {
-			return errors.WithStack(err)
-		}
-		defaultTemplates.addTemplate(t)
-	}
-
-	if t := defaultTemplates.getTemplate(viewPath); t != nil {
-		if _, err := w.Write(t.Execute(data)); err != nil {
-			return errors.WithStack(err)
-		}
-		return nil
-	}
-
-	return errors.New(fmt.Sprintf("Template %s parsed error", viewPath))
+func RenderContext(ctx context.Context, w io.Writer, viewPath string, data ...any) error {
+	return defaultTemplates.RenderContext(ctx, w, viewPath, data...)
 }
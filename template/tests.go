@@ -0,0 +1,265 @@
+package template
+
+import (
+	"reflect"
+	"runtime/debug"
+	"strings"
+)
+
+// A Test reports whether the value v passes it, given the arguments of the
+// test, e.g. {% if n is divisible by(3) %} passes n and 3 to the test
+// divisible by. The tests are added with AddTest.
+type Test func(v any, args ...any) (bool, error)
+
+// builtinTests are the tests known to every template, except defined, which
+// is not applied to a value but to the expression tested.
+var builtinTests = map[string]Test{
+	"empty":        testEmpty,
+	"null":         testNull,
+	"even":         testEven,
+	"odd":          testOdd,
+	"iterable":     testIterable,
+	"divisible by": testDivisibleBy,
+	"same as":      testSameAs,
+}
+
+// testName returns the name of a test made of words separated by single
+// spaces, as they are parsed.
+func testName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// test returns the test named name, added to ts or builtin.
+func (ts *Templates) test(name string) (Test, bool) {
+	if t, ok := ts.Tests[name]; ok {
+		return t, true
+	}
+	t, ok := builtinTests[name]
+	return t, ok
+}
+
+// test applies the test name to v with args.
+func (s *state) test(name string, v any, args []any) (ok bool, e error) {
+	t, found := s.ts.test(name)
+	if !found {
+		return false, err("test: %s is not defined", name)
+	}
+	if !s.ts.Config.Repanic {
+		defer func() {
+			if r := recover(); r != nil {
+				ok, e = false, &PanicError{Func: "test " + name, Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return t(v, args...)
+}
+
+// evalTest reports whether the value of x passes its test, ignoring not.
+func (s *state) evalTest(x *TestExpr) (bool, error) {
+	if x.Name.Name == "defined" {
+		if x.Args != nil {
+			return false, err("evalTest: test defined takes no arguments")
+		}
+		return s.defined(x.X)
+	}
+	v, e := s.evalExpr(x.X)
+	if e != nil {
+		return false, e
+	}
+	var args []any
+	if x.Args != nil {
+		args = make([]any, len(x.Args.List))
+		for i, arg := range x.Args.List {
+			if args[i], e = s.evalExpr(arg); e != nil {
+				return false, e
+			}
+		}
+	}
+	return s.test(x.Name.Name, v, args)
+}
+
+// defined reports whether the variable, the property, the method or the
+// element x exists, e.g. not the missing keys of a map, nor the properties of
+// nil. The other expressions are defined, when they are evaluated without
+// error.
+func (s *state) defined(x Expr) (bool, error) {
+	var v, key any
+	var e error
+	property := true
+	switch x := x.(type) {
+	case *Ident:
+		i := strings.LastIndexByte(x.Name, '.')
+		if i < 0 {
+			_, ok := s.scope.Lookup(x.Name)
+			return ok, nil
+		}
+		v, e = s.lookup(x.Name[:i])
+		key = x.Name[i+1:]
+	case *SelectorExpr:
+		v, e = s.evalExpr(x.X)
+		key = x.Sel.Name
+	case *IndexExpr:
+		if v, e = s.evalExpr(x.X); e == nil {
+			key, e = s.evalExpr(x.Index)
+		}
+		property = false
+	default:
+		_, e = s.evalExpr(x)
+		return e == nil, e
+	}
+	return e == nil && s.has(v, key, property), nil
+}
+
+// has reports whether v has the property, or the element, key.
+func (s *state) has(v, key any, property bool) bool {
+	if cv, ok := v.(*contextValues); ok {
+		name, ok := key.(string)
+		return ok && cv.lookup(name) != nil
+	}
+	if val := indirect(reflect.ValueOf(v)); val.Kind() == reflect.Map {
+		k, e := convert(key, val.Type().Key())
+		return e == nil && val.MapIndex(k).IsValid()
+	}
+	var e error
+	if property {
+		// the methods are not called
+		name := key.(string)
+		if val := reflect.ValueOf(v); method(val, name).IsValid() {
+			return s.policy == nil || s.policy.allowsMethod(val.Type(), name)
+		}
+		_, e = s.property(v, name)
+	} else {
+		_, e = index(v, key)
+	}
+	return e == nil
+}
+
+// testArgs returns an error when the test name is not passed n arguments.
+func testArgs(name string, args []any, n int) error {
+	if len(args) != n {
+		return err("test %s: want %d arguments got %d", name, n, len(args))
+	}
+	return nil
+}
+
+// testInt returns v as an integer, for the test name taking n arguments.
+func testInt(name string, v any, args []any, n int) (int64, error) {
+	if e := testArgs(name, args, n); e != nil {
+		return 0, e
+	}
+	i, ok := toInt(v)
+	if !ok {
+		return 0, err("test %s: %T is not an integer", name, v)
+	}
+	return i, nil
+}
+
+// testEmpty reports whether v is nil, false, or a string, a slice, an array
+// or a map without elements. The numbers are never empty.
+func testEmpty(v any, args ...any) (bool, error) {
+	if e := testArgs("empty", args, 0); e != nil {
+		return false, e
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Invalid:
+		return true, nil
+	case reflect.Bool:
+		return !val.Bool(), nil
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return val.Len() == 0, nil
+	case reflect.Pointer, reflect.Interface, reflect.Func:
+		return val.IsNil(), nil
+	}
+	return false, nil
+}
+
+// testNull reports whether v is nil, or a nil pointer, map or slice.
+func testNull(v any, args ...any) (bool, error) {
+	if e := testArgs("null", args, 0); e != nil {
+		return false, e
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Invalid:
+		return true, nil
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return val.IsNil(), nil
+	}
+	return false, nil
+}
+
+func testEven(v any, args ...any) (bool, error) {
+	i, e := testInt("even", v, args, 0)
+	return e == nil && i%2 == 0, e
+}
+
+func testOdd(v any, args ...any) (bool, error) {
+	i, e := testInt("odd", v, args, 0)
+	return e == nil && i%2 != 0, e
+}
+
+// testIterable reports whether v is a slice, an array or a map, or a pointer
+// to one of them. The strings and the integers, which are ranged over too,
+// are not.
+func testIterable(v any, args ...any) (bool, error) {
+	if e := testArgs("iterable", args, 0); e != nil {
+		return false, e
+	}
+	switch indirect(reflect.ValueOf(v)).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return true, nil
+	}
+	return false, nil
+}
+
+func testDivisibleBy(v any, args ...any) (bool, error) {
+	i, e := testInt("divisible by", v, args, 1)
+	if e != nil {
+		return false, e
+	}
+	d, ok := toInt(args[0])
+	if !ok {
+		return false, err("test divisible by: %T is not an integer", args[0])
+	}
+	if d == 0 {
+		return false, err("test divisible by: integer divide by zero")
+	}
+	return i%d == 0, nil
+}
+
+// testSameAs reports whether v and args[0] are the same value: numbers both
+// integers, or both floats, of the same value; or values of the same type
+// which are equal, the maps, the slices and the functions being the same
+// when they share their memory.
+func testSameAs(v any, args ...any) (bool, error) {
+	if e := testArgs("same as", args, 1); e != nil {
+		return false, e
+	}
+	y := args[0]
+	xi, xf, xok := toNumber(v)
+	yi, yf, yok := toNumber(y)
+	if xok || yok {
+		if !xok || !yok || (xf == nil) != (yf == nil) {
+			return false, nil
+		}
+		if xf != nil {
+			return *xf == *yf, nil
+		}
+		return xi == yi, nil
+	}
+	if v == nil || y == nil {
+		return v == nil && y == nil, nil
+	}
+	a, b := reflect.ValueOf(v), reflect.ValueOf(y)
+	if a.Type() != b.Type() {
+		return false, nil
+	}
+	switch a.Kind() {
+	case reflect.Map, reflect.Func:
+		return a.Pointer() == b.Pointer(), nil
+	case reflect.Slice:
+		return a.Pointer() == b.Pointer() && a.Len() == b.Len(), nil
+	}
+	return a.Type().Comparable() && v == y, nil
+}
@@ -0,0 +1,134 @@
+package template
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestBuiltinTests(t *testing.T) {
+	var nilMap map[string]int
+	list := []int{1, 2}
+	m := map[string]int{"a": 1}
+	cases := []struct {
+		name string
+		v    any
+		args []any
+		want bool
+		err  string
+	}{
+		{"empty", nil, nil, true, ""},
+		{"empty", "", nil, true, ""},
+		{"empty", " ", nil, false, ""},
+		{"empty", []int{}, nil, true, ""},
+		{"empty", nilMap, nil, true, ""},
+		{"empty", false, nil, true, ""},
+		{"empty", (*int)(nil), nil, true, ""},
+		{"empty", 0, nil, false, ""},
+		{"empty", "", []any{1}, false, "test empty: want 0 arguments got 1"},
+		{"null", nil, nil, true, ""},
+		{"null", nilMap, nil, true, ""},
+		{"null", (*int)(nil), nil, true, ""},
+		{"null", "", nil, false, ""},
+		{"null", 0, nil, false, ""},
+		{"even", 2, nil, true, ""},
+		{"even", int8(-3), nil, false, ""},
+		{"even", uint(0), nil, true, ""},
+		{"even", "2", nil, false, "test even: string is not an integer"},
+		{"odd", -3, nil, true, ""},
+		{"odd", 4, nil, false, ""},
+		{"odd", 1.5, nil, false, "test odd: float64 is not an integer"},
+		{"iterable", list, nil, true, ""},
+		{"iterable", [2]int{}, nil, true, ""},
+		{"iterable", &m, nil, true, ""},
+		{"iterable", "ab", nil, false, ""},
+		{"iterable", 3, nil, false, ""},
+		{"divisible by", 9, []any{3}, true, ""},
+		{"divisible by", 9, []any{int64(2)}, false, ""},
+		{"divisible by", 9, []any{0}, false, "test divisible by: integer divide by zero"},
+		{"divisible by", 9, []any{"3"}, false, "test divisible by: string is not an integer"},
+		{"divisible by", 9, nil, false, "test divisible by: want 1 arguments got 0"},
+		{"same as", 1, []any{int64(1)}, true, ""},
+		{"same as", 1, []any{1.0}, false, ""},
+		{"same as", 1.5, []any{float32(1.5)}, true, ""},
+		{"same as", "a", []any{"a"}, true, ""},
+		{"same as", "1", []any{1}, false, ""},
+		{"same as", nil, []any{nil}, true, ""},
+		{"same as", list, []any{list}, true, ""},
+		{"same as", list, []any{[]int{1, 2}}, false, ""},
+		{"same as", list, []any{list[:1]}, false, ""},
+		{"same as", m, []any{m}, true, ""},
+		{"same as", m, []any{map[string]int{"a": 1}}, false, ""},
+		{"same as", []int{}, []any{nil}, false, ""},
+	}
+	for _, c := range cases {
+		got, e := builtinTests[c.name](c.v, c.args...)
+		msg := ""
+		if e != nil {
+			msg = e.Error()
+		}
+		if got != c.want || msg != c.err {
+			t.Errorf("%#v is %s%v: got %v, %q, want %v, %q", c.v, c.name, c.args, got, msg, c.want, c.err)
+		}
+	}
+}
+
+func TestIsTests(t *testing.T) {
+	data := KS(
+		KV("n", 6),
+		KV("list", []int{1}),
+		KV("m", map[string]int{"a": 1}),
+		KV("user", &struct{ Name string }{"bob"}),
+		KV("null", nil),
+	)
+	cases := []struct {
+		code string
+		want string
+		err  string
+	}{
+		{"{{ n is even }} {{ n is odd }} {{ n is not odd }} {{ n is divisible by(4) }}", "true false true false", ""},
+		{"{{ list is iterable }} {{ list is empty }} {{ null is empty }} {{ null is null }}", "true false true true", ""},
+		{"{% if n is divisible  by (3) %}yes{% endif %}", "yes", ""},
+		{"{{ n is same as(6) }} {{ list is same as(list) }} {{ m is not same as(m) }}", "true true false", ""},
+		{"{{ n is defined }} {{ nope is defined }} {{ m.a is defined }} {{ m.b is defined }}", "true false true false", ""},
+		{"{{ m[\"a\"] is defined }} {{ list[3] is defined }} {{ user.Name is defined }} {{ user.Age is not defined }}", "true false true true", ""},
+		{"{{ null.Name is defined }} {{ (n + 1) is defined }}", "false true", ""},
+		// the added tests replace the builtin ones
+		{"{{ n is positive }} {{ -n is positive }} {{ n is member of(list) }} {{ 1 is member of(list) }}", "true false false true", ""},
+		{"{{ 3 is even }}", "true", ""},
+		{"{{ n is prime }}", "", "test: prime is not defined"},
+		{"{{ n is divisible by(0) }}", "", "test divisible by: integer divide by zero"},
+		{"{{ n is defined(1) }}", "", "evalTest: test defined takes no arguments"},
+	}
+	for _, cfg := range []Config{{}, {Bytecode: true}, {Optimize: true}} {
+		for _, c := range cases {
+			ts := NewTemplates(&cfg)
+			ts.AddTest("positive", func(v any, args ...any) (bool, error) {
+				i, ok := toInt(v)
+				return ok && i > 0, nil
+			})
+			ts.AddTest(" member   of ", func(v any, args ...any) (bool, error) {
+				for _, x := range args[0].([]int) {
+					if i, _ := toInt(v); int(i) == x {
+						return true, nil
+					}
+				}
+				return false, nil
+			})
+			ts.AddTest("even", func(v any, args ...any) (bool, error) { return true, nil })
+			w := &strings.Builder{}
+			e := ts.RenderString(w, c.code, data)
+			got := ""
+			var re *RuntimeError
+			if errors.As(e, &re) {
+				got = re.Err.Error()
+			} else if e != nil {
+				got = e.Error()
+			}
+			if w.String() != c.want || got != c.err {
+				t.Errorf("%q (bytecode %v, optimize %v):\ngot  %q, %q\nwant %q, %q", c.code, cfg.Bytecode, cfg.Optimize, w.String(), got, c.want, c.err)
+			}
+		}
+	}
+}
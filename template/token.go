@@ -15,16 +15,20 @@ const (
 	TYPE_STRING
 	TYPE_OPERATOR
 	TYPE_PUNCTUATION
+	TYPE_RAW
+	TYPE_COMMENT
 )
 
 type Token struct {
-	value string
-	typ   int
-	line  int
+	value  string
+	typ    int
+	line   int
+	col    int // byte column, starting at 1
+	offset int // byte offset in the source, starting at 0
 }
 
 func (t *Token) String() string {
-	return fmt.Sprintf("%s(%s)(%d)", TypeToString(t.typ), t.value, t.line)
+	return fmt.Sprintf("%s(%s)(%d:%d)", TypeToString(t.typ), t.value, t.line, t.col)
 }
 
 func (t *Token) Value() string {
@@ -39,6 +43,24 @@ func (t *Token) Line() int {
 	return t.line
 }
 
+func (t *Token) Column() int {
+	return t.col
+}
+
+func (t *Token) Offset() int {
+	return t.offset
+}
+
+// Pos returns the position of the first character of the token.
+func (t *Token) Pos() Pos {
+	return Pos(t.offset + 1)
+}
+
+// End returns the position immediately after the token.
+func (t *Token) End() Pos {
+	return Pos(t.offset + len(t.value) + 1)
+}
+
 func TypeToString(typ int) (name string) {
 	switch typ {
 	case TYPE_EOF:
@@ -65,6 +87,10 @@ func TypeToString(typ int) (name string) {
 		name = "TYPE_OPERATOR"
 	case TYPE_PUNCTUATION:
 		name = "TYPE_PUNCTUATION"
+	case TYPE_RAW:
+		name = "TYPE_RAW"
+	case TYPE_COMMENT:
+		name = "TYPE_COMMENT"
 	default:
 		panic(fmt.Sprintf("Token of type '%d' does not exist.", typ))
 	}
@@ -97,6 +123,10 @@ func TypeToEnglish(typ int) string {
 		return "operator"
 	case TYPE_PUNCTUATION:
 		return "punctuation"
+	case TYPE_RAW:
+		return "raw text"
+	case TYPE_COMMENT:
+		return "comment"
 	default:
 		panic(fmt.Sprintf("Token of type '%d' does not exist.", typ))
 	}
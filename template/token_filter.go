@@ -2,20 +2,76 @@ package template
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
-var opPriority = map[string]int{
-	"&&": 0, "||": 0, "==": 1, ">=": 1,
-	"<=": 1, ">": 1, "<": 1, "!=": 1,
-	"+": 5, "-": 5, "%": 10, "*": 10,
-	"/": 10, "[": 15,
+// binaryPrec are the precedences of the binary operators, the higher
+// binding tighter, like in Go. They are all left associative.
+var binaryPrec = map[string]int{
+	"||": 1, "or": 1,
+	"&&": 2, "and": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3, "is": 3,
+	"+": 4, "-": 4, "^": 4, "b-or": 4, "b-xor": 4,
+	"*": 5, "/": 5, "%": 5, "<<": 5, ">>": 5, "&": 5, "b-and": 5,
 }
 
+const (
+	// notPrec is the precedence of the operand of not, which binds looser
+	// than the comparisons and the tests, e.g. not x is odd is
+	// not (x is odd), unlike !.
+	notPrec = 3
+	// unaryPrec is the precedence of the other unary operators, which bind
+	// tighter than the binary ones.
+	unaryPrec = 6
+	// postfixPrec is the precedence of the filters, the selectors, the
+	// indexes and the calls, which bind tighter than the unary operators.
+	postfixPrec = 7
+)
+
 type Tree struct {
 	List   []ASTNode
 	Extend *ExtendStmt
+	// optimized is set when the tree has been optimized, denied being
+	// then the error of the security policy checked before.
+	optimized bool
+	denied    error
+}
+
+func (tr *Tree) Pos() Pos {
+	if len(tr.List) > 0 {
+		return tr.List[0].Pos()
+	}
+	return NoPos
+}
+
+func (tr *Tree) End() Pos {
+	if len(tr.List) > 0 {
+		return tr.List[len(tr.List)-1].End()
+	}
+	return NoPos
+}
+
+// check returns the first tag, function or filter of the tree of src the
+// policy p denies, like p.Check. An optimized tree is not checked again,
+// the optimizer pruning the tags and the calls p may deny.
+func (tr *Tree) check(src *Source, p *SecurityPolicy) error {
+	if tr.optimized {
+		return tr.denied
+	}
+	return p.Check(src, tr)
+}
+
+// params returns the params statement of the template, nil if it has none.
+func (tr *Tree) params() *ParamsStmt {
+	for _, node := range tr.List {
+		if ps, ok := node.(*ParamsStmt); ok {
+			return ps
+		}
+	}
+	return nil
 }
 
 type TokenFilter struct {
@@ -23,8 +79,17 @@ type TokenFilter struct {
 	Tr     *Tree
 	Cursor Stmt
 	Stack  []Stmt
+	// Recover makes the filter skip the rest of a tag it cannot parse, or
+	// replace the bad expression, and go on with the next one. The errors
+	// are collected in Diagnostics.
+	Recover     bool
+	Diagnostics Diagnostics
+	tag         *Token // opening delimiter of the tag being parsed
 }
 
+// Filter builds the tree of the tokens of stream. It stops at the first
+// syntax error, unless the filter recovers from them, in which case the
+// tree is returned along with the diagnostics of the errors.
 func (filter *TokenFilter) Filter(stream *TokenStream) (*Tree, error) {
 	filter.TokenStream = stream
 	var err error
@@ -33,9 +98,13 @@ func (filter *TokenFilter) Filter(stream *TokenStream) (*Tree, error) {
 		switch token.Type() {
 		case TYPE_TEXT:
 			filter.parseText()
+		case TYPE_COMMENT:
+			filter.parseComment()
 		case TYPE_VAR_START:
+			filter.tag = token
 			err = filter.parseVar()
 		case TYPE_BLOCK_START:
+			filter.tag = token
 			token := filter.Next()
 			switch token.Value() {
 			case "if":
@@ -64,39 +133,124 @@ func (filter *TokenFilter) Filter(stream *TokenStream) (*Tree, error) {
 				err = filter.parseInclude()
 			case "extend":
 				err = filter.parseExtend(token)
+			case "with":
+				err = filter.parseWith()
+			case "endwith":
+				err = filter.popWith()
+			case "spaceless":
+				err = filter.parseSpaceless()
+			case "endspaceless":
+				err = filter.popSpaceless()
+			case "sandbox":
+				err = filter.parseSandbox()
+			case "endsandbox":
+				err = filter.popSandbox()
+			case "params":
+				err = filter.parseParams()
+			case "verbatim", "raw":
+				err = filter.parseRaw(token)
 			default:
-				return nil, filter.unexpected(token)
+				err = filter.unexpected(token)
 			}
 		}
 		if err != nil {
-			return nil, err
+			filter.locate(err)
+			if !filter.Recover {
+				return nil, err
+			}
+			filter.diagnose(err)
+			filter.sync()
+			err = nil
 		}
 	}
+	if err = filter.unclosed(); err != nil {
+		return nil, err
+	}
+	if len(filter.Diagnostics) > 0 {
+		return filter.Tr, filter.Diagnostics
+	}
 	return filter.Tr, nil
 }
 
+// Parse parses src, recovering from the syntax errors: the tags which
+// cannot be parsed are left out of the tree, and reported by the returned
+// diagnostics along with the other errors. Parse never panics.
+func Parse(src *Source) (*Tree, Diagnostics) {
+	lex := NewLexer()
+	lex.Recover = true
+	stream, e := lex.Tokenize(src)
+	if e != nil {
+		return &Tree{}, append(lex.Diagnostics, newDiagnostic(src, e, NoPos))
+	}
+	filter := &TokenFilter{Tr: &Tree{}, Recover: true}
+	tr, _ := filter.Filter(stream)
+	if tr == nil {
+		tr = filter.Tr
+	}
+	diags := append(lex.Diagnostics, filter.Diagnostics...)
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i], diags[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return tr, diags
+}
+
+// diagnose records the error e found in the current tag.
+func (filter *TokenFilter) diagnose(e error) {
+	pos := NoPos
+	if filter.tag != nil {
+		pos = filter.tag.Pos()
+	}
+	filter.Diagnostics = append(filter.Diagnostics, newDiagnostic(filter.Source, e, pos))
+}
+
+// sync skips the tokens up to the closing delimiter of the current tag.
+func (filter *TokenFilter) sync() {
+	tokens := filter.tokens
+	i := filter.current - 1
+	for j := i; j >= 0 && filter.tag != nil; j-- {
+		if tokens[j] == filter.tag {
+			i = j
+			break
+		}
+	}
+	for ; i >= 0 && i < len(tokens); i++ {
+		switch tokens[i].Type() {
+		case TYPE_BLOCK_END, TYPE_VAR_END:
+			filter.current = i + 1
+			return
+		case TYPE_EOF:
+			filter.current = i
+			return
+		}
+	}
+}
+
 func (filter *TokenFilter) parseExtend(token *Token) error {
 	if filter.Tr.Extend != nil {
 		return filter.unexpected(token)
 	}
-	es := &ExtendStmt{}
+	es := &ExtendStmt{TagPos: filter.tag.Pos()}
 	if token := filter.Next(); token.Type() == TYPE_STRING {
 		es.Ident = &BasicLit{
-			Kind:  TYPE_STRING,
-			Value: token.Value(),
+			ValuePos: token.Pos(),
+			Kind:     TYPE_STRING,
+			Value:    token.Value(),
 		}
+		es.EndPos = filter.tagEnd().End()
 		filter.Tr.Extend = es
 		return nil
 	}
-	return filter.unexpected(token)
+	return filter.expecting(filter.Current(), TypeToEnglish(TYPE_STRING))
 }
 
 func (filter *TokenFilter) parseInclude() (err error) {
-	is := &IncludeStmt{}
+	is := &IncludeStmt{TagPos: filter.tag.Pos()}
 	if token := filter.Next(); token.Type() == TYPE_STRING {
 		is.Ident = &BasicLit{
-			Kind:  TYPE_STRING,
-			Value: token.Value(),
+			ValuePos: token.Pos(),
+			Kind:     TYPE_STRING,
+			Value:    token.Value(),
 		}
 
 		if token = filter.Next(); token.Value() == "with" {
@@ -111,7 +265,7 @@ func (filter *TokenFilter) parseInclude() (err error) {
 				}
 				if len(ts) > 0 {
 					var as *AssignStmt
-					if as, err = parseAssignStmt(ts); err != nil {
+					if as, err = filter.parseAssignStmt(ts); err != nil {
 						return
 					} else if as != nil {
 						is.Params = append(is.Params, as)
@@ -119,40 +273,77 @@ func (filter *TokenFilter) parseInclude() (err error) {
 				}
 			}
 		} else if token.Type() != TYPE_BLOCK_END {
-			return filter.unexpected(token)
+			return filter.expecting(token, `"with"`)
 		}
+		is.EndPos = filter.Current().End()
 		filter.append(is)
 		return nil
 	}
-	return filter.unexpected(filter.Current())
+	return filter.expecting(filter.Current(), TypeToEnglish(TYPE_STRING))
 }
 
 func (filter *TokenFilter) parseText() {
 	t := &TextStmt{&BasicLit{
-		Kind:  TYPE_STRING,
-		Value: filter.Current().Value(),
+		ValuePos: filter.Current().Pos(),
+		Kind:     TYPE_STRING,
+		Value:    filter.Current().Value(),
 	}}
 	filter.append(t)
 }
 
+func (filter *TokenFilter) parseRaw(name *Token) error {
+	rs := &RawStmt{TagPos: filter.tag.Pos(), Name: name.Value()}
+	filter.tagEnd()
+	token := filter.Next()
+	if token.Type() != TYPE_RAW {
+		return filter.expecting(token, TypeToEnglish(TYPE_RAW))
+	}
+	rs.Text = &BasicLit{
+		ValuePos: token.Pos(),
+		Kind:     TYPE_STRING,
+		Value:    token.Value(),
+	}
+	if token = filter.Next(); token.Type() != TYPE_BLOCK_START {
+		return filter.expecting(token, TypeToEnglish(TYPE_BLOCK_START))
+	}
+	if token = filter.Next(); token.Value() != "end"+rs.Name {
+		return filter.expecting(token, "end"+rs.Name)
+	}
+	rs.EndPos = filter.tagEnd().End()
+	return filter.append(rs)
+}
+
+func (filter *TokenFilter) parseComment() {
+	token := filter.Current()
+	text := token.Value()[len(TAG_COMMENT[0]) : len(token.Value())-len(TAG_COMMENT[1])]
+	text = strings.TrimPrefix(strings.TrimPrefix(text, string(MODIFIER_TRIM)), string(MODIFIER_TRIM_LINE))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, string(MODIFIER_TRIM)), string(MODIFIER_TRIM_LINE))
+	filter.append(&CommentStmt{
+		TagPos: token.Pos(),
+		Text:   text,
+		EndPos: token.End(),
+	})
+}
+
 func (filter *TokenFilter) parseVar() (err error) {
-	vs := &ValueStmt{}
+	vs := &ValueStmt{TagPos: filter.tag.Pos()}
 	var ts []*Token
 	for !filter.IsEOF() {
 		if token := filter.Next(); token.Type() != TYPE_VAR_END {
 			ts = append(ts, token)
 		} else {
+			vs.EndPos = token.End()
 			break
 		}
 	}
-	if vs.Tok, err = parseExpr(ts); err == nil {
+	if vs.Tok, err = filter.expr(ts); err == nil {
 		filter.append(vs)
 	}
 	return
 }
 
 func (filter *TokenFilter) parseIf() (err error) {
-	is := &IfStmt{}
+	is := &IfStmt{TagPos: filter.tag.Pos()}
 	var ts []*Token
 	for !filter.IsEOF() {
 		if token := filter.Next(); token.Type() != TYPE_BLOCK_END {
@@ -161,7 +352,8 @@ func (filter *TokenFilter) parseIf() (err error) {
 			break
 		}
 	}
-	if is.Cond, err = parseExpr(ts); err == nil {
+	is.Body = filter.section()
+	if is.Cond, err = filter.expr(ts); err == nil {
 		filter.append(is)
 		filter.push(is)
 	}
@@ -169,20 +361,23 @@ func (filter *TokenFilter) parseIf() (err error) {
 }
 
 func (filter *TokenFilter) parseElse() (err error) {
-	es := &SectionStmt{}
 	if st, ok := filter.Cursor.(*IfStmt); ok {
-		st.Else = es
+		st.Body.Rbrace = filter.tag.Pos()
 	} else {
-		err = filter.unexpected(filter.Current())
+		return filter.unexpected(filter.Current())
 	}
+	filter.tagEnd()
+	es := filter.section()
+	filter.Cursor.(*IfStmt).Else = es
 	filter.push(es)
 	return
 }
 
 func (filter *TokenFilter) parseElseIf() (err error) {
-	efs := &IfStmt{}
+	efs := &IfStmt{TagPos: filter.tag.Pos()}
 	if st, ok := filter.Cursor.(*IfStmt); ok {
 		st.Else = efs
+		st.Body.Rbrace = filter.tag.Pos()
 	} else {
 		return filter.unexpected(filter.Current())
 	}
@@ -194,7 +389,8 @@ func (filter *TokenFilter) parseElseIf() (err error) {
 			break
 		}
 	}
-	if efs.Cond, err = parseExpr(ts); err != nil {
+	efs.Body = filter.section()
+	if efs.Cond, err = filter.expr(ts); err != nil {
 		return
 	}
 	// elseif do not in stack
@@ -203,7 +399,7 @@ func (filter *TokenFilter) parseElseIf() (err error) {
 }
 
 func (filter *TokenFilter) parseFor() (err error) {
-	fs := &ForStmt{}
+	fs := &ForStmt{TagPos: filter.tag.Pos()}
 	var (
 		tss   [][]*Token
 		token *Token
@@ -220,41 +416,47 @@ func (filter *TokenFilter) parseFor() (err error) {
 		tss = append(tss, ts)
 	}
 	if len(tss) == 3 {
-		if fs.Init, err = parseAssignStmt(tss[0]); err != nil {
+		if fs.Init, err = filter.parseAssignStmt(tss[0]); err != nil {
 			return
-		} else if fs.Cond, err = parseExpr(tss[1]); err != nil {
+		} else if fs.Cond, err = filter.expr(tss[1]); err != nil {
 			return
-		} else if fs.Post, err = parseAssignStmt(tss[2]); err != nil {
+		} else if fs.Post, err = filter.parseAssignStmt(tss[2]); err != nil {
 			return
 		}
 	} else if len(tss) == 1 {
-		if fs.Cond, err = parseExpr(tss[0]); err != nil {
+		if fs.Cond, err = filter.expr(tss[0]); err != nil {
 			return
 		}
 	} else {
 		err = filter.unexpected(token)
 		return
 	}
+	fs.Body = filter.section()
 	filter.append(fs)
 	filter.push(fs)
 	return
 }
 
 func (filter *TokenFilter) parseRange() (err error) {
-	rs := &RangeStmt{}
+	rs := &RangeStmt{TagPos: filter.tag.Pos()}
 	keyToken := filter.Next()
-	rs.Key = &Ident{keyToken.Value()}
+	rs.Key = &Ident{NamePos: keyToken.Pos(), Name: keyToken.Value()}
 	valueToken := filter.Next()
 	if valueToken.Value() == "," {
 		valueToken = filter.Next()
 	} else if valueToken.Value() == "=" {
 		valueToken = nil
 	} else {
-		err = filter.unexpected(valueToken)
+		err = filter.expecting(valueToken, `"," or "="`)
 		return
 	}
-	if valueToken != nil && valueToken.Value() != "_" {
-		rs.Value = &Ident{valueToken.Value()}
+	if valueToken != nil {
+		if valueToken.Value() != "_" {
+			rs.Value = &Ident{NamePos: valueToken.Pos(), Name: valueToken.Value()}
+		}
+		if token := filter.Next(); token.Value() != "=" {
+			return filter.expecting(token, `"="`)
+		}
 	}
 	var (
 		ts    []*Token
@@ -267,7 +469,8 @@ func (filter *TokenFilter) parseRange() (err error) {
 		}
 		ts = append(ts, token)
 	}
-	if rs.X, err = parseExpr(ts); err == nil {
+	rs.Body = filter.section()
+	if rs.X, err = filter.expr(ts); err == nil {
 		filter.append(rs)
 		filter.push(rs)
 	}
@@ -277,32 +480,140 @@ func (filter *TokenFilter) parseRange() (err error) {
 func (filter *TokenFilter) parseBlock() error {
 	token := filter.Next()
 	if token.Type() != TYPE_NAME {
-		return filter.unexpected(token)
+		return filter.expecting(token, TypeToEnglish(TYPE_NAME))
 	}
 	bs := &BlockStmt{
-		Name: &Ident{Name: token.Value()},
+		TagPos: filter.tag.Pos(),
+		Name:   &Ident{NamePos: token.Pos(), Name: token.Value()},
 	}
+	filter.tagEnd()
+	bs.Body = filter.section()
 	filter.append(bs)
 	filter.push(bs)
 	return nil
 }
 
 func (filter *TokenFilter) parseSet() (err error) {
-	ss := &SetStmt{}
+	ss := &SetStmt{TagPos: filter.tag.Pos()}
 	var ts []*Token
 	for !filter.IsEOF() {
 		if token := filter.Next(); token.Type() != TYPE_BLOCK_END {
 			ts = append(ts, token)
 		} else {
+			ss.EndPos = token.End()
 			break
 		}
 	}
-	if ss.Assign, err = parseAssignStmt(ts); err == nil {
+	if len(ts) == 0 {
+		return filter.expecting(filter.Current(), TypeToEnglish(TYPE_NAME))
+	}
+	if ss.Assign, err = filter.parseAssignStmt(ts); err == nil {
 		filter.append(ss)
 	}
 	return
 }
 
+func (filter *TokenFilter) parseWith() (err error) {
+	ws := &WithStmt{TagPos: filter.tag.Pos()}
+	var ts []*Token
+	for !filter.IsEOF() {
+		if token := filter.Next(); token.Type() != TYPE_BLOCK_END {
+			ts = append(ts, token)
+		} else {
+			break
+		}
+	}
+	if n := len(ts); n > 0 && ts[n-1].Type() == TYPE_NAME && ts[n-1].Value() == "only" {
+		ws.Only = true
+		ts = ts[:n-1]
+	}
+	if err = filter.withVars(ws, ts); err != nil {
+		if !filter.Recover {
+			return
+		}
+		// the block is opened anyway, for its end tag to close it
+		filter.locate(err)
+		filter.diagnose(err)
+	}
+	ws.Body = filter.section()
+	filter.append(ws)
+	filter.push(ws)
+	return nil
+}
+
+// withVars parses the hash or the expression ts of the variables of ws.
+func (filter *TokenFilter) withVars(ws *WithStmt, ts []*Token) (err error) {
+	n := len(ts)
+	if n == 0 {
+		return filter.expecting(filter.Current(), "hash or expression")
+	}
+	if ts[0].Value() == "{" && ts[n-1].Value() == "}" {
+		if ws.Params, err = parseHashParams(ts[1:n-1], ts[n-1]); err != nil {
+			return
+		}
+		if len(ws.Params) == 0 {
+			return filter.expecting(ts[n-1], TypeToEnglish(TYPE_NAME))
+		}
+		return nil
+	}
+	ws.X, err = filter.expr(ts)
+	return
+}
+
+func (filter *TokenFilter) parseSpaceless() error {
+	ss := &SpacelessStmt{TagPos: filter.tag.Pos()}
+	filter.tagEnd()
+	ss.Body = filter.section()
+	filter.append(ss)
+	filter.push(ss)
+	return nil
+}
+
+func (filter *TokenFilter) parseSandbox() error {
+	ss := &SandboxStmt{TagPos: filter.tag.Pos()}
+	filter.tagEnd()
+	ss.Body = filter.section()
+	filter.append(ss)
+	filter.push(ss)
+	return nil
+}
+
+// parseParams parses the parameters of the template, which are declared
+// once, outside of the blocks.
+func (filter *TokenFilter) parseParams() (err error) {
+	ps := &ParamsStmt{TagPos: filter.tag.Pos()}
+	var ts []*Token
+	for !filter.IsEOF() {
+		if token := filter.Next(); token.Type() != TYPE_BLOCK_END {
+			ts = append(ts, token)
+		} else {
+			ps.EndPos = token.End()
+			break
+		}
+	}
+	if filter.Cursor != nil || filter.Tr.params() != nil {
+		return filter.invalid("params must be declared once, outside of blocks")
+	}
+	if len(ts) == 0 {
+		return filter.invalid("params declares no parameter")
+	}
+	if ps.List, err = parseParamList(ts, filter.Current()); err != nil {
+		return
+	}
+	if msg := checkParamList(ps.List); msg != "" {
+		return filter.invalid(msg)
+	}
+	return filter.append(ps)
+}
+
+// invalid returns the error msg of the current tag.
+func (filter *TokenFilter) invalid(msg string) error {
+	e := NewParseTemplateFaild(filter.Source, filter.tag.Line())
+	e.Pos = filter.tag.Pos()
+	e.Message = msg
+	return e
+}
+
 func (filter *TokenFilter) append(s Stmt) error {
 	if filter.Cursor == nil {
 		filter.Tr.List = append(filter.Tr.List, s)
@@ -312,55 +623,193 @@ func (filter *TokenFilter) append(s Stmt) error {
 		st.Append(s)
 		return nil
 	}
-	return NewParseTemplateFaild(filter.Source, filter.Current().Line())
+	e := NewParseTemplateFaild(filter.Source, filter.Current().Line())
+	e.Pos = filter.Current().Pos()
+	return e
 }
 
-func (filter *TokenFilter) popBlock() (err error) {
-	_, ok := filter.Cursor.(*BlockStmt)
-	for !ok {
-		if filter.Cursor, err = filter.pop(); err != nil {
-			return
+func (filter *TokenFilter) popBlock() error {
+	_, err := endBlock[*BlockStmt](filter)
+	return err
+}
+
+func (filter *TokenFilter) popWith() error {
+	_, err := endBlock[*WithStmt](filter)
+	return err
+}
+
+func (filter *TokenFilter) popSpaceless() error {
+	_, err := endBlock[*SpacelessStmt](filter)
+	return err
+}
+
+// popSandbox closes the sandbox block, which may only hold includes.
+func (filter *TokenFilter) popSandbox() error {
+	ss, err := endBlock[*SandboxStmt](filter)
+	if err != nil {
+		return err
+	}
+	if ss.Body != nil {
+		for _, st := range ss.Body.List {
+			if ts, ok := st.(*TextStmt); ok && strings.TrimSpace(ts.Text.(*BasicLit).Value) == "" {
+				continue
+			} else if _, ok := st.(*IncludeStmt); !ok {
+				e := NewParseTemplateFaild(filter.Source, filter.Source.Position(st.Pos()).Line)
+				e.Pos = st.Pos()
+				e.Message = "only include tags are allowed in a sandbox"
+				return e
+			}
 		}
-		_, ok = filter.Cursor.(*BlockStmt)
 	}
-	filter.Cursor, err = filter.pop()
-	return
+	return nil
 }
 
-func (filter *TokenFilter) popRange() (err error) {
-	_, ok := filter.Cursor.(*RangeStmt)
-	for !ok {
-		if filter.Cursor, err = filter.pop(); err != nil {
-			return
+func (filter *TokenFilter) popRange() error {
+	_, err := endBlock[*RangeStmt](filter)
+	return err
+}
+
+func (filter *TokenFilter) popFor() error {
+	_, err := endBlock[*ForStmt](filter)
+	return err
+}
+
+func (filter *TokenFilter) popIf() error {
+	_, err := endBlock[*IfStmt](filter)
+	return err
+}
+
+// expectedEnd returns the end tag of the innermost open block, "" if
+// there is none.
+func (filter *TokenFilter) expectedEnd() string {
+	return endTag(filter.Cursor)
+}
+
+// endTag returns the end tag of the block s, "" if s is not closed by a tag.
+func endTag(s Stmt) string {
+	switch s.(type) {
+	case *IfStmt:
+		return "endif"
+	case *ForStmt:
+		return "endfor"
+	case *RangeStmt:
+		return "endrange"
+	case *BlockStmt:
+		return "endblock"
+	case *WithStmt:
+		return "endwith"
+	case *SpacelessStmt:
+		return "endspaceless"
+	case *SandboxStmt:
+		return "endsandbox"
+	}
+	return ""
+}
+
+// unclosed returns the error of the blocks still open at the end of the
+// template, located at their opening tag. The filter recovering from
+// errors reports all of them, the innermost first.
+func (filter *TokenFilter) unclosed() error {
+	for s := filter.Cursor; s != nil; s, _ = filter.pop() {
+		end := endTag(s)
+		if end == "" {
+			continue
+		}
+		e := NewUnexpectedEndOfFile(filter.Source, filter.Source.Position(s.Pos()).Line, end)
+		e.Pos = s.Pos()
+		if e := filter.unclosedBlock(e, e.Pos); e != nil {
+			return e
 		}
-		_, ok = filter.Cursor.(*RangeStmt)
 	}
-	filter.Cursor, err = filter.pop()
-	return
+	return nil
 }
 
-func (filter *TokenFilter) popFor() (err error) {
-	_, ok := filter.Cursor.(*ForStmt)
-	for !ok {
+// unclosedBlock returns the error e of a block not closed by its end tag,
+// located at pos. The filter recovering from errors reports it by a
+// diagnostic of its own rule instead, and returns nil.
+func (filter *TokenFilter) unclosedBlock(e error, pos Pos) error {
+	if !filter.Recover {
+		return e
+	}
+	d := newDiagnostic(filter.Source, e, pos)
+	d.Rule = RULE_UNCLOSED
+	filter.Diagnostics = append(filter.Diagnostics, d)
+	return nil
+}
+
+// endBlock closes the innermost open block of type T with the current end
+// tag. The blocks opened after it are not closed by their own end tag: the
+// error of the innermost one is returned, located at its opening tag, like
+// the blocks left open at the end of the template. The filter recovering
+// from errors reports all of them and closes them.
+func endBlock[T Stmt](filter *TokenFilter) (s T, err error) {
+	if !opened[T](filter) {
+		return s, filter.expecting(filter.Current(), filter.expectedEnd())
+	}
+	var unclosed error
+	for {
+		var ok bool
+		if s, ok = filter.Cursor.(T); ok {
+			break
+		}
+		// the else sections are closed by the end tag of their if
+		if end := endTag(filter.Cursor); end != "" {
+			e := NewParseTemplateFaild(filter.Source, filter.Source.Position(filter.Cursor.Pos()).Line)
+			e.Pos = filter.Cursor.Pos()
+			e.Message = "unclosed block"
+			e.Expected = end
+			if e := filter.unclosedBlock(e, e.Pos); e != nil && unclosed == nil {
+				unclosed = e
+			}
+		}
 		if filter.Cursor, err = filter.pop(); err != nil {
 			return
 		}
-		_, ok = filter.Cursor.(*ForStmt)
 	}
-	filter.Cursor, err = filter.pop()
+	filter.close(any(s).(blockCloser))
+	if filter.Cursor, err = filter.pop(); err == nil {
+		err = unclosed
+	}
 	return
 }
 
-func (filter *TokenFilter) popIf() (err error) {
-	_, ok := filter.Cursor.(*IfStmt)
-	for !ok {
-		if filter.Cursor, err = filter.pop(); err != nil {
-			return
+// opened reports whether a statement of type T is open, so that an end
+// tag does not close the blocks opened after it.
+func opened[T Stmt](filter *TokenFilter) bool {
+	if _, ok := filter.Cursor.(T); ok {
+		return true
+	}
+	for _, s := range filter.Stack {
+		if _, ok := s.(T); ok {
+			return true
 		}
-		_, ok = filter.Cursor.(*IfStmt)
 	}
-	filter.Cursor, err = filter.pop()
-	return
+	return false
+}
+
+// blockCloser is implemented by the statements closed by an end tag.
+type blockCloser interface {
+	close(tag, end Pos)
+}
+
+// close records the position of the current end tag in the statement it closes.
+func (filter *TokenFilter) close(st blockCloser) {
+	tag := filter.tag.Pos()
+	st.close(tag, filter.tagEnd().End())
+}
+
+// section creates the section following the current tag.
+func (filter *TokenFilter) section() *SectionStmt {
+	return &SectionStmt{Lbrace: filter.Current().End()}
+}
+
+// tagEnd skips the rest of the current tag and returns its closing delimiter.
+func (filter *TokenFilter) tagEnd() *Token {
+	token := filter.Current()
+	for token.Type() != TYPE_BLOCK_END && !filter.IsEOF() {
+		token = filter.Next()
+	}
+	return token
 }
 
 func (filter *TokenFilter) pop() (s Stmt, e error) {
@@ -384,291 +833,537 @@ func (filter *TokenFilter) push(s Stmt) {
 }
 
 func (filter *TokenFilter) unexpected(token *Token) error {
-	return NewUnexpectedToken(filter.Source, token.Line(), token.Value())
+	return filter.expecting(token, "")
 }
 
-type ExprWraper struct {
-	eStack  []Expr
-	opStack []*Token
+// expecting returns the error of the unexpected token, where expected was
+// expected instead.
+func (filter *TokenFilter) expecting(token *Token, expected string) error {
+	if token.Type() == TYPE_EOF {
+		e := NewUnexpectedEndOfFile(filter.Source, token.Line(), expected)
+		e.Pos = token.Pos()
+		return e
+	}
+	e := unexpectedToken(token, expected)
+	e.Source = filter.Source
+	return e
 }
 
-func (ew *ExprWraper) Wrap(stream []*Token) (expr Expr, e error) {
-	for i := 0; i < len(stream); i++ {
-		token := stream[i]
-		switch token.Type() {
-		case TYPE_STRING, TYPE_NUMBER:
-			ew.pushExpr(&BasicLit{Kind: token.Type(), Value: token.Value()})
-		case TYPE_NAME:
-			if i+1 < len(stream) {
-				p := stream[i+1]
-				if p.Value() == "(" {
-					ew.pushOp(token)
-					continue
-				}
+// locate sets the source of the syntax error e, which the expression
+// parser does not know.
+func (filter *TokenFilter) locate(e error) {
+	var tok *UnexpectedToken
+	if errors.As(e, &tok) && tok.Source == nil {
+		tok.Source = filter.Source
+	}
+}
+
+// unexpectedToken returns the error of the unexpected token, where expected
+// was expected instead. The source of the error is not set.
+func unexpectedToken(token *Token, expected string) *UnexpectedToken {
+	e := NewUnexpectedToken(nil, token.Line(), token.Value())
+	e.Pos = token.Pos()
+	e.Expected = expected
+	return e
+}
+
+// An exprParser parses an expression by precedence climbing.
+type exprParser struct {
+	ts []*Token // tokens of the expression
+	i  int      // index of the current token
+}
+
+// peek returns the current token, nil at the end of the expression.
+func (p *exprParser) peek() *Token {
+	if p.i < len(p.ts) {
+		return p.ts[p.i]
+	}
+	return nil
+}
+
+// next returns the current token and moves to the next one.
+func (p *exprParser) next() *Token {
+	t := p.peek()
+	p.i++
+	return t
+}
+
+// is reports whether the current token is the punctuation or the operator
+// value.
+func (p *exprParser) is(value string) bool {
+	t := p.peek()
+	return t != nil && t.Value() == value && (t.Type() == TYPE_PUNCTUATION || t.Type() == TYPE_OPERATOR)
+}
+
+// expect returns the current token, which must be the punctuation value,
+// and moves to the next one.
+func (p *exprParser) expect(value string) (*Token, error) {
+	if !p.is(value) {
+		return nil, p.unexpected(fmt.Sprintf("%q", value))
+	}
+	return p.next(), nil
+}
+
+// unexpected returns the error of the current token, where expected was
+// expected instead.
+func (p *exprParser) unexpected(expected string) error {
+	if t := p.peek(); t != nil {
+		return unexpectedToken(t, expected)
+	}
+	last := p.ts[len(p.ts)-1]
+	e := NewUnexpectedToken(nil, last.Line(), "")
+	e.Message = "unexpected end of expression"
+	e.Pos = last.End()
+	e.Expected = expected
+	return e
+}
+
+// binary parses the expression whose binary operators have a precedence
+// of at least prec.
+func (p *exprParser) binary(prec int) (Expr, error) {
+	x, e := p.unary()
+	if e != nil {
+		return nil, e
+	}
+	for {
+		op := p.peek()
+		if op == nil || op.Type() != TYPE_OPERATOR || binaryPrec[op.Value()] < prec {
+			return x, nil
+		}
+		p.next()
+		if op.Value() == "is" {
+			if x, e = p.test(x, op); e != nil {
+				return nil, e
 			}
-			ew.pushExpr(&Ident{token.Value()})
-		case TYPE_OPERATOR:
-			var ok bool
-			switch token.Value() {
-			case "+", "-", "*", "/", "%", "==", ">=", "<=", ">", "<", "!=":
-				if tt := ew.peekOp(); tt == nil {
-					ew.pushOp(token)
-				} else if ok, e = comparePriority(token, tt); e != nil {
-					return
-				} else if ok {
-					ew.pushOp(token)
-				} else {
-					if e = ew.revert(token); e != nil {
-						return
-					}
-				}
-			case "&&", "||":
-				var op *Token
-				if op = ew.peekOp(); op == nil {
-					ew.pushOp(token)
-				} else {
-					for op.Value() != "&&" && op.Value() != "||" && op.Value() != "(" {
-						if op, e = ew.popOp(); e == nil {
-							if e = ew.revert(op); e != nil {
-								return
-							}
-						} else {
-							break
-						}
-					}
-					ew.pushOp(token)
-				}
-			default:
-				e = err("Wrap: unexpected operator %s", token.Value())
-				return
+			continue
+		}
+		y, e := p.binary(binaryPrec[op.Value()] + 1)
+		if e != nil {
+			return nil, e
+		}
+		x = &BinaryExpr{X: x, Op: OpLit{OpPos: op.Pos(), Op: op.Value()}, Y: y}
+	}
+}
+
+// unary parses an operand, possibly preceded by unary operators.
+func (p *exprParser) unary() (Expr, error) {
+	if op := p.peek(); op != nil && op.Type() == TYPE_OPERATOR {
+		switch op.Value() {
+		case "-", "+", "!", "not":
+			p.next()
+			var x Expr
+			var e error
+			if op.Value() == "not" {
+				x, e = p.binary(notPrec)
+			} else {
+				x, e = p.unary()
 			}
-		case TYPE_PUNCTUATION:
-			var p *Token
-			switch token.Value() {
-			case ",":
-				if p = ew.peekOp(); p == nil {
-					e = err("Wrap: unexpected punctuation %s", token.Value())
-					return
-				}
-				for p.Value() != "(" && p.Value() != "," {
-					if p, e = ew.popOp(); e == nil {
-						if e = ew.revert(p); e != nil {
-							return
-						}
-					} else {
-						return nil, e
-					}
-				}
-				ew.pushOp(token)
-			case "(", "[":
-				ew.pushOp(token)
-			case "]":
-				for {
-					if p, e = ew.popOp(); e != nil {
-						return
-					}
-					if p.Value() == "[" {
-						break
-					}
-					if e = ew.revert(p); e != nil {
-						return
-					}
-				}
-			case ")":
-				for {
-					if p, e = ew.popOp(); e != nil {
-						return
-					}
-					if p.Value() == "(" {
-						break
-					}
-					if e = ew.revert(p); e != nil {
-						return
-					}
-				}
-				if p = ew.peekOp(); p == nil {
-					e = err("Wrap: unexpected punctuation %s", token.Value())
-					return
-				} else if p.Type() == TYPE_NAME {
-					p, _ = ew.popOp()
-					if e = ew.revert(p); e != nil {
-						return
-					}
-				}
-			default:
-				e = err("Wrap: unexpected punctuation %s", token.Value())
-				return
+			if e != nil {
+				return nil, e
 			}
+			return &UnaryExpr{Op: OpLit{OpPos: op.Pos(), Op: op.Value()}, X: x}, nil
 		}
 	}
-	var (
-		op *Token
-	)
-	for len(ew.opStack) > 0 {
-		if op, e = ew.popOp(); e != nil {
-			return
-		}
-		if e = ew.revert(op); e != nil {
-			return
+	x, e := p.operand()
+	if e != nil {
+		return nil, e
+	}
+	return p.postfix(x)
+}
+
+// operand parses a literal, a variable, a call or a parenthesized
+// expression.
+func (p *exprParser) operand() (Expr, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, p.unexpected("expression")
+	}
+	switch t.Type() {
+	case TYPE_STRING, TYPE_NUMBER:
+		p.next()
+		return &BasicLit{ValuePos: t.Pos(), Kind: t.Type(), Value: t.Value()}, nil
+	case TYPE_NAME:
+		p.next()
+		id := &Ident{NamePos: t.Pos(), Name: t.Value()}
+		if p.is("(") {
+			return p.call(&CallExpr{Fun: id})
 		}
+		return id, nil
 	}
-	expr, e = ew.popExpr()
-	if len(ew.eStack) > 0 {
-		fmt.Println(ew.eStack)
-		panic(len(ew.eStack))
+	if p.is("(") {
+		p.next()
+		x, e := p.binary(1)
+		if e != nil {
+			return nil, e
+		}
+		if _, e = p.expect(")"); e != nil {
+			return nil, e
+		}
+		return x, nil
 	}
-	return
+	return nil, p.unexpected("expression")
 }
 
-func (ew *ExprWraper) revert(op *Token) error {
-	if op.Type() == TYPE_NAME {
-		fun := &Ident{op.Value()}
-		call := &CallExpr{Fun: fun}
-		if expr := ew.peekExpr(); expr == nil {
-			return fmt.Errorf("revert: unexpected operator %s", op.Value())
-		} else if _, ok := expr.(*ArgsExpr); ok {
-			args, _ := ew.popExpr()
-			call.Args = args.(*ArgsExpr)
+// postfix parses the filters, the selectors and the indexes following x.
+func (p *exprParser) postfix(x Expr) (Expr, error) {
+	for {
+		t := p.peek()
+		switch {
+		case p.is("|"):
+			p.next()
+			name := p.peek()
+			if name == nil || name.Type() != TYPE_NAME {
+				return nil, p.unexpected("filter")
+			}
+			p.next()
+			call := &CallExpr{Pipe: t.Pos(), Fun: &Ident{NamePos: name.Pos(), Name: name.Value()}, Args: &ArgsExpr{List: []Expr{x}}}
+			if !p.is("(") {
+				x = call
+				continue
+			}
+			var e error
+			if x, e = p.call(call); e != nil {
+				return nil, e
+			}
+		case p.is("."):
+			p.next()
+			name := p.peek()
+			if name == nil || name.Type() != TYPE_NAME {
+				return nil, p.unexpected(TypeToEnglish(TYPE_NAME))
+			}
+			p.next()
+			// a dotted name selects each of its parts in turn
+			pos := name.Pos()
+			for _, sel := range strings.Split(name.Value(), ".") {
+				x = &SelectorExpr{X: x, Sel: &Ident{NamePos: pos, Name: sel}}
+				pos += Pos(len(sel) + 1)
+			}
+		case p.is("["):
+			p.next()
+			idx, e := p.binary(1)
+			if e != nil {
+				return nil, e
+			}
+			rbrack, e := p.expect("]")
+			if e != nil {
+				return nil, e
+			}
+			x = &IndexExpr{X: x, Lbrack: t.Pos(), Index: idx, Rbrack: rbrack.Pos()}
+		case p.is("("):
+			// only the functions and the methods are called
+			if _, ok := x.(*SelectorExpr); !ok {
+				return nil, p.unexpected("operator")
+			}
+			var e error
+			if x, e = p.call(&CallExpr{Fun: x}); e != nil {
+				return nil, e
+			}
+		default:
+			return x, nil
 		}
-		return nil
 	}
-	e1, err1 := ew.popExpr()
-	e2, err2 := ew.popExpr()
-	if err1 != nil {
-		return err1
+}
+
+// call parses the arguments of call, which follow the current "(", and
+// appends them to its arguments.
+func (p *exprParser) call(call *CallExpr) (*CallExpr, error) {
+	lparen, args, rparen, e := p.args()
+	if e != nil {
+		return nil, e
 	}
-	if err2 != nil {
-		return err2
+	call.Lparen, call.Rparen = lparen, rparen
+	if call.Args == nil {
+		call.Args = &ArgsExpr{}
 	}
-	expr, err := waperBinary(op, e1, e2)
-	if err != nil {
-		return nil
-	}
-	ew.pushExpr(expr)
-	return nil
+	call.Args.List = append(call.Args.List, args...)
+	return call, nil
 }
 
-func (ew *ExprWraper) peekExpr() Expr {
-	if len(ew.eStack) == 0 {
-		return nil
+// args parses the arguments between the current "(" and the matching ")",
+// and returns them along with the positions of the parentheses.
+func (p *exprParser) args() (lparen Pos, args []Expr, rparen Pos, e error) {
+	lparen = p.next().Pos()
+	for !p.is(")") {
+		if len(args) > 0 {
+			if _, e = p.expect(","); e != nil {
+				return
+			}
+		}
+		var x Expr
+		if x, e = p.binary(1); e != nil {
+			return
+		}
+		args = append(args, x)
 	}
-	return ew.eStack[len(ew.eStack)-1]
+	rparen = p.next().Pos()
+	return
 }
 
-func (ew *ExprWraper) pushExpr(e Expr) {
-	ew.eStack = append(ew.eStack, e)
+// test parses the test of x following is, e.g. divisible by(3). A test is
+// named by one or more words, and may be negated with not.
+func (p *exprParser) test(x Expr, is *Token) (Expr, error) {
+	tx := &TestExpr{X: x, Is: is.Pos()}
+	if t := p.peek(); t != nil && t.Type() == TYPE_OPERATOR && t.Value() == "not" {
+		p.next()
+		tx.Not = true
+	}
+	var words []string
+	for t := p.peek(); t != nil && t.Type() == TYPE_NAME; t = p.peek() {
+		if tx.Name == nil {
+			tx.Name = &Ident{NamePos: t.Pos()}
+		}
+		words = append(words, t.Value())
+		p.next()
+	}
+	if tx.Name == nil {
+		return nil, p.unexpected("test")
+	}
+	tx.Name.Name = strings.Join(words, " ")
+	if p.is("(") {
+		lparen, args, rparen, e := p.args()
+		if e != nil {
+			return nil, e
+		}
+		tx.Lparen, tx.Args, tx.Rparen = lparen, &ArgsExpr{List: args}, rparen
+	}
+	return tx, nil
 }
 
-func (ew *ExprWraper) popExpr() (Expr, error) {
-	if len(ew.eStack) == 0 {
-		return nil, err("popExpr: Try to pop expression from an empty stack")
+// parseAssignStmt parses the assignment ts of the current tag, e.g. i = 0
+// or i++.
+func (filter *TokenFilter) parseAssignStmt(ts []*Token) (*AssignStmt, error) {
+	if len(ts) < 2 {
+		return nil, filter.failed("assignment")
 	}
-	t := ew.eStack[len(ew.eStack)-1]
-	ew.eStack = ew.eStack[:len(ew.eStack)-1]
-	return t, nil
+	token := ts[0]
+	if token.Type() != TYPE_NAME {
+		return nil, filter.expecting(token, TypeToEnglish(TYPE_NAME))
+	}
+	ss := &AssignStmt{Lh: &Ident{NamePos: token.Pos(), Name: token.Value()}}
+	tok := ts[1]
+	ss.TokPos, ss.Tok = tok.Pos(), tok.Value()
+	if len(ts) == 2 && (tok.Value() == "++" || tok.Value() == "--") {
+		return ss, nil
+	} else if tok.Value() == "=" || assignOp(tok.Value()) != "" {
+		if len(ts) == 2 {
+			return nil, filter.expecting(tok, "expression")
+		}
+		expr, err := parseExpr(ts[2:])
+		if err != nil {
+			filter.locate(err)
+			return nil, err
+		}
+		ss.Rh = expr
+		return ss, nil
+	}
+	return nil, filter.failed("assignment")
 }
 
-func (ew *ExprWraper) peekOp() *Token {
-	if len(ew.opStack) == 0 {
-		return nil
-	}
-	return ew.opStack[len(ew.opStack)-1]
+// failed returns the error of the current tag, where expected was expected.
+func (filter *TokenFilter) failed(expected string) error {
+	e := NewParseTemplateFaild(filter.Source, filter.tag.Line())
+	e.Pos = filter.tag.Pos()
+	e.Expected = expected
+	return e
 }
 
-func (ew *ExprWraper) pushOp(op *Token) {
-	ew.opStack = append(ew.opStack, op)
+// parseHashParams parses the content of a hash literal, e.g. a: 1, "b": c,
+// into a list of assignments. The hash ends with the token end.
+func parseHashParams(ts []*Token, end *Token) ([]*AssignStmt, error) {
+	var (
+		params []*AssignStmt
+		next   = end // token following the current item
+		offset int
+	)
+	for _, part := range splitList(ts) {
+		if offset += len(part) + 1; offset <= len(ts) {
+			next = ts[offset-1]
+		} else {
+			next = end
+		}
+		if len(part) == 0 {
+			return nil, unexpectedToken(next, TypeToEnglish(TYPE_NAME))
+		}
+		key := part[0]
+		if key.Type() == TYPE_NAME && strings.Contains(key.Value(), ".") || key.Type() != TYPE_NAME && key.Type() != TYPE_STRING {
+			return nil, unexpectedToken(key, TypeToEnglish(TYPE_NAME))
+		}
+		if len(part) < 2 {
+			return nil, unexpectedToken(next, `":"`)
+		} else if part[1].Value() != ":" {
+			return nil, unexpectedToken(part[1], `":"`)
+		} else if len(part) == 2 {
+			return nil, unexpectedToken(next, "expression")
+		}
+		expr, e := parseExpr(part[2:])
+		if e != nil {
+			return nil, e
+		}
+		params = append(params, &AssignStmt{
+			Lh:     &Ident{NamePos: key.Pos(), Name: unquote(key.Value())},
+			TokPos: part[1].Pos(),
+			Tok:    part[1].Value(),
+			Rh:     expr,
+		})
+	}
+	return params, nil
 }
 
-func (ew *ExprWraper) popOp() (*Token, error) {
-	if len(ew.opStack) == 0 {
-		return nil, err("peekOp: Try to pop token from an empty stack")
+// splitList splits ts at the commas which are not between brackets. A
+// trailing comma is allowed.
+func splitList(ts []*Token) [][]*Token {
+	var (
+		parts [][]*Token
+		depth int
+		start int
+	)
+	for i := 0; i <= len(ts); i++ {
+		if i < len(ts) {
+			switch ts[i].Value() {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+			if depth > 0 || ts[i].Value() != "," || ts[i].Type() != TYPE_PUNCTUATION {
+				continue
+			}
+		}
+		part := ts[start:i]
+		start = i + 1
+		if len(part) == 0 && i == len(ts) {
+			break
+		}
+		parts = append(parts, part)
 	}
-	t := ew.opStack[len(ew.opStack)-1]
-	ew.opStack = ew.opStack[:len(ew.opStack)-1]
-	return t, nil
+	return parts
 }
 
-func waperBinary(op *Token, x1, x2 Expr) (Expr, error) {
-	switch op.Type() {
-	case TYPE_NAME:
-		fn := &Ident{op.Value()}
-		return &CallExpr{Fun: fn}, nil
-	case TYPE_OPERATOR:
-		switch op.Value() {
-		case "+", "-", "*", "/", "%", ">", "<", ">=", "<=", "!=", "==", "&&", "||":
-			return &BinaryExpr{X: x2, Op: OpLit{op.Value()}, Y: x1}, nil
+// parseParamList parses the content of a params tag, e.g.
+// user: User, title: string = "Home", into a list of parameters. The tag
+// ends with the token end.
+func parseParamList(ts []*Token, end *Token) ([]*Param, error) {
+	var (
+		params []*Param
+		next   = end // token following the current parameter
+		offset int
+	)
+	for _, part := range splitList(ts) {
+		if offset += len(part) + 1; offset <= len(ts) {
+			next = ts[offset-1]
+		} else {
+			next = end
 		}
-	case TYPE_PUNCTUATION:
-		switch op.Value() {
-		case "[":
-			return &IndexExpr{X: x1, Index: x2}, nil
-		case ",":
-			if arg, ok := x1.(*ArgsExpr); ok {
-				arg.List = append(arg.List, x2)
-				return arg, nil
+		if len(part) == 0 {
+			return nil, unexpectedToken(next, TypeToEnglish(TYPE_NAME))
+		}
+		name := part[0]
+		if name.Type() != TYPE_NAME || strings.Contains(name.Value(), ".") {
+			return nil, unexpectedToken(name, TypeToEnglish(TYPE_NAME))
+		}
+		if len(part) < 2 {
+			return nil, unexpectedToken(next, `":"`)
+		} else if part[1].Value() != ":" {
+			return nil, unexpectedToken(part[1], `":"`)
+		}
+		typ, i, e := parseType(append(part[:len(part):len(part)], next), 2)
+		if e != nil {
+			return nil, e
+		}
+		param := &Param{
+			Name:    &Ident{NamePos: name.Pos(), Name: name.Value()},
+			Colon:   part[1].Pos(),
+			TypePos: part[2].Pos(),
+			Type:    typ,
+		}
+		if i < len(part) {
+			if part[i].Value() != "=" {
+				return nil, unexpectedToken(part[i], `"=" or ","`)
+			} else if i+1 == len(part) {
+				return nil, unexpectedToken(part[i], "expression")
 			}
-			return &ArgsExpr{List: []Expr{x1, x2}}, nil
-		}
-	}
-	return nil, err("waperBinary: unexpected token %s", op.Value())
-}
-
-func parseAssignStmt(ts []*Token) (*AssignStmt, error) {
-	switch {
-	case len(ts) == 0:
-		return nil, err("parseAssignStmt: empty token list")
-	case len(ts) >= 2:
-		token := ts[0]
-		if token.Type() != TYPE_NAME {
-			return nil, err("parseAssignStmt: unexpected token %s", token.Value())
-		}
-		ss := &AssignStmt{Lh: &Ident{token.Value()}}
-		tok := ts[1]
-		ss.Tok = tok.Value()
-		if len(ts) == 2 && (tok.Value() == "++" || tok.Value() == "--") {
-			return ss, nil
-		} else if tok.Value() == "-=" || tok.Value() == "+=" || tok.Value() == "=" {
-			if expr, err := parseExpr(ts[2:]); err == nil {
-				ss.Rh = expr
-				return ss, nil
-			} else {
-				return nil, err
+			if param.Default, e = parseExpr(part[i+1:]); e != nil {
+				return nil, e
 			}
 		}
+		params = append(params, param)
 	}
-	return nil, err("parseAssignStmt: parse failed")
+	return params, nil
 }
 
-func parseExpr(ts []*Token) (Expr, error) {
-	return (&ExprWraper{}).Wrap(ts)
+// parseType parses the Go type starting at ts[i], and returns it along
+// with the index of the token following it. A type is a name, possibly
+// qualified by its package, or a pointer, slice or map type. The last token
+// of ts follows the tokens of the type.
+func parseType(ts []*Token, i int) (string, int, error) {
+	switch token := ts[i]; {
+	case token.Value() == "*":
+		typ, j, e := parseType(ts, i+1)
+		return "*" + typ, j, e
+	case token.Value() == "[":
+		if ts[i+1].Value() != "]" {
+			return "", i + 1, unexpectedToken(ts[i+1], `"]"`)
+		}
+		typ, j, e := parseType(ts, i+2)
+		return "[]" + typ, j, e
+	case token.Type() == TYPE_NAME && token.Value() == "map":
+		if ts[i+1].Value() != "[" {
+			return "", i + 1, unexpectedToken(ts[i+1], `"["`)
+		}
+		key, j, e := parseType(ts, i+2)
+		if e != nil {
+			return "", j, e
+		}
+		if ts[j].Value() != "]" {
+			return "", j, unexpectedToken(ts[j], `"]"`)
+		}
+		value, k, e := parseType(ts, j+1)
+		return "map[" + key + "]" + value, k, e
+	case token.Type() == TYPE_NAME:
+		return token.Value(), i + 1, nil
+	}
+	return "", i, unexpectedToken(ts[i], "type")
 }
 
-func comparePriority(t1, t2 *Token) (bool, error) {
-	if t1.Type() == TYPE_NAME {
-		return true, nil
+// expr parses the expression of tokens ts of the current tag. When the
+// filter recovers from errors, a bad expression is replaced with a BadExpr.
+func (filter *TokenFilter) expr(ts []*Token) (Expr, error) {
+	if len(ts) == 0 {
+		e := filter.expecting(filter.Current(), "expression")
+		if !filter.Recover {
+			return nil, e
+		}
+		bad := &BadExpr{From: filter.Current().Pos(), To: filter.Current().Pos()}
+		filter.Diagnostics = append(filter.Diagnostics, newDiagnostic(filter.Source, e, bad.From))
+		return bad, nil
 	}
-	if t1.Value() == "(" || t1.Value() == "[" {
-		return true, nil
+	x, e := parseExpr(ts)
+	filter.locate(e)
+	if e == nil || !filter.Recover {
+		return x, e
 	}
-
-	if t2.Type() == TYPE_NAME {
-		return false, nil
+	bad := &BadExpr{From: filter.tag.Pos(), To: filter.Current().End()}
+	if len(ts) > 0 {
+		bad.From, bad.To = ts[0].Pos(), ts[len(ts)-1].End()
 	}
+	filter.Diagnostics = append(filter.Diagnostics, newDiagnostic(filter.Source, e, bad.From))
+	return bad, nil
+}
 
-	if t2.Value() == "(" || t2.Value() == "[" {
-		return false, nil
+// parseExpr parses the expression of tokens ts.
+func parseExpr(ts []*Token) (Expr, error) {
+	if len(ts) == 0 {
+		return nil, err("parseExpr: empty token list")
 	}
-
-	if t2.Value() == "," {
-		return true, nil
+	p := &exprParser{ts: ts}
+	x, e := p.binary(1)
+	if e != nil {
+		return nil, e
 	}
-
-	p1, ok1 := opPriority[t1.Value()]
-	p2, ok2 := opPriority[t2.Value()]
-	if ok1 && ok2 {
-		return p1 > p2, nil
+	if p.peek() != nil {
+		return nil, p.unexpected("operator")
 	}
-	return false, err("comparePriority: undefined token")
+	return x, nil
 }
 
 func err(format string, data ...any) error {
@@ -0,0 +1,199 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// diagnose returns the diagnostics of the syntax errors of code as
+// line:column: message.
+func diagnose(code string) []string {
+	_, diags := Parse(NewSource(code))
+	var got []string
+	for _, d := range diags {
+		got = append(got, fmt.Sprintf("%d:%d: %s", d.Line, d.Column, d.Message))
+	}
+	return got
+}
+
+func TestUnclosedBlocks(t *testing.T) {
+	cases := []struct {
+		code string
+		want []string
+	}{
+		{"{% if a %}{% for i = 0; i < 2; i++ %}x{% endfor %}{% endif %}", nil},
+		{"{% if a %}x{% elseif b %}y{% else %}z{% endif %}", nil},
+		{"{% if a %}{% for i = 0; i < 2; i++ %}x{% endif %}", []string{
+			"1:11: unclosed block, expecting endfor",
+		}},
+		{"{% with {a: 1} %}{% range v = a %}{% endwith %}", []string{
+			"1:18: unclosed block, expecting endrange",
+		}},
+		{"{% if a %}x{% else %}\n{% for i = 0; i < 2; i++ %}x{% endif %}", []string{
+			"2:1: unclosed block, expecting endfor",
+		}},
+		{"{% if a %}{% for i = 0; i < 2; i++ %}{% with {b: 1} %}x{% endif %}", []string{
+			"1:11: unclosed block, expecting endfor",
+			"1:38: unclosed block, expecting endwith",
+		}},
+		{"{% block a %}{% if a %}{% endblock %}{% endif %}", []string{
+			"1:14: unclosed block, expecting endif",
+			`1:41: unexpected token "endif"`,
+		}},
+		{"{% spaceless %}{% sandbox %}\n{% endspaceless %}", []string{
+			"1:16: unclosed block, expecting endsandbox",
+		}},
+		{"a\n  {% if a %}{% for i = 0; i < 2; i++ %}", []string{
+			"2:3: unexpected end of template, expecting endif",
+			"2:13: unexpected end of template, expecting endfor",
+		}},
+		{"{% endif %}", []string{`1:4: unexpected token "endif"`}},
+	}
+	for _, c := range cases {
+		if got := diagnose(c.code); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q:\ngot  %q\nwant %q", c.code, got, c.want)
+		}
+		// without recovering, the first error is returned
+		e := EmptyTemplate().ParseString(c.code)
+		if (e == nil) != (c.want == nil) {
+			t.Errorf("%q: got error %v", c.code, e)
+		}
+	}
+}
+
+// group returns the expression x with its operations parenthesized.
+func group(x Expr) string {
+	switch x := x.(type) {
+	case *Ident:
+		return x.Name
+	case *BasicLit:
+		return x.Value
+	case *SelectorExpr:
+		return group(x.X) + "." + x.Sel.Name
+	case *IndexExpr:
+		return group(x.X) + "[" + group(x.Index) + "]"
+	case *UnaryExpr:
+		if x.Op.Op == "not" {
+			return "(not " + group(x.X) + ")"
+		}
+		return "(" + x.Op.Op + group(x.X) + ")"
+	case *BinaryExpr:
+		return "(" + group(x.X) + " " + x.Op.Op + " " + group(x.Y) + ")"
+	case *TestExpr:
+		is := " is "
+		if x.Not {
+			is = " is not "
+		}
+		return "(" + group(x.X) + is + x.Name.Name + ")"
+	case *CallExpr:
+		var args []string
+		if x.Args != nil {
+			for _, arg := range x.Args.List {
+				args = append(args, group(arg))
+			}
+		}
+		if x.Pipe.IsValid() {
+			return "(" + args[0] + " | " + group(x.Fun) + ")"
+		}
+		return group(x.Fun) + "(" + strings.Join(args, ", ") + ")"
+	}
+	return fmt.Sprintf("%T", x)
+}
+
+func TestPrecedence(t *testing.T) {
+	cases := []struct {
+		x, want string
+		value   string // rendered with a = 1 and b = 2
+	}{
+		{"a + b * 3", "(a + (b * 3))", "7"},
+		{"a * b + 3", "((a * b) + 3)", "5"},
+		{"a - b - 3", "((a - b) - 3)", "-4"},
+		{"12 / b / 3", "((12 / b) / 3)", "2"},
+		{"a + b == 3", "((a + b) == 3)", "true"},
+		{"a < b == (b > a)", "((a < b) == (b > a))", "true"},
+		{"a == 1 && b == 2 || 0", "(((a == 1) && (b == 2)) || 0)", "true"},
+		{"0 || a == 1 && b == 3", "(0 || ((a == 1) && (b == 3)))", "false"},
+		{"a or b and 0", "(a or (b and 0))", "true"},
+		{"not a == b", "(not (a == b))", "true"},
+		{"not a and 0", "((not a) and 0)", "false"},
+		{"not not a", "(not (not a))", "true"},
+		{"not b is odd", "(not (b is odd))", "true"},
+		{"!a == b", "((!a) == b)", "false"},
+		{"-a * b", "((-a) * b)", "-2"},
+		{"- a | abs", "(-(a | abs))", "-1"},
+		{"-2 * -b", "((-2) * (-b))", "4"},
+		// the filters bind tighter than the binary operators
+		{"a | b & 3", "((a | b) & 3)", ""},
+		{"b & 3 | abs", "(b & (3 | abs))", "2"},
+		{"a + b & 3", "(a + (b & 3))", "3"},
+		{"a ^ b * 3", "(a ^ (b * 3))", "7"},
+		{"a << b + 1", "((a << b) + 1)", "5"},
+		{"a b-or b b-and 3", "(a b-or (b b-and 3))", "3"},
+		{"a + b is even", "((a + b) is even)", "false"},
+		{"a is odd and b is even", "((a is odd) and (b is even))", "true"},
+		{"a is not odd == 0", "((a is not odd) == 0)", "false"},
+		{"a + b | abs", "(a + (b | abs))", "3"},
+	}
+	for _, c := range cases {
+		tr, diags := Parse(NewSource("{{ " + c.x + " }}"))
+		if len(diags) > 0 {
+			t.Errorf("%s: %v", c.x, diags)
+			continue
+		}
+		if got := group(tr.List[0].(*ValueStmt).Tok); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.x, got, c.want)
+		}
+		if c.value == "" {
+			continue
+		}
+		for _, cfg := range []Config{{}, {Bytecode: true}, {Optimize: true}} {
+			w := &strings.Builder{}
+			ts := NewTemplates(&cfg)
+			ts.AddGlobal("abs", func(x int) int {
+				if x < 0 {
+					return -x
+				}
+				return x
+			})
+			if e := ts.RenderString(w, "{{ "+c.x+" }}", KS(KV("a", 1), KV("b", 2))); e != nil {
+				t.Errorf("%s: %v", c.x, e)
+			} else if w.String() != c.value {
+				t.Errorf("%s %+v: got %s, want %s", c.x, cfg, w.String(), c.value)
+			}
+		}
+	}
+}
+
+func TestParseWith(t *testing.T) {
+	cases := []struct {
+		code string
+		want []string
+	}{
+		{"{% with {a: 1, b: c} only %}{% endwith %}{% with h %}{% endwith %}", nil},
+		{"{% with %}{% endwith %}", []string{`1:9: unexpected token "%}", expecting hash or expression`}},
+		{"{% with only %}{% endwith %}", []string{`1:14: unexpected token "%}", expecting hash or expression`}},
+		{"{% with {} %}{% endwith %}", []string{`1:10: unexpected token "}", expecting name`}},
+		{"{% with {a 1} %}{% endwith %}", []string{`1:12: unexpected token "1", expecting ":"`}},
+		{"{% with {a:} %}{% endwith %}", []string{`1:12: unexpected token "}", expecting expression`}},
+		{"{% with {a: 1,, b: 2} %}{% endwith %}", []string{`1:15: unexpected token ",", expecting name`}},
+		{"{% with {a.b: 1} %}{% endwith %}", []string{`1:10: unexpected token "a.b", expecting name`}},
+		{"{% with {1: 1} %}{% endwith %}", []string{`1:10: unexpected token "1", expecting name`}},
+		{"{% with {a: 1 +} %}{{ x y }}{% endwith %}", []string{
+			"1:16: unexpected end of expression, expecting expression",
+			`1:25: unexpected token "y", expecting operator`,
+		}},
+		{"{% with {a: 1} %}", []string{"1:1: unexpected end of template, expecting endwith"}},
+	}
+	for _, c := range cases {
+		if got := diagnose(c.code); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q:\ngot  %q\nwant %q", c.code, got, c.want)
+		}
+		// without recovering, the first error is returned
+		e := EmptyTemplate().ParseString(c.code)
+		if (e == nil) != (c.want == nil) {
+			t.Errorf("%q: got error %v", c.code, e)
+		}
+	}
+}
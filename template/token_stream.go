@@ -2,7 +2,6 @@ package template
 
 import (
 	"bytes"
-	"fmt"
 )
 
 type TokenStream struct {
@@ -19,29 +18,40 @@ func (ts *TokenStream) String() string {
 	return buf.String()
 }
 
+// Current returns the token returned by the last call of Next.
 func (ts *TokenStream) Current() *Token {
-	if ts.current >= len(ts.tokens) {
-		panic("Unexpected end of template")
-	}
-	return ts.tokens[ts.current-1]
+	return ts.at(ts.current - 1)
 }
 
+// Next advances to the next token and returns it. At the end of the stream,
+// the EOF token is returned again.
 func (ts *TokenStream) Next() *Token {
-	ts.current++
-	if ts.current >= len(ts.tokens) {
-		panic("Unexpected end of template")
+	if ts.current < len(ts.tokens) {
+		ts.current++
 	}
-	return ts.tokens[ts.current-1]
+	return ts.at(ts.current - 1)
 }
 
+// Peek returns the token n tokens after the next one, the EOF token when
+// there is none.
 func (ts *TokenStream) Peek(n int) *Token {
-	if ts.current+n >= len(ts.tokens) {
-		et := ts.tokens[ts.current+n-1]
-		panic(fmt.Sprintf("Unexpected end of template at line %d", et.Line()))
-	}
-	return ts.tokens[ts.current+n]
+	return ts.at(ts.current + n)
 }
 
 func (ts *TokenStream) IsEOF() bool {
-	return TYPE_EOF == ts.tokens[ts.current].Type()
+	return TYPE_EOF == ts.at(ts.current).Type()
+}
+
+// at returns the token of index i, the first or the last one when i is out
+// of range.
+func (ts *TokenStream) at(i int) *Token {
+	switch {
+	case len(ts.tokens) == 0:
+		return &Token{typ: TYPE_EOF}
+	case i < 0:
+		i = 0
+	case i >= len(ts.tokens):
+		i = len(ts.tokens) - 1
+	}
+	return ts.tokens[i]
 }
@@ -0,0 +1,337 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// A loop is a for or range loop being run.
+type loop struct {
+	n          int      // iterations started
+	it         iterator // values ranged over
+	key, value int32    // variables of a range, plus one; or 0
+}
+
+// run runs the code of p from pc to its return, in the current frame. It
+// executes the statements exactly like walk. The stack is grown once to
+// hold the operands of p.
+func (s *state) run(p *Program, pc int) error {
+	if n := len(s.stack) + p.stack; n > cap(s.stack) {
+		s.stack = append(make([]any, 0, n), s.stack...)
+	}
+	code := p.code
+	for {
+		in := code[pc]
+		pc++
+		switch in.op {
+		case opStep:
+			if e := s.canceled(); e != nil {
+				return e
+			}
+			s.frames[len(s.frames)-1].pos = Pos(in.a)
+			if e := s.step(); e != nil {
+				return e
+			}
+		case opText:
+			if _, e := io.WriteString(s.wr, p.strs[in.a]); e != nil {
+				return e
+			}
+		case opPush:
+			s.stack = append(s.stack, p.values[in.a])
+		case opLoad:
+			v, e := s.resolve(p.paths[in.a])
+			if e != nil {
+				return e
+			}
+			s.stack = append(s.stack, v)
+		case opIndex:
+			n := len(s.stack)
+			v, e := index(s.stack[n-2], s.stack[n-1])
+			if e != nil {
+				return e
+			}
+			s.stack[n-2] = v
+			s.stack = s.stack[:n-1]
+		case opBinary:
+			n := len(s.stack)
+			v, e := binary(p.strs[in.a], s.stack[n-2], s.stack[n-1])
+			if e != nil {
+				return e
+			}
+			s.stack[n-2] = v
+			s.stack = s.stack[:n-1]
+		case opUnary, opProperty:
+			n := len(s.stack)
+			var v any
+			var e error
+			if in.op == opUnary {
+				v, e = unary(p.strs[in.a], s.stack[n-1])
+			} else {
+				v, e = s.property(s.stack[n-1], p.strs[in.a])
+			}
+			if e != nil {
+				return e
+			}
+			s.stack[n-1] = v
+		case opAnd, opOr:
+			n := len(s.stack)
+			if t := truth(s.stack[n-1]); t == (in.op == opOr) {
+				s.stack[n-1] = t
+				pc = int(in.a)
+			} else {
+				s.stack = s.stack[:n-1]
+			}
+		case opTruth:
+			n := len(s.stack)
+			s.stack[n-1] = truth(s.stack[n-1])
+		case opFunc:
+			fn, e := s.function(p.strs[in.a], in.b != 0)
+			if e != nil {
+				return e
+			}
+			s.stack = append(s.stack, fn)
+		case opMethod:
+			n := len(s.stack)
+			fn, e := s.method(s.stack[n-1], p.nodes[in.b].(Expr), p.strs[in.a])
+			if e != nil {
+				return e
+			}
+			s.stack[n-1] = fn
+		case opCall:
+			n, argc := len(s.stack), int(in.b)
+			var args []any
+			if argc > 0 {
+				args = s.stack[n-argc:]
+			}
+			v, e := s.call(p.strs[in.a], s.stack[n-argc-1].(reflect.Value), args)
+			if e != nil {
+				return e
+			}
+			s.stack[n-argc-1] = v
+			s.stack = s.stack[:n-argc]
+		case opTest:
+			n, argc := len(s.stack), int(in.b)
+			var args []any
+			if argc > 0 {
+				args = s.stack[n-argc:]
+			}
+			ok, e := s.test(p.strs[in.a], s.stack[n-argc-1], args)
+			if e != nil {
+				return e
+			}
+			s.stack[n-argc-1] = ok
+			s.stack = s.stack[:n-argc]
+		case opDefined:
+			ok, e := s.defined(p.nodes[in.a].(Expr))
+			if e != nil {
+				return e
+			}
+			s.stack = append(s.stack, ok)
+		case opPrint:
+			n := len(s.stack)
+			v := s.stack[n-1]
+			s.stack = s.stack[:n-1]
+			if e := s.print(v); e != nil {
+				return e
+			}
+		case opJump:
+			pc = int(in.a)
+		case opJumpIfFalse:
+			n := len(s.stack)
+			if !truth(s.stack[n-1]) {
+				pc = int(in.a)
+			}
+			s.stack = s.stack[:n-1]
+		case opSet, opDefine:
+			n := len(s.stack)
+			v := s.stack[n-1]
+			s.stack = s.stack[:n-1]
+			set := s.scope.Set
+			if in.op == opDefine {
+				set = s.scope.Define
+			}
+			if e := set(p.strs[in.a], v); e != nil {
+				return e
+			}
+		case opPushScope:
+			s.saved = append(s.saved, s.push(s.scope.Push()))
+		case opPopScope:
+			n := len(s.saved)
+			s.pop(s.saved[n-1])
+			s.saved = s.saved[:n-1]
+		case opFor:
+			s.loops = append(s.loops, loop{})
+		case opLoop:
+			l := &s.loops[len(s.loops)-1]
+			if e := s.canceled(); e != nil {
+				return e
+			}
+			l.n++
+			if e := s.iterate(l.n); e != nil {
+				return e
+			}
+		case opRange:
+			n := len(s.stack)
+			it, e := newIterator(s.stack[n-1])
+			if e != nil {
+				return e
+			}
+			s.stack = s.stack[:n-1]
+			s.loops = append(s.loops, loop{it: it, key: in.a, value: in.b})
+		case opNext:
+			l := &s.loops[len(s.loops)-1]
+			k, v, ok := l.it.next()
+			if !ok {
+				pc = int(in.a)
+				break
+			}
+			if e := s.canceled(); e != nil {
+				return e
+			}
+			l.n++
+			if e := s.iterate(l.n); e != nil {
+				return e
+			}
+			if l.key > 0 {
+				s.scope.Define(p.strs[l.key-1], k)
+			}
+			if l.value > 0 {
+				s.scope.Define(p.strs[l.value-1], v)
+			}
+		case opEndLoop:
+			s.loops = s.loops[:len(s.loops)-1]
+		case opBlock:
+			if e := s.runBlock(p, p.nodes[in.a].(*BlockStmt)); e != nil {
+				return e
+			}
+		case opTemplate:
+			t, e := s.ts.load(p.strs[in.a])
+			if e != nil {
+				return e
+			}
+			s.stack = append(s.stack, t)
+		case opInclude:
+			if e := s.runInclude(p.nodes[in.a].(*IncludeStmt)); e != nil {
+				return e
+			}
+		case opHash:
+			if e := checkHash(s.stack[len(s.stack)-1]); e != nil {
+				return e
+			}
+		case opWith:
+			s.runWith(p.nodes[in.a].(*WithStmt))
+		case opCapture:
+			s.writers = append(s.writers, s.wr)
+			s.wr = &bytes.Buffer{}
+		case opFlush:
+			n := len(s.writers)
+			buf := s.wr.(*bytes.Buffer)
+			s.wr = s.writers[n-1]
+			s.writers = s.writers[:n-1]
+			if _, e := io.WriteString(s.wr, removeSpaces(buf.String())); e != nil {
+				return e
+			}
+		case opSandbox:
+			applied := s.policy == nil
+			if applied {
+				s.policy = s.ts.Config.policy()
+			}
+			s.stack = append(s.stack, applied)
+		case opUnsandbox:
+			n := len(s.stack)
+			if s.stack[n-1].(bool) {
+				s.policy = nil
+			}
+			s.stack = s.stack[:n-1]
+		case opFail:
+			return p.values[in.a].(error)
+		case opReturn:
+			return nil
+		}
+	}
+}
+
+// print writes v like the value statements of walk, without formatting
+// strings and integers.
+func (s *state) print(v any) error {
+	var e error
+	switch v := v.(type) {
+	case nil:
+	case string:
+		_, e = io.WriteString(s.wr, v)
+	case int64:
+		var buf [20]byte
+		_, e = s.wr.Write(strconv.AppendInt(buf[:0], v, 10))
+	default:
+		if e = s.printable(v); e == nil {
+			_, e = fmt.Fprint(s.wr, v)
+		}
+	}
+	return e
+}
+
+// runBlock runs the block bs of p, or the block overriding it, like
+// walkBlock.
+func (s *state) runBlock(p *Program, bs *BlockStmt) error {
+	f := s.frames[len(s.frames)-1]
+	if b, ok := s.blocks[bs.Name.Name]; ok && b.src != f.src {
+		return s.enter(&frame{src: b.src, block: bs.Name.Name}, func() error {
+			return s.run(b.prog, b.prog.blocks[b.stmt])
+		})
+	} else if ok {
+		p, bs = b.prog, b.stmt
+	}
+	name := f.block
+	f.block = bs.Name.Name
+	e := s.run(p, p.blocks[bs])
+	f.block = name
+	return e
+}
+
+// runInclude renders the template on the stack below the parameters of is,
+// like walkInclude.
+func (s *state) runInclude(is *IncludeStmt) error {
+	n := len(is.Params)
+	base := len(s.stack) - n
+	t := s.stack[base-1].(*Template)
+	scope := s.scope.Fork()
+	for i, as := range is.Params {
+		scope.Define(as.Lh.(*Ident).Name, s.stack[base+i])
+	}
+	s.stack = s.stack[:base-1]
+	blocks := s.blocks
+	s.blocks = nil
+	prev := s.push(scope)
+	e := s.execute(t)
+	s.pop(prev)
+	s.blocks = blocks
+	return e
+}
+
+// runWith pushes the scope of ws defining its variables and parameters,
+// which are on the stack, like walkWith.
+func (s *state) runWith(ws *WithStmt) {
+	var scope *Scope
+	if ws.Only {
+		scope = s.ts.Globals.Fork()
+	} else {
+		scope = s.scope.Fork()
+	}
+	n := len(ws.Params)
+	base := len(s.stack) - n
+	if ws.X != nil {
+		base--
+		iter := indirect(reflect.ValueOf(s.stack[base])).MapRange()
+		for iter.Next() {
+			scope.Define(iter.Key().String(), iter.Value().Interface())
+		}
+	}
+	for i, as := range ws.Params {
+		scope.Define(as.Lh.(*Ident).Name, s.stack[len(s.stack)-n+i])
+	}
+	s.stack = s.stack[:base]
+	s.saved = append(s.saved, s.push(scope))
+}
@@ -0,0 +1,442 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node ASTNode) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling
+// v.Visit(node); node must not be nil. If the visitor w returned by
+// v.Visit(node) is not nil, Walk is invoked recursively with visitor
+// w for each of the non-nil children of node, in the order they appear
+// in the source, followed by a call of w.Visit(nil).
+func Walk(v Visitor, node ASTNode) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	// walk children
+	switch n := node.(type) {
+	// Expressions
+	case *BadExpr, *Ident, *BasicLit, *OpLit, *ParenExpr:
+		// nothing to do
+
+	case *IndexExpr:
+		Walk(v, n.X)
+		Walk(v, n.Index)
+
+	case *SelectorExpr:
+		Walk(v, n.X)
+		Walk(v, n.Sel)
+
+	case *CallExpr:
+		if n.Pipe.IsValid() {
+			// the first argument precedes the filter
+			Walk(v, n.Args.List[0])
+			Walk(v, n.Fun)
+			walkExprList(v, n.Args.List[1:])
+			break
+		}
+		Walk(v, n.Fun)
+		if n.Args != nil {
+			Walk(v, n.Args)
+		}
+
+	case *ArgsExpr:
+		walkExprList(v, n.List)
+
+	case *UnaryExpr:
+		Walk(v, &n.Op)
+		Walk(v, n.X)
+
+	case *BinaryExpr:
+		Walk(v, n.X)
+		Walk(v, &n.Op)
+		Walk(v, n.Y)
+
+	case *TestExpr:
+		Walk(v, n.X)
+		Walk(v, n.Name)
+		if n.Args != nil {
+			Walk(v, n.Args)
+		}
+
+	// Statements
+	case *CommentStmt:
+		// nothing to do
+
+	case *AssignStmt:
+		Walk(v, n.Lh)
+		if n.Rh != nil {
+			Walk(v, n.Rh)
+		}
+
+	case *SectionStmt:
+		walkStmtList(v, n.List)
+
+	case *TextStmt:
+		Walk(v, n.Text)
+
+	case *RawStmt:
+		Walk(v, n.Text)
+
+	case *ValueStmt:
+		Walk(v, n.Tok)
+
+	case *SetStmt:
+		Walk(v, n.Assign)
+
+	case *IfStmt:
+		Walk(v, n.Cond)
+		walkSection(v, n.Body)
+		if n.Else != nil {
+			Walk(v, n.Else)
+		}
+
+	case *ForStmt:
+		if n.Init != nil {
+			Walk(v, n.Init)
+		}
+		if n.Cond != nil {
+			Walk(v, n.Cond)
+		}
+		if n.Post != nil {
+			Walk(v, n.Post)
+		}
+		walkSection(v, n.Body)
+
+	case *RangeStmt:
+		if n.Key != nil {
+			Walk(v, n.Key)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+		Walk(v, n.X)
+		walkSection(v, n.Body)
+
+	case *BlockStmt:
+		Walk(v, n.Name)
+		walkSection(v, n.Body)
+
+	case *IncludeStmt:
+		Walk(v, n.Ident)
+		walkAssignList(v, n.Params)
+
+	case *ExtendStmt:
+		Walk(v, n.Ident)
+
+	case *WithStmt:
+		walkAssignList(v, n.Params)
+		if n.X != nil {
+			Walk(v, n.X)
+		}
+		walkSection(v, n.Body)
+
+	case *SpacelessStmt:
+		walkSection(v, n.Body)
+
+	case *SandboxStmt:
+		walkSection(v, n.Body)
+
+	case *ParamsStmt:
+		for _, x := range n.List {
+			Walk(v, x)
+		}
+
+	case *Param:
+		Walk(v, n.Name)
+		if n.Default != nil {
+			Walk(v, n.Default)
+		}
+
+	// Template
+	case *Tree:
+		if n.Extend != nil {
+			Walk(v, n.Extend)
+		}
+		for _, x := range n.List {
+			Walk(v, x)
+		}
+
+	default:
+		panic(fmt.Sprintf("template.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkExprList(v Visitor, list []Expr) {
+	for _, x := range list {
+		Walk(v, x)
+	}
+}
+
+func walkStmtList(v Visitor, list []Stmt) {
+	for _, x := range list {
+		Walk(v, x)
+	}
+}
+
+func walkAssignList(v Visitor, list []*AssignStmt) {
+	for _, x := range list {
+		Walk(v, x)
+	}
+}
+
+func walkSection(v Visitor, section *SectionStmt) {
+	if section != nil {
+		Walk(v, section)
+	}
+}
+
+type inspector func(ASTNode) bool
+
+func (f inspector) Visit(node ASTNode) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling
+// f(node); node must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a
+// call of f(nil).
+func Inspect(node ASTNode, f func(ASTNode) bool) {
+	Walk(inspector(f), node)
+}
+
+// Rewrite traverses an AST in depth-first order and replaces every node
+// with the result of f, which is called after the children of the node
+// have been rewritten. Rewrite returns the result of f(node).
+//
+// A replacement must fit the place of the node it replaces, e.g. an
+// expression can only be replaced with an expression. When f returns nil
+// for a statement of a list or for an optional child, the node is removed.
+func Rewrite(node ASTNode, f func(ASTNode) ASTNode) ASTNode {
+	r := rewriter(f)
+	return r.node(node)
+}
+
+type rewriter func(ASTNode) ASTNode
+
+func (r rewriter) node(node ASTNode) ASTNode {
+	switch n := node.(type) {
+	// Expressions
+	case *BadExpr, *Ident, *BasicLit, *OpLit, *ParenExpr:
+		// nothing to do
+
+	case *IndexExpr:
+		n.X = r.expr(n.X)
+		n.Index = r.expr(n.Index)
+
+	case *SelectorExpr:
+		n.X = r.expr(n.X)
+		n.Sel = r.ident(n.Sel)
+
+	case *CallExpr:
+		n.Fun = r.expr(n.Fun)
+		if n.Args != nil {
+			n.Args = r.args(n.Args)
+		}
+
+	case *ArgsExpr:
+		list := n.List[:0]
+		for _, x := range n.List {
+			if x = r.expr(x); x != nil {
+				list = append(list, x)
+			}
+		}
+		n.List = list
+
+	case *UnaryExpr:
+		n.Op = r.op(n.Op, n)
+		n.X = r.expr(n.X)
+
+	case *BinaryExpr:
+		n.X = r.expr(n.X)
+		n.Op = r.op(n.Op, n)
+		n.Y = r.expr(n.Y)
+
+	case *TestExpr:
+		n.X = r.expr(n.X)
+		n.Name = r.ident(n.Name)
+		if n.Args != nil {
+			n.Args = r.args(n.Args)
+		}
+
+	// Statements
+	case *CommentStmt:
+		// nothing to do
+
+	case *AssignStmt:
+		n.Lh = r.expr(n.Lh)
+		if n.Rh != nil {
+			n.Rh = r.expr(n.Rh)
+		}
+
+	case *SectionStmt:
+		n.List = r.stmtList(n.List)
+
+	case *TextStmt:
+		n.Text = r.expr(n.Text)
+
+	case *RawStmt:
+		n.Text = r.expr(n.Text)
+
+	case *ValueStmt:
+		n.Tok = r.expr(n.Tok)
+
+	case *SetStmt:
+		n.Assign = r.assign(n.Assign)
+
+	case *IfStmt:
+		n.Cond = r.expr(n.Cond)
+		n.Body = r.section(n.Body)
+		if n.Else != nil {
+			n.Else = r.stmt(n.Else)
+		}
+
+	case *ForStmt:
+		if n.Init != nil {
+			n.Init = r.stmt(n.Init)
+		}
+		if n.Cond != nil {
+			n.Cond = r.expr(n.Cond)
+		}
+		if n.Post != nil {
+			n.Post = r.stmt(n.Post)
+		}
+		n.Body = r.section(n.Body)
+
+	case *RangeStmt:
+		if n.Key != nil {
+			n.Key = r.expr(n.Key)
+		}
+		if n.Value != nil {
+			n.Value = r.expr(n.Value)
+		}
+		n.X = r.expr(n.X)
+		n.Body = r.section(n.Body)
+
+	case *BlockStmt:
+		n.Name = r.ident(n.Name)
+		n.Body = r.section(n.Body)
+
+	case *IncludeStmt:
+		n.Ident = r.basicLit(n.Ident)
+		n.Params = r.assignList(n.Params)
+
+	case *ExtendStmt:
+		n.Ident = r.basicLit(n.Ident)
+
+	case *WithStmt:
+		n.Params = r.assignList(n.Params)
+		if n.X != nil {
+			n.X = r.expr(n.X)
+		}
+		n.Body = r.section(n.Body)
+
+	case *SpacelessStmt:
+		n.Body = r.section(n.Body)
+
+	case *SandboxStmt:
+		n.Body = r.section(n.Body)
+
+	case *ParamsStmt:
+		list := n.List[:0]
+		for _, x := range n.List {
+			if x = replacement(r, x); x != nil {
+				list = append(list, x)
+			}
+		}
+		n.List = list
+
+	case *Param:
+		n.Name = r.ident(n.Name)
+		if n.Default != nil {
+			n.Default = r.expr(n.Default)
+		}
+
+	// Template
+	case *Tree:
+		if n.Extend != nil {
+			n.Extend = r.extend(n.Extend)
+		}
+		list := n.List[:0]
+		for _, x := range n.List {
+			if x = r.node(x); x != nil {
+				list = append(list, x)
+			}
+		}
+		n.List = list
+
+	default:
+		panic(fmt.Sprintf("template.Rewrite: unexpected node type %T", n))
+	}
+
+	return r(node)
+}
+
+// replacement returns the rewritten node as a T, the zero T when the node
+// is removed. A nil node is kept as it is.
+func replacement[T ASTNode](r rewriter, node T) T {
+	var zero T
+	if v := reflect.ValueOf(node); !v.IsValid() || v.IsNil() {
+		return node
+	}
+	switch x := r.node(node).(type) {
+	case nil:
+		return zero
+	case T:
+		return x
+	default:
+		panic(fmt.Sprintf("template.Rewrite: cannot replace %T with %T", node, x))
+	}
+}
+
+func (r rewriter) expr(x Expr) Expr                    { return replacement(r, x) }
+func (r rewriter) stmt(s Stmt) Stmt                    { return replacement(r, s) }
+func (r rewriter) ident(x *Ident) *Ident               { return replacement(r, x) }
+func (r rewriter) basicLit(x *BasicLit) *BasicLit      { return replacement(r, x) }
+func (r rewriter) args(x *ArgsExpr) *ArgsExpr          { return replacement(r, x) }
+func (r rewriter) assign(s *AssignStmt) *AssignStmt    { return replacement(r, s) }
+func (r rewriter) section(s *SectionStmt) *SectionStmt { return replacement(r, s) }
+func (r rewriter) extend(s *ExtendStmt) *ExtendStmt    { return replacement(r, s) }
+
+// op returns the replacement of the operator of n, which must be an
+// operator.
+func (r rewriter) op(op OpLit, n ASTNode) OpLit {
+	if x, ok := r(&op).(*OpLit); ok && x != nil {
+		return *x
+	}
+	panic(fmt.Sprintf("template.Rewrite: cannot replace operator %s of %T", op.Op, n))
+}
+
+func (r rewriter) stmtList(list []Stmt) []Stmt {
+	out := list[:0]
+	for _, s := range list {
+		if s = r.stmt(s); s != nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (r rewriter) assignList(list []*AssignStmt) []*AssignStmt {
+	out := list[:0]
+	for _, s := range list {
+		if s = r.assign(s); s != nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
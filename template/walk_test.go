@@ -0,0 +1,199 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recorder records the nodes it visits, indented by their depth, and does
+// not visit the children of the nodes skip returns true for.
+type recorder struct {
+	nodes *[]string
+	depth int
+	skip  func(ASTNode) bool
+}
+
+func (r recorder) Visit(node ASTNode) Visitor {
+	if node == nil {
+		*r.nodes = append(*r.nodes, strings.Repeat(" ", r.depth-1)+"nil")
+		return nil
+	}
+	*r.nodes = append(*r.nodes, strings.Repeat(" ", r.depth)+strings.TrimPrefix(fmt.Sprintf("%T", node), "*template."))
+	if r.skip != nil && r.skip(node) {
+		return nil
+	}
+	r.depth++
+	return r
+}
+
+func TestWalk(t *testing.T) {
+	tr, diags := Parse(NewSource("{% if a + 1 %}x{% else %}{{ f(b) }}{% endif %}"))
+	if len(diags) > 0 {
+		t.Fatal(diags)
+	}
+	var got []string
+	Walk(recorder{nodes: &got}, tr)
+	want := []string{
+		"Tree",
+		" IfStmt",
+		"  BinaryExpr",
+		"   Ident",
+		"   nil",
+		"   OpLit",
+		"   nil",
+		"   BasicLit",
+		"   nil",
+		"  nil",
+		"  SectionStmt",
+		"   TextStmt",
+		"    BasicLit",
+		"    nil",
+		"   nil",
+		"  nil",
+		"  SectionStmt",
+		"   ValueStmt",
+		"    CallExpr",
+		"     Ident",
+		"     nil",
+		"     ArgsExpr",
+		"      Ident",
+		"      nil",
+		"     nil",
+		"    nil",
+		"   nil",
+		"  nil",
+		" nil",
+		"nil",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the children of the skipped nodes are not visited
+	got = nil
+	Walk(recorder{nodes: &got, skip: func(n ASTNode) bool {
+		_, ok := n.(*SectionStmt)
+		return ok
+	}}, tr)
+	want = []string{
+		"Tree",
+		" IfStmt",
+		"  BinaryExpr",
+		"   Ident",
+		"   nil",
+		"   OpLit",
+		"   nil",
+		"   BasicLit",
+		"   nil",
+		"  nil",
+		"  SectionStmt",
+		"  SectionStmt",
+		" nil",
+		"nil",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInspect(t *testing.T) {
+	tr, diags := Parse(NewSource("{{ a }}{% for i = 0; i < n; i++ %}{{ b[i] }}{% endfor %}{{ c.d }}"))
+	if len(diags) > 0 {
+		t.Fatal(diags)
+	}
+	var idents []string
+	Inspect(tr, func(n ASTNode) bool {
+		if id, ok := n.(*Ident); ok {
+			idents = append(idents, id.Name)
+		}
+		_, loop := n.(*SectionStmt)
+		return !loop
+	})
+	if want := []string{"a", "i", "i", "n", "i", "c.d"}; !reflect.DeepEqual(idents, want) {
+		t.Errorf("got %v, want %v", idents, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	cases := []struct {
+		code string
+		f    func(ASTNode) ASTNode
+		want string
+	}{
+		// the variables x are replaced with 2
+		{"{{ x * 3 }}{% if x %}{{ x }}{% endif %}{{ y }}", func(n ASTNode) ASTNode {
+			if id, ok := n.(*Ident); ok && id.Name == "x" {
+				return &BasicLit{ValuePos: id.NamePos, Kind: TYPE_NUMBER, Value: "2"}
+			}
+			return n
+		}, "62y"},
+		// the operators are replaced
+		{"{{ 1 + 2 }}{{ 5 - 1 }}", func(n ASTNode) ASTNode {
+			if op, ok := n.(*OpLit); ok && op.Op == "+" {
+				return &OpLit{OpPos: op.OpPos, Op: "*"}
+			}
+			return n
+		}, "24"},
+		// the texts are removed, in the blocks too
+		{"a{{ y }}b{% for i = 0; i < 2; i++ %}c{{ i }}{% endfor %}", func(n ASTNode) ASTNode {
+			if _, ok := n.(*TextStmt); ok {
+				return nil
+			}
+			return n
+		}, "y01"},
+		// the else branch is removed
+		{"{% if 0 %}a{% else %}b{% endif %}c", func(n ASTNode) ASTNode {
+			if s, ok := n.(*SectionStmt); ok && len(s.List) == 1 {
+				if text, ok := s.List[0].(*TextStmt); ok && text.Text.(*BasicLit).Value == "b" {
+					return nil
+				}
+			}
+			return n
+		}, "c"},
+		// the children are rewritten before their parent
+		{"{{ y }}{% if 1 %}{{ y }}{% endif %}", func(n ASTNode) ASTNode {
+			switch n := n.(type) {
+			case *Ident:
+				return &BasicLit{ValuePos: n.NamePos, Kind: TYPE_STRING, Value: "z"}
+			case *ValueStmt:
+				if _, ok := n.Tok.(*BasicLit); !ok {
+					panic("child not rewritten")
+				}
+			}
+			return n
+		}, "zz"},
+	}
+	for _, c := range cases {
+		tpl := EmptyTemplate()
+		if e := tpl.ParseString(c.code); e != nil {
+			t.Fatal(e)
+		}
+		if tr := Rewrite(tpl.Tr, c.f); tr != tpl.Tr {
+			t.Errorf("%q: got tree %p, want %p", c.code, tr, tpl.Tr)
+		}
+		w := &strings.Builder{}
+		if e := tpl.Execute(w, KS(KV("x", 1), KV("y", "y"))); e != nil {
+			t.Errorf("%q: %v", c.code, e)
+		} else if w.String() != c.want {
+			t.Errorf("%q: got %q, want %q", c.code, w.String(), c.want)
+		}
+	}
+}
+
+func TestRewriteMismatch(t *testing.T) {
+	tr, _ := Parse(NewSource("{{ x }}"))
+	defer func() {
+		want := "template.Rewrite: cannot replace *template.Ident with *template.TextStmt"
+		if r := recover(); r != want {
+			t.Errorf("got panic %v, want %s", r, want)
+		}
+	}()
+	Rewrite(tr, func(n ASTNode) ASTNode {
+		if _, ok := n.(*Ident); ok {
+			return &TextStmt{}
+		}
+		return n
+	})
+}